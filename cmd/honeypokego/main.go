@@ -5,9 +5,32 @@
 package main
 
 import (
+	"flag"
+
 	"github.com/bocajspear1/honeypoke-go/internal/starter"
 )
 
 func main() {
-	starter.StartHoneyPoke()
+	if starter.RunBindHelper() {
+		return
+	}
+
+	importMissed := flag.String("import-missed", "", "Import a legacy missed.txt file into the missed port database and exit")
+	exportMissed := flag.String("export-missed", "", "Export the missed port database to a legacy missed.txt file and exit")
+	showMissed := flag.Int("show-missed", 0, "Show the given number of most missed ports and exit")
+	replay := flag.String("replay", "", "Replay a pcap file through the watcher instead of listening live, then exit")
+	replayListeners := flag.Bool("replay-listeners", false, "With -replay, also pass TCP streams to the configured TCP ports through their listeners")
+	flag.Parse()
+
+	if *importMissed != "" {
+		starter.ImportMissed(*importMissed)
+	} else if *exportMissed != "" {
+		starter.ExportMissed(*exportMissed)
+	} else if *showMissed > 0 {
+		starter.ShowMissed(*showMissed)
+	} else if *replay != "" {
+		starter.ReplayCapture(*replay, *replayListeners)
+	} else {
+		starter.StartHoneyPoke()
+	}
 }
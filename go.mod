@@ -1,6 +1,6 @@
 module github.com/bocajspear1/honeypoke-go
 
-go 1.13
+go 1.17
 
 require (
 	github.com/elastic/go-elasticsearch/v6 v6.8.2
@@ -8,5 +8,16 @@ require (
 	github.com/elastic/go-elasticsearch/v8 v8.8.0
 	github.com/google/gopacket v1.1.17
 	github.com/oschwald/geoip2-golang v1.3.0
+	go.etcd.io/bbolt v1.3.9
+	golang.org/x/net v0.11.0
+	golang.org/x/sys v0.9.0
+)
+
+require (
+	github.com/elastic/elastic-transport-go/v8 v8.0.0-20230329154755-1a3c63de0db6 // indirect
+)
+
+require (
+	github.com/elastic/elastic-transport-go/v8 v8.0.0-20230329154755-1a3c63de0db6 // indirect
 	github.com/oschwald/maxminddb-golang v1.5.0 // indirect
 )
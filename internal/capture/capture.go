@@ -0,0 +1,240 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package capture
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// SessionDirectory is where session captures are written
+const SessionDirectory = "./sessions"
+
+// Longest to wait after a session ends for our FIN or RST to reach the watcher
+const sessionSettle = time.Second
+
+// How far before a session was accepted to look for its packets, to get the handshake
+const sessionSlack = 10 * time.Second
+
+const snapLength = 65536
+
+// Config controls the rolling capture
+type Config struct {
+	Enabled bool
+	// How long packets are kept
+	Retention time.Duration
+	// Most bytes of packets kept in memory, older packets are dropped first
+	MaxBytes int
+}
+
+type packet struct {
+	info     gopacket.CaptureInfo
+	data     []byte
+	linkType layers.LinkType
+	keys     [2]sessionKey
+}
+
+// sessionKey is a session as a listener sees it, the client and our port
+type sessionKey struct {
+	client     string
+	clientPort uint16
+	port       uint16
+}
+
+// flow is the packets of one session in the ring, by sequence number
+type flow struct {
+	packets []uint64
+	// Closed once we've sent a FIN or RST
+	ended chan bool
+}
+
+// The watcher adds every TCP packet it sees, and listeners pull out their session when it ends.
+// Packets don't say which side is us, so each is indexed both ways.
+var ring = struct {
+	lock    sync.Mutex
+	config  Config
+	packets []packet
+	// Sequence number of packets[0]
+	first uint64
+	size  int
+	flows map[sessionKey]*flow
+}{flows: make(map[sessionKey]*flow)}
+
+// Configure sets up the rolling capture, it's off until this is called with Enabled set
+func Configure(config Config) {
+	ring.lock.Lock()
+	defer ring.lock.Unlock()
+	ring.config = config
+}
+
+// Enabled checks if the rolling capture is on
+func Enabled() bool {
+	ring.lock.Lock()
+	defer ring.lock.Unlock()
+	return ring.config.Enabled
+}
+
+// getFlow finds the flow for a session, adding it if it's new. Expects the lock to be held.
+func getFlow(key sessionKey) *flow {
+	sessionFlow, ok := ring.flows[key]
+	if !ok {
+		sessionFlow = &flow{ended: make(chan bool)}
+		ring.flows[key] = sessionFlow
+	}
+	return sessionFlow
+}
+
+// trim drops packets that are too old or don't fit. Expects the lock to be held.
+func trim(now time.Time) {
+	drop := 0
+	for drop < len(ring.packets) {
+		oldest := ring.packets[drop]
+		if now.Sub(oldest.info.Timestamp) <= ring.config.Retention && ring.size <= ring.config.MaxBytes {
+			break
+		}
+		ring.size -= len(oldest.data)
+		// The oldest packet is always first in its flows
+		for _, key := range oldest.keys {
+			sessionFlow := ring.flows[key]
+			sessionFlow.packets = sessionFlow.packets[1:]
+			if len(sessionFlow.packets) == 0 {
+				delete(ring.flows, key)
+			}
+		}
+		drop++
+	}
+	if drop > 0 {
+		ring.packets = ring.packets[drop:]
+		ring.first += uint64(drop)
+	}
+}
+
+// Add keeps a TCP packet in the ring. data is kept as is, so it must not be reused. start is
+// set for SYN packets and end for FIN and RST packets.
+func Add(linkType layers.LinkType, info gopacket.CaptureInfo, data []byte, srcIP string, srcPort uint16, dstIP string, dstPort uint16, start bool, end bool) {
+	ring.lock.Lock()
+	defer ring.lock.Unlock()
+
+	if !ring.config.Enabled {
+		return
+	}
+
+	item := packet{
+		info:     info,
+		data:     data,
+		linkType: linkType,
+		keys: [2]sessionKey{
+			{client: srcIP, clientPort: srcPort, port: dstPort},
+			{client: dstIP, clientPort: dstPort, port: srcPort},
+		},
+	}
+	sequence := ring.first + uint64(len(ring.packets))
+	ring.packets = append(ring.packets, item)
+	ring.size += len(data)
+	for i, key := range item.keys {
+		sessionFlow := getFlow(key)
+		sessionFlow.packets = append(sessionFlow.packets, sequence)
+		// The second key has us as the sender
+		if i != 1 {
+			continue
+		}
+		select {
+		case <-sessionFlow.ended:
+			if start {
+				// A new session from a reused client port
+				sessionFlow.ended = make(chan bool)
+			}
+		default:
+			if end {
+				close(sessionFlow.ended)
+			}
+		}
+	}
+	trim(info.Timestamp)
+}
+
+// waitForEnd waits for us to end a session in the capture, or for sessionSettle to pass
+func waitForEnd(key sessionKey) {
+	ring.lock.Lock()
+	ended := getFlow(key).ended
+	ring.lock.Unlock()
+
+	timer := time.NewTimer(sessionSettle)
+	defer timer.Stop()
+	select {
+	case <-ended:
+	case <-timer.C:
+	}
+}
+
+// session gets the packets between a client and one of our ports since started
+func session(key sessionKey, started time.Time) []packet {
+	ring.lock.Lock()
+	defer ring.lock.Unlock()
+
+	sessionFlow := ring.flows[key]
+	if sessionFlow == nil {
+		return nil
+	}
+	if len(sessionFlow.packets) == 0 {
+		// Only added by waiting on a session that never showed up
+		delete(ring.flows, key)
+		return nil
+	}
+
+	since := started.Add(-sessionSlack)
+	found := make([]packet, 0, len(sessionFlow.packets))
+	for _, sequence := range sessionFlow.packets {
+		item := ring.packets[sequence-ring.first]
+		if !item.info.Timestamp.Before(since) {
+			found = append(found, item)
+		}
+	}
+	return found
+}
+
+// WriteSession writes the packets of a session that has just ended to a pcap file,
+// returning its path
+func WriteSession(client string, clientPort uint16, port uint16, started time.Time) (string, error) {
+	key := sessionKey{client: client, clientPort: clientPort, port: port}
+	waitForEnd(key)
+
+	packets := session(key, started)
+	if len(packets) == 0 {
+		return "", errors.New("No packets captured for session")
+	}
+
+	name := "tcp-" + strconv.Itoa(int(port)) + "-" + strings.Replace(client, ":", "_", -1) + "-" + strconv.Itoa(int(clientPort)) + "-" + strconv.FormatInt(started.Unix(), 10) + ".pcap"
+	outPath := filepath.Join(SessionDirectory, name)
+
+	outFile, err := os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0444)
+	if err != nil {
+		return "", err
+	}
+	defer outFile.Close()
+
+	writer := pcapgo.NewWriter(outFile)
+	err = writer.WriteFileHeader(snapLength, packets[0].linkType)
+	if err != nil {
+		return "", err
+	}
+	for _, item := range packets {
+		err = writer.WritePacket(item.info, item.data)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return outPath, nil
+}
@@ -0,0 +1,202 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package capture
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+const (
+	client = "198.51.100.7"
+	us     = "192.0.2.10"
+)
+
+var sessionStart = time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+// resetRing empties the ring and configures it
+func resetRing(config Config) {
+	ring.lock.Lock()
+	ring.packets = nil
+	ring.first = 0
+	ring.size = 0
+	ring.flows = make(map[sessionKey]*flow)
+	ring.lock.Unlock()
+	Configure(config)
+}
+
+// addPacket adds a packet of size bytes, at offset from the start
+func addPacket(offset time.Duration, size int, fromClient bool, clientPort uint16, start bool, end bool) {
+	info := gopacket.CaptureInfo{Timestamp: sessionStart.Add(offset), CaptureLength: size, Length: size}
+	data := make([]byte, size)
+	if fromClient {
+		Add(layers.LinkTypeEthernet, info, data, client, clientPort, us, 80, start, end)
+	} else {
+		Add(layers.LinkTypeEthernet, info, data, us, 80, client, clientPort, start, end)
+	}
+}
+
+func sessionSizes(key sessionKey, started time.Time) []int {
+	sizes := make([]int, 0)
+	for _, item := range session(key, started) {
+		sizes = append(sizes, len(item.data))
+	}
+	return sizes
+}
+
+func TestSession(t *testing.T) {
+	resetRing(Config{Enabled: true, Retention: time.Hour, MaxBytes: 1 << 20})
+	defer Configure(Config{})
+
+	// An older session from the same client port, too long before the new one to be included
+	addPacket(0, 1, true, 40000, true, false)
+	addPacket(time.Minute, 2, true, 40000, true, false)
+	addPacket(time.Minute, 3, false, 40000, true, false)
+	// Another client port isn't part of the session
+	addPacket(time.Minute, 100, true, 40001, true, false)
+	addPacket(time.Minute+time.Second, 4, true, 40000, false, false)
+	addPacket(time.Minute+2*time.Second, 5, false, 40000, false, true)
+
+	key := sessionKey{client: client, clientPort: 40000, port: 80}
+	sizes := sessionSizes(key, sessionStart.Add(time.Minute))
+	if len(sizes) != 4 || sizes[0] != 2 || sizes[3] != 5 {
+		t.Errorf("Got packets of sizes %v, expected 2 to 5", sizes)
+	}
+	if sizes := sessionSizes(sessionKey{client: client, clientPort: 40002, port: 80}, sessionStart); len(sizes) != 0 {
+		t.Errorf("Got packets %v for a session that never happened", sizes)
+	}
+}
+
+func TestTrim(t *testing.T) {
+	resetRing(Config{Enabled: true, Retention: time.Minute, MaxBytes: 100})
+	defer Configure(Config{})
+
+	addPacket(0, 40, true, 40000, true, false)
+	addPacket(time.Second, 40, true, 40001, true, false)
+	addPacket(2*time.Second, 40, true, 40002, true, false)
+	ring.lock.Lock()
+	if len(ring.packets) != 2 || ring.first != 1 || ring.size != 80 {
+		t.Errorf("Got %d packets from %d with %d bytes, the oldest should be dropped to fit", len(ring.packets), ring.first, ring.size)
+	}
+	if _, ok := ring.flows[sessionKey{client: client, clientPort: 40000, port: 80}]; ok {
+		t.Error("The flow of the dropped packet is still there")
+	}
+	ring.lock.Unlock()
+
+	// Once the newest packet is past the retention, everything before it goes
+	addPacket(2*time.Minute, 10, true, 40003, true, false)
+	ring.lock.Lock()
+	if len(ring.packets) != 1 || ring.first != 3 || ring.size != 10 || len(ring.flows) != 2 {
+		t.Errorf("Got %d packets from %d with %d bytes and %d flows after they got old", len(ring.packets), ring.first, ring.size, len(ring.flows))
+	}
+	ring.lock.Unlock()
+
+	if sizes := sessionSizes(sessionKey{client: client, clientPort: 40003, port: 80}, sessionStart.Add(2*time.Minute)); len(sizes) != 1 {
+		t.Errorf("Got packets %v for the session after trimming", sizes)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	resetRing(Config{})
+	addPacket(0, 10, true, 40000, true, false)
+	if Enabled() || len(ring.packets) != 0 {
+		t.Error("Packets were kept with the capture off")
+	}
+}
+
+func TestWaitForEnd(t *testing.T) {
+	resetRing(Config{Enabled: true, Retention: time.Hour, MaxBytes: 1 << 20})
+	defer Configure(Config{})
+	key := sessionKey{client: client, clientPort: 40000, port: 80}
+
+	addPacket(0, 1, true, 40000, true, false)
+	// Our FIN ends the session, so there's no waiting
+	addPacket(time.Second, 1, false, 40000, false, true)
+	waited := time.Now()
+	waitForEnd(key)
+	if time.Since(waited) >= sessionSettle {
+		t.Error("Waited for a session that had already ended")
+	}
+
+	// A SYN from the same client port starts a new one
+	addPacket(time.Minute, 1, true, 40000, true, false)
+	addPacket(time.Minute, 1, false, 40000, true, false)
+	waited = time.Now()
+	waitForEnd(key)
+	if time.Since(waited) < sessionSettle {
+		t.Error("Didn't wait for the new session to end")
+	}
+}
+
+func TestWriteSession(t *testing.T) {
+	resetRing(Config{Enabled: true, Retention: time.Hour, MaxBytes: 1 << 20})
+	defer Configure(Config{})
+
+	dir, err := ioutil.TempDir("", "honeypoke")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	if err := os.Mkdir(SessionDirectory, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	addPacket(0, 60, true, 40000, true, false)
+	addPacket(0, 60, false, 40000, true, false)
+	addPacket(time.Second, 60, false, 40000, false, true)
+
+	path, err := WriteSession(client, 40000, 80, sessionStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "sessions/tcp-80-198.51.100.7-40000-1792411200.pcap" {
+		t.Errorf("Got path %s", path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := pcapgo.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reader.LinkType() != layers.LinkTypeEthernet {
+		t.Errorf("Got link type %s", reader.LinkType())
+	}
+	count := 0
+	for {
+		_, _, err := reader.ReadPacketData()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	if count != 3 {
+		t.Errorf("Wrote %d packets, expected 3", count)
+	}
+
+	if _, err := WriteSession(client, 40001, 80, sessionStart); err == nil {
+		t.Error("No error for a session without packets")
+	}
+}
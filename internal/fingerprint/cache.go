@@ -0,0 +1,86 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package fingerprint
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How long fingerprints are kept around for records to pick up
+const cacheTTL = 10 * time.Minute
+
+// How many new entries between sweeps of old ones
+const cacheSweepInterval = 4096
+
+type cacheEntry struct {
+	result Result
+	added  time.Time
+}
+
+// The watcher sees SYNs before the listeners finish with a connection, so fingerprints are
+// kept here by source address and port for the listeners, and by source for the watcher's own records
+var cache = struct {
+	lock      sync.Mutex
+	byConn    map[string]cacheEntry
+	bySource  map[string]cacheEntry
+	additions int
+}{
+	byConn:   make(map[string]cacheEntry),
+	bySource: make(map[string]cacheEntry),
+}
+
+func sweep(now time.Time) {
+	for key, entry := range cache.byConn {
+		if now.Sub(entry.added) > cacheTTL {
+			delete(cache.byConn, key)
+		}
+	}
+	for key, entry := range cache.bySource {
+		if now.Sub(entry.added) > cacheTTL {
+			delete(cache.bySource, key)
+		}
+	}
+}
+
+// Remember keeps the fingerprint of a SYN from a source
+func Remember(source string, sourcePort uint16, result Result) {
+	now := time.Now()
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.additions++
+	if cache.additions%cacheSweepInterval == 0 {
+		sweep(now)
+	}
+
+	entry := cacheEntry{result: result, added: now}
+	cache.byConn[net.JoinHostPort(source, strconv.Itoa(int(sourcePort)))] = entry
+	cache.bySource[source] = entry
+}
+
+func lookup(table map[string]cacheEntry, key string) (Result, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	entry, ok := table[key]
+	if !ok || time.Since(entry.added) > cacheTTL {
+		return Result{}, false
+	}
+	return entry.result, true
+}
+
+// Lookup gets the fingerprint of the SYN that started a connection
+func Lookup(source string, sourcePort uint16) (Result, bool) {
+	return lookup(cache.byConn, net.JoinHostPort(source, strconv.Itoa(int(sourcePort))))
+}
+
+// LookupSource gets the fingerprint of the latest SYN from a source
+func LookupSource(source string) (Result, bool) {
+	return lookup(cache.bySource, source)
+}
@@ -0,0 +1,194 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package fingerprint
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Result is what can be told about the sender of a SYN
+type Result struct {
+	// Signature in a p0f-like format: version:ttl:mss:window,scale:options:quirks
+	Signature   string
+	OSGuess     string
+	ScannerTool string
+}
+
+// synInfo holds the parts of a SYN that are used for fingerprinting
+type synInfo struct {
+	version     int
+	ttl         uint8
+	initialTTL  uint8
+	ipID        uint16
+	dontFrag    bool
+	window      uint16
+	mss         uint16
+	windowScale int
+	options     string
+	seq         uint32
+	dstIP       []byte
+}
+
+type osSignature struct {
+	name       string
+	initialTTL uint8
+	options    string
+	// Checks the window size, or nil if any window is fine
+	window func(info *synInfo) bool
+}
+
+var osSignatures = []osSignature{
+	{name: "Linux", initialTTL: 64, options: "mss,sok,ts,nop,ws"},
+	{name: "Linux (no timestamps)", initialTTL: 64, options: "mss,nop,nop,sok,nop,ws"},
+	{name: "Windows", initialTTL: 128, options: "mss,nop,ws,nop,nop,sok"},
+	{name: "Windows XP", initialTTL: 128, options: "mss,nop,nop,sok"},
+	{name: "macOS/iOS", initialTTL: 64, options: "mss,nop,ws,nop,nop,ts,sok,eol+1"},
+	{name: "FreeBSD", initialTTL: 64, options: "mss,nop,ws,sok,ts"},
+	{name: "OpenBSD", initialTTL: 64, options: "mss,nop,nop,sok,nop,ws,nop,nop,ts"},
+	{name: "Solaris", initialTTL: 64, options: "nop,ws,nop,nop,ts,nop,nop,sok,mss"},
+	{name: "Embedded/Network device", initialTTL: 255, options: "mss", window: func(info *synInfo) bool {
+		return info.window < 1024 || info.window > 4096
+	}},
+}
+
+// guessInitialTTL rounds a TTL up to the usual starting value, since every hop decrements it
+func guessInitialTTL(ttl uint8) uint8 {
+	switch {
+	case ttl <= 32:
+		return 32
+	case ttl <= 64:
+		return 64
+	case ttl <= 128:
+		return 128
+	}
+	return 255
+}
+
+// optionLayout lists TCP options by name, in the order they were sent
+func optionLayout(tcp *layers.TCP, info *synInfo) string {
+	names := make([]string, 0, len(tcp.Options))
+	for i, option := range tcp.Options {
+		switch option.OptionType {
+		case layers.TCPOptionKindEndList:
+			// Anything after the end of the list is padding
+			names = append(names, "eol+"+strconv.Itoa(len(tcp.Options)-i-1))
+			return strings.Join(names, ",")
+		case layers.TCPOptionKindNop:
+			names = append(names, "nop")
+		case layers.TCPOptionKindMSS:
+			names = append(names, "mss")
+			if len(option.OptionData) == 2 {
+				info.mss = binary.BigEndian.Uint16(option.OptionData)
+			}
+		case layers.TCPOptionKindWindowScale:
+			names = append(names, "ws")
+			if len(option.OptionData) == 1 {
+				info.windowScale = int(option.OptionData[0])
+			}
+		case layers.TCPOptionKindSACKPermitted:
+			names = append(names, "sok")
+		case layers.TCPOptionKindSACK:
+			names = append(names, "sack")
+		case layers.TCPOptionKindTimestamps:
+			names = append(names, "ts")
+		default:
+			names = append(names, "?"+strconv.Itoa(int(option.OptionType)))
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// scannerTool checks for the tell-tale signs of well-known scanners
+func scannerTool(info *synInfo) string {
+	// Mirai and its descendants use the target address as the sequence number
+	if len(info.dstIP) == 4 && info.seq == binary.BigEndian.Uint32(info.dstIP) {
+		return "mirai"
+	}
+	// ZMap uses a fixed IP ID
+	if info.version == 4 && info.ipID == 54321 {
+		return "zmap"
+	}
+	// Masscan sends bare SYNs with a small window by default
+	if info.initialTTL == 255 && info.window == 1024 && info.options == "" {
+		return "masscan"
+	}
+	// Nmap SYN scans only send an MSS option, with one of a few window sizes
+	if info.options == "mss" && info.mss == 1460 {
+		switch info.window {
+		case 1024, 2048, 3072, 4096:
+			return "nmap"
+		}
+	}
+	return ""
+}
+
+func osGuess(info *synInfo) string {
+	for _, signature := range osSignatures {
+		if signature.initialTTL != info.initialTTL || signature.options != info.options {
+			continue
+		}
+		if signature.window != nil && !signature.window(info) {
+			continue
+		}
+		return signature.name
+	}
+	return ""
+}
+
+// FromSYN fingerprints a SYN packet. Only one of ip4 or ip6 should be set.
+func FromSYN(ip4 *layers.IPv4, ip6 *layers.IPv6, tcp *layers.TCP) Result {
+	info := new(synInfo)
+	quirks := make([]string, 0)
+
+	if ip4 != nil {
+		info.version = 4
+		info.ttl = ip4.TTL
+		info.ipID = ip4.Id
+		info.dontFrag = ip4.Flags&layers.IPv4DontFragment != 0
+		info.dstIP = ip4.DstIP.To4()
+		if info.dontFrag {
+			quirks = append(quirks, "df")
+		}
+		if info.ipID == 0 {
+			quirks = append(quirks, "id0")
+		} else if info.dontFrag {
+			quirks = append(quirks, "id+")
+		}
+	} else if ip6 != nil {
+		info.version = 6
+		info.ttl = ip6.HopLimit
+	}
+
+	info.initialTTL = guessInitialTTL(info.ttl)
+	info.window = tcp.Window
+	info.seq = tcp.Seq
+	info.options = optionLayout(tcp, info)
+
+	if tcp.Seq == 0 {
+		quirks = append(quirks, "seq0")
+	}
+	if tcp.ECE || tcp.CWR {
+		quirks = append(quirks, "ecn")
+	}
+
+	windowScale := "*"
+	if strings.Contains(info.options, "ws") {
+		windowScale = strconv.Itoa(info.windowScale)
+	}
+
+	result := Result{
+		Signature: fmt.Sprintf("%d:%d+%d:%d:%d,%s:%s:%s", info.version, info.initialTTL, info.initialTTL-info.ttl,
+			info.mss, info.window, windowScale, info.options, strings.Join(quirks, ",")),
+		OSGuess:     osGuess(info),
+		ScannerTool: scannerTool(info),
+	}
+
+	return result
+}
@@ -0,0 +1,180 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package fingerprint
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestGuessInitialTTL(t *testing.T) {
+	tests := []struct {
+		ttl      uint8
+		expected uint8
+	}{
+		{1, 32}, {32, 32}, {33, 64}, {52, 64}, {64, 64}, {65, 128}, {117, 128}, {128, 128}, {129, 255}, {255, 255},
+	}
+	for _, test := range tests {
+		if initial := guessInitialTTL(test.ttl); initial != test.expected {
+			t.Errorf("Got %d for TTL %d, expected %d", initial, test.ttl, test.expected)
+		}
+	}
+}
+
+func option(kind layers.TCPOptionKind, data ...byte) layers.TCPOption {
+	return layers.TCPOption{OptionType: kind, OptionData: data}
+}
+
+var (
+	mss1460 = option(layers.TCPOptionKindMSS, 0x05, 0xb4)
+	nop     = option(layers.TCPOptionKindNop)
+	sok     = option(layers.TCPOptionKindSACKPermitted)
+	ts      = option(layers.TCPOptionKindTimestamps, 0, 0, 0, 1, 0, 0, 0, 0)
+	eol     = option(layers.TCPOptionKindEndList)
+)
+
+func ws(scale byte) layers.TCPOption {
+	return option(layers.TCPOptionKindWindowScale, scale)
+}
+
+func TestFromSYN(t *testing.T) {
+	target := net.ParseIP("192.0.2.10")
+	tests := []struct {
+		name      string
+		ip4       *layers.IPv4
+		ip6       *layers.IPv6
+		tcp       *layers.TCP
+		signature string
+		os        string
+		tool      string
+	}{
+		{
+			"linux",
+			&layers.IPv4{TTL: 52, Id: 1234, Flags: layers.IPv4DontFragment, DstIP: target},
+			nil,
+			&layers.TCP{Seq: 1000, Window: 64240, Options: []layers.TCPOption{mss1460, sok, ts, nop, ws(7)}},
+			"4:64+12:1460:64240,7:mss,sok,ts,nop,ws:df,id+",
+			"Linux",
+			"",
+		},
+		{
+			"windows with ECN",
+			&layers.IPv4{TTL: 117, Id: 4321, Flags: layers.IPv4DontFragment, DstIP: target},
+			nil,
+			&layers.TCP{Seq: 1000, Window: 64240, ECE: true, CWR: true, Options: []layers.TCPOption{mss1460, nop, ws(8), nop, nop, sok}},
+			"4:128+11:1460:64240,8:mss,nop,ws,nop,nop,sok:df,id+,ecn",
+			"Windows",
+			"",
+		},
+		{
+			"macOS with padding",
+			&layers.IPv4{TTL: 64, Flags: layers.IPv4DontFragment, DstIP: target},
+			nil,
+			&layers.TCP{Seq: 1000, Window: 65535, Options: []layers.TCPOption{mss1460, nop, ws(6), nop, nop, ts, sok, eol, eol}},
+			"4:64+0:1460:65535,6:mss,nop,ws,nop,nop,ts,sok,eol+1:df,id0",
+			"macOS/iOS",
+			"",
+		},
+		{
+			"ipv6",
+			nil,
+			&layers.IPv6{HopLimit: 60},
+			&layers.TCP{Seq: 1000, Window: 64800, Options: []layers.TCPOption{mss1460, sok, ts, nop, ws(7)}},
+			"6:64+4:1460:64800,7:mss,sok,ts,nop,ws:",
+			"Linux",
+			"",
+		},
+		{
+			"masscan",
+			&layers.IPv4{TTL: 250, Id: 999, DstIP: target},
+			nil,
+			&layers.TCP{Seq: 1000, Window: 1024},
+			"4:255+5:0:1024,*::",
+			"",
+			"masscan",
+		},
+		{
+			"nmap",
+			&layers.IPv4{TTL: 40, Id: 999, DstIP: target},
+			nil,
+			&layers.TCP{Seq: 1000, Window: 1024, Options: []layers.TCPOption{mss1460}},
+			"4:64+24:1460:1024,*:mss:",
+			"",
+			"nmap",
+		},
+		{
+			"zmap",
+			&layers.IPv4{TTL: 240, Id: 54321, DstIP: target},
+			nil,
+			&layers.TCP{Seq: 1000, Window: 65535},
+			"4:255+15:0:65535,*::",
+			"",
+			"zmap",
+		},
+		{
+			"mirai",
+			&layers.IPv4{TTL: 50, Id: 999, DstIP: target},
+			nil,
+			&layers.TCP{Seq: 0xc000020a, Window: 14600, Options: []layers.TCPOption{mss1460, sok, ts, nop, ws(2)}},
+			"4:64+14:1460:14600,2:mss,sok,ts,nop,ws:",
+			"Linux",
+			"mirai",
+		},
+		{
+			"unknown option and seq0",
+			&layers.IPv4{TTL: 200, Id: 999, DstIP: target},
+			nil,
+			&layers.TCP{Seq: 0, Window: 512, Options: []layers.TCPOption{mss1460, option(layers.TCPOptionKind(34), 1, 2)}},
+			"4:255+55:1460:512,*:mss,?34:seq0",
+			"",
+			"",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := FromSYN(test.ip4, test.ip6, test.tcp)
+			if result.Signature != test.signature {
+				t.Errorf("Got signature %q, expected %q", result.Signature, test.signature)
+			}
+			if result.OSGuess != test.os || result.ScannerTool != test.tool {
+				t.Errorf("Got OS %q and tool %q, expected %q and %q", result.OSGuess, result.ScannerTool, test.os, test.tool)
+			}
+		})
+	}
+}
+
+func TestCache(t *testing.T) {
+	first := Result{Signature: "first"}
+	second := Result{Signature: "second"}
+	Remember("198.51.100.7", 40000, first)
+	Remember("198.51.100.7", 40001, second)
+
+	if result, ok := Lookup("198.51.100.7", 40000); !ok || result != first {
+		t.Errorf("Got %v for the first connection", result)
+	}
+	if result, ok := LookupSource("198.51.100.7"); !ok || result != second {
+		t.Errorf("Got %v for the source, expected the latest SYN", result)
+	}
+	if _, ok := Lookup("198.51.100.7", 40002); ok {
+		t.Error("Found a fingerprint for a connection that was never seen")
+	}
+
+	cache.lock.Lock()
+	entry := cache.bySource["198.51.100.7"]
+	entry.added = time.Now().Add(-cacheTTL - time.Second)
+	cache.bySource["198.51.100.7"] = entry
+	sweep(time.Now())
+	_, swept := cache.bySource["198.51.100.7"]
+	cache.lock.Unlock()
+	if swept {
+		t.Error("An old fingerprint wasn't swept")
+	}
+	if _, ok := Lookup("198.51.100.7", 40000); !ok {
+		t.Error("A new fingerprint was swept")
+	}
+}
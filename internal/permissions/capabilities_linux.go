@@ -0,0 +1,319 @@
+//go:build linux
+// +build linux
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package permissions
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Indexed by capability number, from linux/capability.h
+var capabilityNames = []string{
+	"cap_chown", "cap_dac_override", "cap_dac_read_search", "cap_fowner", "cap_fsetid",
+	"cap_kill", "cap_setgid", "cap_setuid", "cap_setpcap", "cap_linux_immutable",
+	"cap_net_bind_service", "cap_net_broadcast", "cap_net_admin", "cap_net_raw", "cap_ipc_lock",
+	"cap_ipc_owner", "cap_sys_module", "cap_sys_rawio", "cap_sys_chroot", "cap_sys_ptrace",
+	"cap_sys_pacct", "cap_sys_admin", "cap_sys_boot", "cap_sys_nice", "cap_sys_resource",
+	"cap_sys_time", "cap_sys_tty_config", "cap_mknod", "cap_lease", "cap_audit_write",
+	"cap_audit_control", "cap_setfcap", "cap_mac_override", "cap_mac_admin", "cap_syslog",
+	"cap_wake_alarm", "cap_block_suspend", "cap_audit_read", "cap_perfmon", "cap_bpf",
+	"cap_checkpoint_restore",
+}
+
+// What capability mode keeps: binding privileged ports and capturing packets
+var capabilityModeCaps = []uint{unix.CAP_NET_BIND_SERVICE, unix.CAP_NET_RAW}
+
+// What we need to switch to capability mode
+var setupCaps = []uint{unix.CAP_SETUID, unix.CAP_SETGID, unix.CAP_SETPCAP}
+
+// Set by EnterCapabilityMode
+var capabilityMode = false
+
+func capabilityMask(caps []uint) uint64 {
+	var mask uint64
+	for _, capability := range caps {
+		mask |= 1 << capability
+	}
+	return mask
+}
+
+// capabilityString lists the capabilities in mask by name
+func capabilityString(mask uint64) string {
+	names := make([]string, 0)
+	for i := uint(0); i < 64; i++ {
+		if mask&(1<<i) == 0 {
+			continue
+		}
+		if int(i) < len(capabilityNames) {
+			names = append(names, capabilityNames[i])
+		} else {
+			names = append(names, "cap_"+strconv.Itoa(int(i)))
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// Credentials of one thread, from its status file in /proc
+type threadState struct {
+	tid        string
+	uids       []int
+	gids       []int
+	groups     []int
+	permitted  uint64
+	effective  uint64
+	ambient    uint64
+	noNewPrivs bool
+	seccomp    int
+}
+
+func parseIDs(value string) ([]int, error) {
+	ids := make([]int, 0)
+	for _, field := range strings.Fields(value) {
+		id, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func parseThreadState(status io.Reader, name string) (*threadState, error) {
+	state := &threadState{}
+	scanner := bufio.NewScanner(status)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		var err error
+		switch parts[0] {
+		case "Uid":
+			state.uids, err = parseIDs(value)
+		case "Gid":
+			state.gids, err = parseIDs(value)
+		case "Groups":
+			state.groups, err = parseIDs(value)
+		case "CapPrm":
+			state.permitted, err = strconv.ParseUint(value, 16, 64)
+		case "CapEff":
+			state.effective, err = strconv.ParseUint(value, 16, 64)
+		case "CapAmb":
+			state.ambient, err = strconv.ParseUint(value, 16, 64)
+		case "NoNewPrivs":
+			state.noNewPrivs = value == "1"
+		case "Seccomp":
+			state.seccomp, err = strconv.Atoi(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Bad %s line in %s: %s", parts[0], name, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(state.uids) == 0 || len(state.gids) == 0 {
+		return nil, fmt.Errorf("No credentials in %s", name)
+	}
+	return state, nil
+}
+
+func readThreadState(statusPath string) (*threadState, error) {
+	statusFile, err := os.Open(statusPath)
+	if err != nil {
+		return nil, err
+	}
+	defer statusFile.Close()
+	return parseThreadState(statusFile, statusPath)
+}
+
+func (s *threadState) root() bool {
+	for _, id := range s.uids {
+		if id == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// threadIDs lists our threads from /proc/self/task, opened as tasks so it still works after
+// a chroot
+func threadIDs(tasks *os.File) ([]string, error) {
+	_, err := tasks.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return tasks.Readdirnames(-1)
+}
+
+// readThreads gets the credentials of every thread, since Linux keeps them per thread
+func readThreads(tasks *os.File) ([]*threadState, error) {
+	tids, err := threadIDs(tasks)
+	if err != nil {
+		return nil, err
+	}
+	threads := make([]*threadState, 0, len(tids))
+	for _, tid := range tids {
+		fd, err := unix.Openat(int(tasks.Fd()), tid+"/status", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err == unix.ENOENT || err == unix.ESRCH {
+			// The thread exited
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		statusFile := os.NewFile(uintptr(fd), tid+"/status")
+		state, err := parseThreadState(statusFile, "task "+tid)
+		statusFile.Close()
+		if err != nil {
+			return nil, err
+		}
+		state.tid = tid
+		threads = append(threads, state)
+	}
+	if len(threads) == 0 {
+		return nil, fmt.Errorf("No threads found in /proc/self/task")
+	}
+	return threads, nil
+}
+
+func lastCapability() uint {
+	contents, err := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err == nil {
+		last, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+		if err == nil && last > 0 && last < 64 {
+			return uint(last)
+		}
+	}
+	return uint(len(capabilityNames) - 1)
+}
+
+// EnterCapabilityMode makes HoneyPoke run as newUser and newGroup with only the capabilities to
+// bind privileged ports and capture packets. Capabilities belong to each thread, and Go can't
+// change them on every thread, so if we have more than that HoneyPoke is started over with just
+// those. That means it has to be called before anything is opened.
+func EnterCapabilityMode(newUser string, newGroup string) {
+	capabilityMode = true
+	wanted := capabilityMask(capabilityModeCaps)
+
+	state, err := readThreadState("/proc/self/status")
+	if err != nil {
+		log.Fatalf("Could not read our capabilities: %s\n", err)
+	}
+	if !state.root() && state.permitted&^wanted == 0 {
+		// Already there, either we were started over or started with file or ambient capabilities
+		if state.permitted&wanted != wanted {
+			log.Printf("Capability mode is missing %s, binding privileged ports or capturing may fail\n", capabilityString(wanted&^state.permitted))
+		}
+		return
+	}
+
+	needed := capabilityMask(setupCaps)
+	if state.effective&needed != needed {
+		log.Fatalf("Started with capabilities %s, but dropping them needs %s\n", capabilityString(state.permitted), capabilityString(needed))
+	}
+
+	uid, gid, err := lookupIDs(newUser, newGroup)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if uid == 0 {
+		log.Fatalln("Capability mode needs a user other than root")
+	}
+
+	log.Printf("Starting over as uid %d gid %d with %s\n", uid, gid, capabilityString(wanted))
+	err = restartWithCapabilities(uid, gid, wanted)
+	log.Fatalf("Could not switch to capability mode: %s\n", err)
+}
+
+// restartWithCapabilities sets up this thread to keep only the wanted capabilities as uid and
+// gid, then execs HoneyPoke from it. The new process gets this thread's credentials on every
+// thread. Only returns on errors.
+func restartWithCapabilities(uid int, gid int, wanted uint64) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	// Never unlocked, we either exec from this thread or exit
+	runtime.LockOSThread()
+
+	// The bounding set is kept over exec, this needs CAP_SETPCAP so it goes first
+	for i := uint(0); i <= lastCapability(); i++ {
+		if wanted&(1<<i) == 0 {
+			err = unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(i), 0, 0, 0)
+			if err != nil && err != syscall.EINVAL {
+				return fmt.Errorf("Could not drop %s from the bounding set: %s", capabilityString(1<<i), err)
+			}
+		}
+	}
+
+	// Keep our permitted capabilities when we stop being root
+	err = unix.Prctl(unix.PR_SET_KEEPCAPS, 1, 0, 0, 0)
+	if err != nil {
+		return err
+	}
+	err = syscall.Setgroups([]int{})
+	if err != nil {
+		return err
+	}
+	err = syscall.Setresgid(gid, gid, gid)
+	if err != nil {
+		return err
+	}
+	err = syscall.Setresuid(uid, uid, uid)
+	if err != nil {
+		return err
+	}
+
+	err = raiseAmbient(wanted)
+	if err != nil {
+		return err
+	}
+
+	return syscall.Exec(executable, os.Args, os.Environ())
+}
+
+// raiseAmbient makes the wanted capabilities ambient on this thread, so they're kept when it
+// execs HoneyPoke. They have to be permitted already.
+func raiseAmbient(wanted uint64) error {
+	// Ambient capabilities have to be inheritable and permitted
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	data := [2]unix.CapUserData{}
+	for i := range data {
+		set := uint32(wanted >> (32 * uint(i)))
+		data[i] = unix.CapUserData{Effective: set, Permitted: set, Inheritable: set}
+	}
+	err := unix.Capset(&header, &data[0])
+	if err != nil {
+		return fmt.Errorf("Could not set capabilities: %s", err)
+	}
+	for i := uint(0); i < 64; i++ {
+		if wanted&(1<<i) == 0 {
+			continue
+		}
+		err = unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, uintptr(i), 0, 0)
+		if err != nil {
+			return fmt.Errorf("Could not make %s ambient: %s", capabilityString(1<<i), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+//go:build linux
+// +build linux
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package permissions
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Newer than our x/sys
+const (
+	landlockAccessFsIoctlDev = 1 << 15
+)
+
+// Access rights that make sense on a file instead of a directory
+const landlockFileAccess = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+	unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_TRUNCATE | landlockAccessFsIoctlDev
+
+const landlockReadAccess = unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR
+
+const landlockWriteAccess = landlockReadAccess | unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+	unix.LANDLOCK_ACCESS_FS_REMOVE_DIR | unix.LANDLOCK_ACCESS_FS_REMOVE_FILE | unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+	unix.LANDLOCK_ACCESS_FS_MAKE_REG | unix.LANDLOCK_ACCESS_FS_REFER | unix.LANDLOCK_ACCESS_FS_TRUNCATE
+
+// Read by Go's resolver for recorders that connect by name, by user lookups, and for checking
+// recorders' certificates
+var landlockSystemPaths = []string{"/etc/hosts", "/etc/resolv.conf", "/etc/nsswitch.conf", "/etc/passwd",
+	"/etc/group", "/etc/localtime", "/etc/ssl", "/etc/pki", "/usr/share/ca-certificates"}
+
+// The few kernel files read after the sandbox is up: our own status and threads for the self-test
+// and /proc/net/dev for libpcap, the capability and listen backlog limits, and the huge page size
+// for Go's runtime. /proc/self is opened as our own /proc/<pid>, which exec keeps.
+var landlockKernelPaths = []string{"/proc/self", "/proc/sys/kernel/cap_last_cap", "/proc/sys/net/core/somaxconn",
+	"/sys/kernel/mm/transparent_hugepage/hpage_pmd_size"}
+
+// Needed to start HoneyPoke over inside the sandbox, along with HoneyPoke itself
+var landlockExecPaths = []string{"/etc/ld.so.cache", "/lib", "/lib64", "/usr/lib", "/usr/lib64"}
+
+// os/exec opens it for the bind helper
+var landlockDevices = []string{"/dev/null"}
+
+// landlockABI gets the version of Landlock the kernel has
+func landlockABI() (int, error) {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(abi), nil
+}
+
+// landlockHandled is every filesystem access the kernel's Landlock knows about, anything handled
+// and not allowed by a rule is denied
+func landlockHandled(abi int) uint64 {
+	// Everything up to MAKE_SYM is in the first version
+	handled := uint64(unix.LANDLOCK_ACCESS_FS_MAKE_SYM<<1) - 1
+	if abi >= 2 {
+		handled |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	if abi >= 3 {
+		handled |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+	if abi >= 5 {
+		handled |= landlockAccessFsIoctlDev
+	}
+	return handled
+}
+
+func addLandlockRule(ruleset int, path string, access uint64) error {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("Could not open %s: %s", path, err)
+	}
+	defer unix.Close(fd)
+
+	var stat unix.Stat_t
+	err = unix.Fstat(fd, &stat)
+	if err != nil {
+		return err
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+		access &= landlockFileAccess
+	}
+
+	rule := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(fd)}
+	_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(ruleset), unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("Could not add Landlock rule for %s: %s", path, errno)
+	}
+	return nil
+}
+
+// existingPaths leaves out the system paths this system doesn't have
+func existingPaths(paths []string) []string {
+	existing := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			existing = append(existing, path)
+		}
+	}
+	return existing
+}
+
+// landlockRuleset makes the ruleset for the sandbox: the working directory and read only paths
+// can be read, the writable ones can be written, HoneyPoke and its libraries can be run, and
+// nothing else
+func landlockRuleset(directory string, config *SandboxConfig, executable string) (int, error) {
+	abi, err := landlockABI()
+	if err != nil {
+		return -1, err
+	}
+	handled := landlockHandled(abi)
+
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	ruleset, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return -1, errno
+	}
+
+	rules := []struct {
+		paths  []string
+		access uint64
+	}{
+		{append([]string{directory}, config.ReadOnly...), landlockReadAccess},
+		{config.Writable, landlockWriteAccess},
+		{existingPaths(append(landlockSystemPaths, landlockKernelPaths...)), landlockReadAccess},
+		{append(existingPaths(landlockExecPaths), executable), landlockReadAccess | unix.LANDLOCK_ACCESS_FS_EXECUTE},
+		{existingPaths(landlockDevices), unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE},
+	}
+	for _, rule := range rules {
+		for _, path := range rule.paths {
+			err = addLandlockRule(int(ruleset), path, rule.access&handled)
+			if err != nil {
+				unix.Close(int(ruleset))
+				return -1, err
+			}
+		}
+	}
+	return int(ruleset), nil
+}
+
+// landlockRestrictSelf restricts the thread we're on to the ruleset. Threads it starts after
+// that, and whatever it execs, are restricted too.
+func landlockRestrictSelf(ruleset int) error {
+	_, _, errno := unix.Syscall(unix.SYS_LANDLOCK_RESTRICT_SELF, uintptr(ruleset), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
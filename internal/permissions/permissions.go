@@ -0,0 +1,49 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package permissions
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"sync"
+)
+
+// Closed once DropPermissions is done
+var dropped = make(chan bool)
+var dropOnce sync.Once
+
+// WaitUntilDropped blocks until DropPermissions has run, so nothing gets handled as root
+func WaitUntilDropped() {
+	<-dropped
+}
+
+func markDropped() {
+	dropOnce.Do(func() {
+		close(dropped)
+	})
+}
+
+// lookupIDs gets the uid and gid to switch to
+func lookupIDs(newUser string, newGroup string) (int, int, error) {
+	newUserData, err := user.Lookup(newUser)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Could not get user: %s", err)
+	}
+	newGroupData, err := user.LookupGroup(newGroup)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Could not get group: %s", err)
+	}
+
+	uid, err := strconv.Atoi(newUserData.Uid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid uid %s for user %s", newUserData.Uid, newUser)
+	}
+	gid, err := strconv.Atoi(newGroupData.Gid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid gid %s for group %s", newGroupData.Gid, newGroup)
+	}
+	return uid, gid, nil
+}
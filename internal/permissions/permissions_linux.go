@@ -0,0 +1,110 @@
+//go:build linux
+// +build linux
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package permissions
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// DropPermissions drops permissions if started as root (which is normal), then checks every
+// thread really dropped them. Since Go 1.16 Setgroups and the set*id calls change every thread,
+// not just the one we're on. If a sandbox was configured it's set up here too, before anything
+// gets handled.
+func DropPermissions(newUser string, newGroup string) {
+	// Kept open so threads can still be checked after a chroot, and closed before any
+	// connections are handled since it's a way out of one
+	tasks, err := os.Open("/proc/self/task")
+	if err != nil {
+		log.Fatalf("Could not open /proc/self/task: %s\n", err)
+	}
+
+	wasRoot := syscall.Getuid() == 0
+	if wasRoot {
+		uid, gid, err := lookupIDs(newUser, newGroup)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		if sandbox != nil && sandbox.Filesystem == SandboxChroot {
+			err = enterChroot()
+			if err != nil {
+				log.Fatalln("Unable to chroot due to error:", err)
+			}
+		}
+
+		err = syscall.Setgroups([]int{})
+		if err != nil {
+			log.Fatalln("Unable to clear supplementary groups due to error:", err)
+		}
+		err = syscall.Setresgid(gid, gid, gid)
+		if err != nil {
+			log.Fatalln("Unable to set GID due to error:", err)
+		}
+		err = syscall.Setresuid(uid, uid, uid)
+		if err != nil {
+			log.Fatalln("Unable to set UID due to error:", err)
+		}
+		log.Println("Dropped privileges...")
+	}
+
+	checkPrivileges(tasks, wasRoot)
+
+	if sandbox != nil {
+		err = applySandbox()
+		if err != nil {
+			log.Fatalf("Could not set up the sandbox: %s\n", err)
+		}
+		err = testSandbox(tasks)
+		if err != nil {
+			log.Fatalf("Sandbox self-test failed: %s\n", err)
+		}
+	}
+
+	tasks.Close()
+	markDropped()
+}
+
+// checkPrivileges makes sure no thread is root or has capabilities it shouldn't, and reports
+// what we're running as
+func checkPrivileges(tasks *os.File, wasRoot bool) {
+	threads, err := readThreads(tasks)
+	if err != nil {
+		log.Fatalf("Could not check privileges: %s\n", err)
+	}
+
+	allowed := uint64(0)
+	if capabilityMode {
+		allowed = capabilityMask(capabilityModeCaps)
+	}
+	for _, thread := range threads {
+		if thread.root() {
+			log.Fatalln("A thread is still running as root after dropping privileges")
+		}
+		extra := (thread.permitted | thread.effective | thread.ambient) &^ allowed
+		if extra == 0 {
+			continue
+		}
+		if wasRoot || capabilityMode {
+			log.Fatalf("A thread still has %s after dropping privileges\n", capabilityString(extra))
+		}
+		// Whoever started us gave us these, we can't take them away
+		log.Printf("Running with %s, use capability mode to keep only what's needed\n", capabilityString(extra))
+		break
+	}
+
+	state := threads[0]
+	groups := "no supplementary groups"
+	if len(state.groups) > 0 {
+		groups = "supplementary groups " + strings.Trim(fmt.Sprint(state.groups), "[]")
+	}
+	log.Printf("Running as uid %d gid %d with %s and effective capabilities %s (checked %d threads)\n", state.uids[1], state.gids[1], groups, capabilityString(state.effective), len(threads))
+}
@@ -0,0 +1,49 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package permissions
+
+import (
+	"log"
+	"syscall"
+)
+
+// DropPermissions drops permissions if started as root (which is normal). The BSDs and macOS
+// change credentials for the whole process, so plain setuid is enough here.
+func DropPermissions(newUser string, newGroup string) {
+	if syscall.Getuid() == 0 {
+		uid, gid, err := lookupIDs(newUser, newGroup)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		err = syscall.Setgroups([]int{})
+		if err != nil {
+			log.Fatalln("Unable to clear supplementary groups due to error:", err)
+		}
+		err = syscall.Setgid(gid)
+		if err != nil {
+			log.Fatalln("Unable to set GID due to error:", err)
+		}
+		err = syscall.Setuid(uid)
+		if err != nil {
+			log.Fatalln("Unable to set UID due to error:", err)
+		}
+		log.Println("Dropped privileges...")
+	}
+
+	if syscall.Getuid() == 0 || syscall.Geteuid() == 0 {
+		log.Fatalln("Still running as root after dropping privileges")
+	}
+	log.Printf("Running as uid %d gid %d\n", syscall.Getuid(), syscall.Getgid())
+	markDropped()
+}
+
+// EnterCapabilityMode needs Linux capabilities
+func EnterCapabilityMode(newUser string, newGroup string) {
+	log.Fatalln("Capability mode is only supported on Linux")
+}
@@ -1,3 +1,4 @@
+//go:build windows
 // +build windows
 
 /* This Source Code Form is subject to the terms of the Mozilla Public
@@ -8,6 +9,13 @@ package permissions
 
 import "log"
 
+// DropPermissions only lets the listeners start, there's nothing to drop on Windows
 func DropPermissions(newUser string, newGroup string) {
 	log.Println("Windows has no privileges to drop...")
+	markDropped()
+}
+
+// EnterCapabilityMode needs Linux capabilities
+func EnterCapabilityMode(newUser string, newGroup string) {
+	log.Fatalln("Capability mode is only supported on Linux")
 }
@@ -0,0 +1,27 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package permissions
+
+// SandboxLandlock limits the filesystem with Landlock
+const SandboxLandlock = "landlock"
+
+// SandboxChroot chroots into the working directory, which needs HoneyPoke to start as root
+const SandboxChroot = "chroot"
+
+// SandboxNone leaves the filesystem alone
+const SandboxNone = "none"
+
+// SandboxConfig is what EnterSandbox and DropPermissions lock HoneyPoke down with. Landlock
+// lets HoneyPoke read its working directory, but only write the files and directories it
+// writes to.
+type SandboxConfig struct {
+	Filesystem string
+	// Paths outside the working directory Landlock allows reading
+	ReadOnly []string
+	// Paths Landlock allows writing, which can't have HoneyPoke itself in them
+	Writable []string
+	// Only allow the syscalls the listeners, watcher and recorders need
+	Seccomp bool
+}
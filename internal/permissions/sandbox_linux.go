@@ -0,0 +1,279 @@
+//go:build linux
+// +build linux
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package permissions
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Set in the environment when HoneyPoke is started over inside the sandbox
+const sandboxEnv = "HONEYPOKE_SANDBOX"
+
+// Set by EnterSandbox
+var sandbox *SandboxConfig
+
+// The working directory, checked against / after the chroot
+var sandboxDirectory string
+var sandboxDirectoryStat unix.Stat_t
+
+// EnterSandbox checks the sandbox can be set up and sets no_new_privs and Landlock on HoneyPoke.
+// Both only apply to the thread that asks for them and the threads and programs it starts, and Go
+// can't run anything on every thread once cgo is in, so HoneyPoke is started over from a thread
+// that has them. That means it has to be called before anything is opened. The chroot and
+// seccomp are left for DropPermissions.
+func EnterSandbox(config SandboxConfig) error {
+	directory, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	switch config.Filesystem {
+	case SandboxLandlock:
+		_, err := landlockABI()
+		if err != nil {
+			return fmt.Errorf("Landlock isn't available: %s", err)
+		}
+	case SandboxChroot:
+		if syscall.Getuid() != 0 {
+			return errors.New("chroot needs HoneyPoke to be started as root, use landlock instead")
+		}
+		err = unix.Stat(directory, &sandboxDirectoryStat)
+		if err != nil {
+			return err
+		}
+	case SandboxNone, "":
+		config.Filesystem = SandboxNone
+	default:
+		return fmt.Errorf("Invalid sandbox filesystem %s", config.Filesystem)
+	}
+
+	if config.Seccomp && seccompArch == 0 {
+		return fmt.Errorf("seccomp is only supported on amd64 and arm64, not %s", runtime.GOARCH)
+	}
+
+	config.ReadOnly, err = sandboxPaths(config.ReadOnly)
+	if err != nil {
+		return err
+	}
+	config.Writable, err = sandboxPaths(config.Writable)
+	if err != nil {
+		return err
+	}
+	if config.Filesystem == SandboxLandlock {
+		err = checkExecutable(config.Writable)
+		if err != nil {
+			return err
+		}
+	}
+
+	sandboxDirectory = directory
+	sandbox = &config
+
+	if os.Getenv(sandboxEnv) == "1" {
+		// Started over already, so nothing we start gets it
+		os.Unsetenv(sandboxEnv)
+		state, err := readThreadState("/proc/self/status")
+		if err != nil {
+			return err
+		}
+		if !state.noNewPrivs {
+			return fmt.Errorf("Started with %s set, but not in the sandbox", sandboxEnv)
+		}
+		return nil
+	}
+	return restartSandboxed()
+}
+
+// restartSandboxed sets no_new_privs on this thread, restricts it with Landlock if that's the
+// filesystem sandbox, then execs HoneyPoke from it. Only returns on errors.
+func restartSandboxed() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	// Never unlocked, we either exec from this thread or exit
+	runtime.LockOSThread()
+
+	if capabilityMode {
+		// Capability mode's capabilities might be from file capabilities, which no_new_privs
+		// stops exec from giving us again
+		state, err := readThreadState("/proc/self/status")
+		if err != nil {
+			return err
+		}
+		err = raiseAmbient(state.permitted & capabilityMask(capabilityModeCaps))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+	if err != nil {
+		return fmt.Errorf("Could not set no_new_privs: %s", err)
+	}
+	if sandbox.Filesystem == SandboxLandlock {
+		ruleset, err := landlockRuleset(sandboxDirectory, sandbox, executable)
+		if err != nil {
+			return err
+		}
+		err = landlockRestrictSelf(ruleset)
+		unix.Close(ruleset)
+		if err != nil {
+			return fmt.Errorf("Could not restrict HoneyPoke with Landlock: %s", err)
+		}
+	}
+
+	log.Println("Starting over in the sandbox")
+	return syscall.Exec(executable, os.Args, append(os.Environ(), sandboxEnv+"=1"))
+}
+
+// sandboxPaths makes paths for the Landlock rules absolute, checking they exist
+func sandboxPaths(paths []string) ([]string, error) {
+	absolutePaths := make([]string, 0, len(paths))
+	for _, path := range paths {
+		absolute, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		if absolute == "/" {
+			return nil, errors.New("The sandbox can't allow all of /")
+		}
+		_, err = os.Stat(absolute)
+		if err != nil {
+			return nil, err
+		}
+		absolutePaths = append(absolutePaths, absolute)
+	}
+	return absolutePaths, nil
+}
+
+// checkExecutable makes sure HoneyPoke itself can't be written in the sandbox, so whatever
+// gets in can't change what runs the next time it starts
+func checkExecutable(writable []string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	executable, err = filepath.EvalSymlinks(executable)
+	if err != nil {
+		return err
+	}
+	for _, path := range writable {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return err
+		}
+		if executable == resolved || strings.HasPrefix(executable, resolved+string(filepath.Separator)) {
+			return fmt.Errorf("%s can't be writable in the sandbox, HoneyPoke is in it", path)
+		}
+	}
+	return nil
+}
+
+// enterChroot chroots into the working directory, so relative paths keep working. Threads
+// share their root, so this is the one thing that doesn't have to be done on each of them.
+func enterChroot() error {
+	err := syscall.Chroot(sandboxDirectory)
+	if err != nil {
+		return err
+	}
+	return syscall.Chdir("/")
+}
+
+// applySandbox finishes the sandbox once privileges are dropped. seccomp copies the filter
+// to every thread itself.
+func applySandbox() error {
+	if sandbox.Seccomp {
+		err := installSeccomp()
+		if err != nil {
+			return fmt.Errorf("Could not install seccomp filter: %s", err)
+		}
+	}
+	return nil
+}
+
+// testSandbox makes sure every thread is in the sandbox and that it actually stops things
+func testSandbox(tasks *os.File) error {
+	threads, err := readThreads(tasks)
+	if err != nil {
+		return err
+	}
+	for _, thread := range threads {
+		if !thread.noNewPrivs {
+			return fmt.Errorf("Thread %s doesn't have no_new_privs set", thread.tid)
+		}
+		if sandbox.Seccomp && thread.seccomp != unix.SECCOMP_MODE_FILTER {
+			return fmt.Errorf("Thread %s doesn't have the seccomp filter", thread.tid)
+		}
+	}
+
+	switch sandbox.Filesystem {
+	case SandboxLandlock:
+		root, err := os.Open("/")
+		if err == nil {
+			root.Close()
+			return errors.New("Landlock still allows reading /")
+		} else if !os.IsPermission(err) {
+			return err
+		}
+		testPath := filepath.Join(sandboxDirectory, ".honeypoke-sandbox-test")
+		testFile, err := os.OpenFile(testPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			testFile.Close()
+			os.Remove(testPath)
+			return fmt.Errorf("Landlock still allows writing in %s", sandboxDirectory)
+		} else if !os.IsPermission(err) {
+			return err
+		}
+	case SandboxChroot:
+		var root unix.Stat_t
+		err := unix.Stat("/", &root)
+		if err != nil {
+			return err
+		}
+		if root.Dev != sandboxDirectoryStat.Dev || root.Ino != sandboxDirectoryStat.Ino {
+			return errors.New("/ isn't the working directory after the chroot")
+		}
+	}
+
+	if sandbox.Seccomp {
+		// Harmless if it's allowed, unsharing nothing
+		err := unix.Unshare(0)
+		if err != syscall.EPERM {
+			return fmt.Errorf("seccomp allowed unshare: %v", err)
+		}
+		// and that it lets through what HoneyPoke still needs
+		err = probeSeccomp()
+		if err != nil {
+			return err
+		}
+	}
+
+	allowed := "the whole filesystem"
+	if sandbox.Filesystem == SandboxLandlock {
+		allowed = fmt.Sprintf("reading %s and the system files it needs, writing %d paths and reading %d others with Landlock", sandboxDirectory, len(sandbox.Writable), len(sandbox.ReadOnly))
+	} else if sandbox.Filesystem == SandboxChroot {
+		allowed = sandboxDirectory + " with chroot"
+	}
+	syscalls := "any syscall"
+	if sandbox.Seccomp {
+		syscalls = fmt.Sprintf("%d syscalls with seccomp", len(seccompSyscalls)+2)
+	}
+	log.Printf("Sandbox is up on %d threads: no_new_privs set, limited to %s and %s\n", len(threads), allowed, syscalls)
+	return nil
+}
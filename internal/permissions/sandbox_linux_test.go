@@ -0,0 +1,215 @@
+//go:build linux
+// +build linux
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package permissions
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/sys/unix"
+)
+
+// Set to the name of a child to run instead of the tests, with the directory it can use
+const (
+	sandboxChildEnv     = "HONEYPOKE_SANDBOX_CHILD"
+	sandboxDirectoryEnv = "HONEYPOKE_SANDBOX_DIRECTORY"
+)
+
+// Exit status of a child that can't do its test here
+const skipStatus = 3
+
+// skipChild is returned by a child that can't do its test here
+type skipChild string
+
+func (reason skipChild) Error() string {
+	return string(reason)
+}
+
+var sandboxChildren = map[string]func(directory string) error{
+	"seccomp":          seccompChild,
+	"landlock":         landlockChild,
+	"landlock-started": landlockStartedChild,
+}
+
+func TestMain(m *testing.M) {
+	if name := os.Getenv(sandboxChildEnv); name != "" {
+		err := sandboxChildren[name](os.Getenv(sandboxDirectoryEnv))
+		if _, skip := err.(skipChild); skip {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(skipStatus)
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runChild runs one of the sandbox children in a new process, since the sandbox can't be undone
+func runChild(t *testing.T, name string, directory string) {
+	child := exec.Command(os.Args[0], "-test.run=^$")
+	child.Env = append(os.Environ(), sandboxChildEnv+"="+name, sandboxDirectoryEnv+"="+directory)
+	output, err := child.CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == skipStatus {
+		t.Skipf("%s", output)
+	} else if err != nil {
+		t.Fatalf("%s child failed: %s\n%s", name, err, output)
+	}
+}
+
+// landlockChild restricts itself the way restartSandboxed does, with the working directory
+// and HoneyPoke's files under directory, then starts over as landlockStartedChild
+func landlockChild(directory string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	work := filepath.Join(directory, "work")
+	config := &SandboxConfig{Writable: []string{filepath.Join(work, "large"), filepath.Join(work, "missed.db")}}
+
+	runtime.LockOSThread()
+	err = unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+	if err != nil {
+		return err
+	}
+	ruleset, err := landlockRuleset(work, config, executable)
+	if err != nil {
+		return err
+	}
+	err = landlockRestrictSelf(ruleset)
+	unix.Close(ruleset)
+	if err == unix.E2BIG {
+		return skipChild("Already in as many Landlock sandboxes as there can be")
+	} else if err != nil {
+		return err
+	}
+	os.Setenv(sandboxChildEnv, "landlock-started")
+	return syscall.Exec(executable, []string{executable, "-test.run=^$"}, os.Environ())
+}
+
+// landlockStartedChild checks what the sandbox allows after starting over in it
+func landlockStartedChild(directory string) error {
+	work := filepath.Join(directory, "work")
+
+	// The self-test reads these
+	state, err := readThreadState("/proc/self/status")
+	if err != nil {
+		return err
+	}
+	if !state.noNewPrivs {
+		return fmt.Errorf("no_new_privs isn't set")
+	}
+	tasks, err := os.Open("/proc/self/task")
+	if err != nil {
+		return err
+	}
+	_, err = readThreads(tasks)
+	tasks.Close()
+	if err != nil {
+		return err
+	}
+
+	_, err = ioutil.ReadFile(filepath.Join(work, "config.json"))
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(work, "large", "tcp-80.large"), []byte("large"), 0444)
+	if err != nil {
+		return err
+	}
+	db, err := bolt.Open(filepath.Join(work, "missed.db"), 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("ports"))
+		return err
+	})
+	db.Close()
+	if err != nil {
+		return err
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	denied := []func() error{
+		func() error { return ioutil.WriteFile(filepath.Join(work, "config.json"), []byte("{}"), 0644) },
+		func() error { return ioutil.WriteFile(filepath.Join(work, "new.txt"), []byte("new"), 0644) },
+		func() error { return os.Remove(filepath.Join(work, "missed.db")) },
+		func() error { return os.Rename(executable, executable+".old") },
+		func() error { _, err := ioutil.ReadDir("/"); return err },
+		func() error { _, err := ioutil.ReadFile("/proc/1/status"); return err },
+		func() error { _, err := ioutil.ReadDir("/sys/class/net"); return err },
+		func() error { _, err := ioutil.ReadFile("/etc/shadow"); return err },
+	}
+	for i, try := range denied {
+		err = try()
+		if !os.IsPermission(err) {
+			return fmt.Errorf("Access %d wasn't denied: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func TestLandlock(t *testing.T) {
+	if _, err := landlockABI(); err != nil {
+		t.Skipf("Landlock isn't available: %s", err)
+	}
+	directory, err := ioutil.TempDir("", "honeypoke-landlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	work := filepath.Join(directory, "work")
+	err = os.MkdirAll(filepath.Join(work, "large"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"config.json", "missed.db"} {
+		err = ioutil.WriteFile(filepath.Join(work, name), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	runChild(t, "landlock", directory)
+}
+
+func TestCheckExecutable(t *testing.T) {
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	directory, err := ioutil.TempDir("", "honeypoke-writable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	err = checkExecutable([]string{directory})
+	if err != nil {
+		t.Errorf("Got error %s for a directory without HoneyPoke", err)
+	}
+	for _, writable := range []string{executable, filepath.Dir(executable)} {
+		err = checkExecutable([]string{directory, writable})
+		if err == nil {
+			t.Errorf("%s was allowed to be writable", writable)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package permissions
+
+import "errors"
+
+// EnterSandbox needs Linux
+func EnterSandbox(config SandboxConfig) error {
+	return errors.New("The sandbox is only supported on Linux")
+}
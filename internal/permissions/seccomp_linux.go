@@ -0,0 +1,199 @@
+//go:build linux
+// +build linux
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package permissions
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// From linux/seccomp.h
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTSync = 1
+	seccompRetKillProcess  = 0x80000000
+	seccompRetErrno        = 0x00050000
+	seccompRetAllow        = 0x7fff0000
+)
+
+// Offsets in struct seccomp_data
+const (
+	seccompDataNr   = 0
+	seccompDataArch = 4
+	seccompDataArg0 = 16
+	seccompDataArg1 = 24
+)
+
+// Creating namespaces isn't something HoneyPoke ever needs to do
+const cloneNamespaceFlags = unix.CLONE_NEWNS | unix.CLONE_NEWCGROUP | unix.CLONE_NEWUTS | unix.CLONE_NEWIPC |
+	unix.CLONE_NEWUSER | unix.CLONE_NEWPID | unix.CLONE_NEWNET
+
+// A file descriptor that's never open
+const badFD = ^uintptr(0)
+
+// seccompProbe is a syscall the self-test makes sure the filter allows. The arguments are ones
+// the kernel turns down without doing anything, a bad file descriptor unless they're set.
+type seccompProbe struct {
+	name string
+	nr   uintptr
+	args []uintptr
+}
+
+// Syscalls the capture, the listeners and the recorders need, which might not be made until
+// something comes in or a recorder reconnects
+var seccompProbes = []struct {
+	user     string
+	syscalls []seccompProbe
+}{
+	{"the capture", []seccompProbe{
+		{"socket", unix.SYS_SOCKET, nil},
+		{"bind", unix.SYS_BIND, nil},
+		{"ioctl", unix.SYS_IOCTL, []uintptr{badFD, unix.SIOCGIFINDEX}},
+		{"setsockopt", unix.SYS_SETSOCKOPT, nil},
+		{"getsockopt", unix.SYS_GETSOCKOPT, nil},
+		{"mmap", unix.SYS_MMAP, []uintptr{0, 4096, unix.PROT_READ, unix.MAP_SHARED, badFD, 0}},
+		{"ppoll", unix.SYS_PPOLL, []uintptr{1, 1, 0, 0, 0}},
+		{"eventfd2", unix.SYS_EVENTFD2, []uintptr{0, badFD}},
+		{"recvfrom", unix.SYS_RECVFROM, nil},
+	}},
+	{"the listeners", []seccompProbe{
+		{"listen", unix.SYS_LISTEN, nil},
+		{"accept4", unix.SYS_ACCEPT4, nil},
+		{"getsockname", unix.SYS_GETSOCKNAME, nil},
+		{"getpeername", unix.SYS_GETPEERNAME, nil},
+		{"recvmsg", unix.SYS_RECVMSG, nil},
+		{"sendto", unix.SYS_SENDTO, nil},
+		{"shutdown", unix.SYS_SHUTDOWN, nil},
+		{"epoll_ctl", unix.SYS_EPOLL_CTL, nil},
+		{"epoll_pwait", unix.SYS_EPOLL_PWAIT, nil},
+	}},
+	{"the recorders", []seccompProbe{
+		{"connect", unix.SYS_CONNECT, nil},
+		{"sendmsg", unix.SYS_SENDMSG, nil},
+		{"read", unix.SYS_READ, nil},
+		{"write", unix.SYS_WRITE, nil},
+		{"writev", unix.SYS_WRITEV, nil},
+	}},
+	{"writing files", []seccompProbe{
+		{"pread64", unix.SYS_PREAD64, nil},
+		{"pwrite64", unix.SYS_PWRITE64, nil},
+		{"fstat", unix.SYS_FSTAT, nil},
+		{"fcntl", unix.SYS_FCNTL, nil},
+		{"flock", unix.SYS_FLOCK, nil},
+		{"fsync", unix.SYS_FSYNC, nil},
+		{"fdatasync", unix.SYS_FDATASYNC, nil},
+		{"ftruncate", unix.SYS_FTRUNCATE, nil},
+		{"getdents64", unix.SYS_GETDENTS64, nil},
+		{"lseek", unix.SYS_LSEEK, nil},
+	}},
+}
+
+// probeSeccomp makes each probe's syscall, which fails with EPERM only if the filter stopped it
+func probeSeccomp() error {
+	for _, group := range seccompProbes {
+		for _, probe := range group.syscalls {
+			args := probe.args
+			if args == nil {
+				args = []uintptr{badFD}
+			}
+			var full [6]uintptr
+			copy(full[:], args)
+			_, _, errno := unix.Syscall6(probe.nr, full[0], full[1], full[2], full[3], full[4], full[5])
+			if errno == unix.EPERM {
+				return fmt.Errorf("seccomp stops %s, which is needed for %s", probe.name, group.user)
+			}
+		}
+	}
+	return nil
+}
+
+func seccompErrno(errno syscall.Errno) bpf.Instruction {
+	return bpf.RetConstant{Val: seccompRetErrno | uint32(errno)}
+}
+
+// seccompFilter builds the filter. Syscalls that aren't allowed fail with EPERM rather than
+// killing HoneyPoke, so a missing one shows up as an error instead of a crash.
+func seccompFilter() ([]bpf.RawInstruction, error) {
+	loadNr := bpf.LoadAbsolute{Off: seccompDataNr, Size: 4}
+	allow := bpf.RetConstant{Val: seccompRetAllow}
+
+	program := []bpf.Instruction{
+		// Syscall numbers mean something else on other architectures
+		bpf.LoadAbsolute{Off: seccompDataArch, Size: 4},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: seccompArch, SkipTrue: 1},
+		bpf.RetConstant{Val: seccompRetKillProcess},
+
+		// Threads, but no namespaces. The flags are the first argument everywhere we support.
+		loadNr,
+		bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: unix.SYS_CLONE, SkipTrue: 4},
+		bpf.LoadAbsolute{Off: seccompDataArg0, Size: 4},
+		bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: cloneNamespaceFlags, SkipTrue: 1},
+		allow,
+		seccompErrno(syscall.EPERM),
+
+		// clone3 keeps its flags in memory the filter can't see, so have glibc fall back to clone
+		loadNr,
+		bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: unix.SYS_CLONE3, SkipTrue: 1},
+		seccompErrno(syscall.ENOSYS),
+
+		// No pushing input into a terminal we were started from
+		loadNr,
+		bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: unix.SYS_IOCTL, SkipTrue: 5},
+		bpf.LoadAbsolute{Off: seccompDataArg1, Size: 4},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.TIOCSTI, SkipTrue: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.TIOCLINUX, SkipTrue: 1},
+		allow,
+		seccompErrno(syscall.EPERM),
+
+		loadNr,
+	}
+	for _, nr := range seccompSyscalls {
+		program = append(program, bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: uint32(nr), SkipTrue: 1}, allow)
+	}
+	program = append(program, seccompErrno(syscall.EPERM))
+
+	return bpf.Assemble(program)
+}
+
+// installSeccomp sets no_new_privs and installs the filter on every thread
+func installSeccomp() error {
+	if seccompArch == 0 {
+		return fmt.Errorf("seccomp isn't supported on %s", runtime.GOARCH)
+	}
+
+	raw, err := seccompFilter()
+	if err != nil {
+		return err
+	}
+	filter := make([]unix.SockFilter, len(raw))
+	for i, instruction := range raw {
+		filter[i] = unix.SockFilter{Code: instruction.Op, Jt: instruction.Jt, Jf: instruction.Jf, K: instruction.K}
+	}
+	program := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+
+	// Both have to be on the same thread, TSYNC then copies them to the others
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	err = unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+	if err != nil {
+		return err
+	}
+	result, _, errno := unix.Syscall(unix.SYS_SECCOMP, seccompSetModeFilter, seccompFilterFlagTSync, uintptr(unsafe.Pointer(&program)))
+	if errno != 0 {
+		return errno
+	} else if result != 0 {
+		return fmt.Errorf("Thread %d could not take the seccomp filter", result)
+	}
+	return nil
+}
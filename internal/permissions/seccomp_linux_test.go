@@ -0,0 +1,301 @@
+//go:build linux
+// +build linux
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package permissions
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// seccompChild installs the filter and goes through what the listeners, recorders and
+// watcher do, failing on anything the filter stops
+func seccompChild(directory string) error {
+	err := installSeccomp()
+	if err != nil {
+		return err
+	}
+
+	steps := []struct {
+		name string
+		run  func(directory string) error
+	}{
+		{"probes", func(string) error { return probeSeccomp() }},
+		{"files", seccompFiles},
+		{"missed port database", seccompBolt},
+		{"listeners", seccompListeners},
+		{"recorders", seccompRecorders},
+		{"capture", seccompCapture},
+	}
+	for _, step := range steps {
+		err = step.run(directory)
+		if err != nil {
+			return fmt.Errorf("%s: %s", step.name, err)
+		}
+	}
+
+	// Still stopped
+	err = unix.Unshare(unix.CLONE_NEWUTS)
+	if err != unix.EPERM {
+		return fmt.Errorf("unshare wasn't stopped: %v", err)
+	}
+	return nil
+}
+
+// seccompFiles writes a large input file and a session capture the way the server and
+// capture packages do
+func seccompFiles(directory string) error {
+	path := filepath.Join(directory, "tcp-80.large")
+	outFile, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0444)
+	if err != nil {
+		return err
+	}
+	_, err = outFile.Write(bytes.Repeat([]byte{'a'}, 8192))
+	if err != nil {
+		return err
+	}
+	err = outFile.Sync()
+	if err != nil {
+		return err
+	}
+	outFile.Close()
+
+	err = os.Rename(path, path+".old")
+	if err != nil {
+		return err
+	}
+	contents, err := ioutil.ReadFile(path + ".old")
+	if err != nil || len(contents) != 8192 {
+		return fmt.Errorf("Could not read the file back: %v", err)
+	}
+	_, err = ioutil.ReadDir(directory)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path + ".old")
+}
+
+func seccompBolt(directory string) error {
+	db, err := bolt.Open(filepath.Join(directory, "missed.db"), 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("tcp"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("8080"), []byte{0, 0, 0, 1})
+	})
+	if err != nil {
+		return err
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("tcp")).Get([]byte("8080")) == nil {
+			return fmt.Errorf("Count is missing")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+func seccompListeners(directory string) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+		buffer := make([]byte, 5)
+		_, err = conn.Read(buffer)
+		accepted <- err
+	}()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		return err
+	}
+	client.Write([]byte("hello"))
+	client.Close()
+	err = <-accepted
+	if err != nil {
+		return err
+	}
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer udp.Close()
+	sender, err := net.Dial("udp", udp.LocalAddr().String())
+	if err != nil {
+		return err
+	}
+	defer sender.Close()
+	sender.Write([]byte("hello"))
+	udp.SetReadDeadline(time.Now().Add(time.Second))
+	buffer := make([]byte, 5)
+	_, remote, err := udp.ReadFrom(buffer)
+	if err != nil {
+		return err
+	}
+	_, err = udp.WriteTo(buffer, remote)
+	return err
+}
+
+// seccompRecorders posts a record over HTTP like the Elasticsearch recorders, by name so the
+// resolver is used too
+func seccompRecorders(directory string) error {
+	received := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- body
+	}))
+	defer server.Close()
+
+	url := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	response, err := http.Post(url, "application/json", strings.NewReader(`{"port":80}`))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if body := <-received; string(body) != `{"port":80}` {
+		return fmt.Errorf("Got %q", body)
+	}
+	return nil
+}
+
+// canCapture checks for CAP_NET_RAW, skipping the capture steps without it
+func canCapture() bool {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return false
+	}
+	unix.Close(fd)
+	return true
+}
+
+// seccompCapture sets up a TPACKET_V3 ring on the loopback interface and waits for a packet
+// in it, the way both libpcap and gopacket's afpacket capture on Linux. The tests can't use
+// the real libpcap, and afpacket would need cgo.
+func seccompCapture(directory string) error {
+	if !canCapture() {
+		return nil
+	}
+	protocol := htons(unix.ETH_P_ALL)
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, int(protocol))
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	request, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+	err = unix.IoctlIfreq(fd, unix.SIOCGIFINDEX, request)
+	if err != nil {
+		return err
+	}
+	err = unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V3)
+	if err != nil {
+		return err
+	}
+	ring := unix.TpacketReq3{Block_size: 1 << 16, Block_nr: 4, Frame_size: 1 << 11, Frame_nr: 4 * (1 << 16) / (1 << 11), Retire_blk_tov: 10}
+	err = unix.SetsockoptTpacketReq3(fd, unix.SOL_PACKET, unix.PACKET_RX_RING, &ring)
+	if err != nil {
+		return err
+	}
+	memory, err := unix.Mmap(fd, 0, int(ring.Block_size*ring.Block_nr), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	defer unix.Munmap(memory)
+	err = unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: protocol, Ifindex: int(request.Uint32())})
+	if err != nil {
+		return err
+	}
+
+	filter, err := bpf.Assemble([]bpf.Instruction{bpf.RetConstant{Val: 0xffff}})
+	if err != nil {
+		return err
+	}
+	program := unix.SockFprog{Len: 1, Filter: &unix.SockFilter{Code: filter[0].Op, K: filter[0].K}}
+	err = unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &program)
+	if err != nil {
+		return err
+	}
+	err = unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_FANOUT, os.Getpid()&0xffff|unix.PACKET_FANOUT_HASH<<16)
+	if err != nil {
+		return err
+	}
+
+	// libpcap wakes itself up with an eventfd when it's stopped
+	wakeup, err := unix.Eventfd(0, unix.EFD_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(wakeup)
+
+	sender, err := net.Dial("udp", "127.0.0.1:9")
+	if err != nil {
+		return err
+	}
+	defer sender.Close()
+	ready := 0
+	for tries := 0; tries < 20 && ready == 0; tries++ {
+		sender.Write([]byte("hello"))
+		ready, err = unix.Poll([]unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}, {Fd: int32(wakeup), Events: unix.POLLIN}}, 50)
+		if err != nil {
+			return err
+		}
+	}
+	if ready == 0 {
+		return fmt.Errorf("No packet was captured")
+	}
+	_, err = unix.GetsockoptTpacketStatsV3(fd, unix.SOL_PACKET, unix.PACKET_STATISTICS)
+	return err
+}
+
+func htons(value uint16) uint16 {
+	return value<<8 | value>>8
+}
+
+func TestSeccomp(t *testing.T) {
+	if seccompArch == 0 {
+		t.Skip("No seccomp filter for this architecture")
+	}
+	directory, err := ioutil.TempDir("", "honeypoke-seccomp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	runChild(t, "seccomp", directory)
+}
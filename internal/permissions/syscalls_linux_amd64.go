@@ -0,0 +1,48 @@
+//go:build linux && amd64
+// +build linux,amd64
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package permissions
+
+import "golang.org/x/sys/unix"
+
+const seccompArch = unix.AUDIT_ARCH_X86_64
+
+// Syscalls the seccomp filter allows, besides clone and ioctl which it checks the arguments of
+var seccompSyscalls = []uintptr{
+	// Go runtime, cgo and glibc
+	unix.SYS_ARCH_PRCTL, unix.SYS_BRK, unix.SYS_EXIT, unix.SYS_EXIT_GROUP, unix.SYS_FUTEX,
+	unix.SYS_GETPID, unix.SYS_GETPPID, unix.SYS_GETTID, unix.SYS_GETRANDOM, unix.SYS_GETRLIMIT,
+	unix.SYS_PRLIMIT64, unix.SYS_MADVISE, unix.SYS_MMAP, unix.SYS_MPROTECT, unix.SYS_MREMAP,
+	unix.SYS_MSYNC, unix.SYS_MUNMAP, unix.SYS_NANOSLEEP, unix.SYS_CLOCK_NANOSLEEP, unix.SYS_CLOCK_GETTIME,
+	unix.SYS_CLOCK_GETRES, unix.SYS_GETTIMEOFDAY, unix.SYS_RESTART_SYSCALL, unix.SYS_RSEQ,
+	unix.SYS_RT_SIGACTION, unix.SYS_RT_SIGPROCMASK, unix.SYS_RT_SIGRETURN, unix.SYS_SIGALTSTACK,
+	unix.SYS_SCHED_GETAFFINITY, unix.SYS_SCHED_YIELD, unix.SYS_SET_ROBUST_LIST, unix.SYS_SET_TID_ADDRESS,
+	unix.SYS_TGKILL, unix.SYS_UNAME, unix.SYS_GETUID, unix.SYS_GETEUID, unix.SYS_GETGID,
+	unix.SYS_GETEGID, unix.SYS_GETGROUPS, unix.SYS_WAIT4, unix.SYS_WAITID,
+
+	// Polling
+	unix.SYS_EPOLL_CREATE, unix.SYS_EPOLL_CREATE1, unix.SYS_EPOLL_CTL, unix.SYS_EPOLL_WAIT,
+	unix.SYS_EPOLL_PWAIT, unix.SYS_EPOLL_PWAIT2, unix.SYS_EVENTFD2, unix.SYS_POLL, unix.SYS_PPOLL,
+	unix.SYS_SELECT, unix.SYS_PSELECT6,
+
+	// Files
+	unix.SYS_OPEN, unix.SYS_OPENAT, unix.SYS_CLOSE, unix.SYS_READ, unix.SYS_READV, unix.SYS_PREAD64,
+	unix.SYS_WRITE, unix.SYS_WRITEV, unix.SYS_PWRITE64, unix.SYS_LSEEK, unix.SYS_FCNTL, unix.SYS_DUP,
+	unix.SYS_DUP2, unix.SYS_DUP3, unix.SYS_PIPE, unix.SYS_PIPE2, unix.SYS_FSTAT, unix.SYS_STAT,
+	unix.SYS_LSTAT, unix.SYS_NEWFSTATAT, unix.SYS_STATX, unix.SYS_STATFS, unix.SYS_FSTATFS,
+	unix.SYS_GETDENTS64, unix.SYS_GETCWD, unix.SYS_READLINK, unix.SYS_READLINKAT, unix.SYS_ACCESS,
+	unix.SYS_FACCESSAT, unix.SYS_FACCESSAT2, unix.SYS_MKDIR, unix.SYS_MKDIRAT, unix.SYS_UNLINK,
+	unix.SYS_UNLINKAT, unix.SYS_RENAME, unix.SYS_RENAMEAT, unix.SYS_RENAMEAT2, unix.SYS_FSYNC,
+	unix.SYS_FDATASYNC, unix.SYS_FTRUNCATE, unix.SYS_FALLOCATE, unix.SYS_FLOCK, unix.SYS_SENDFILE,
+	unix.SYS_SPLICE, unix.SYS_COPY_FILE_RANGE,
+
+	// Network
+	unix.SYS_SOCKET, unix.SYS_BIND, unix.SYS_LISTEN, unix.SYS_ACCEPT, unix.SYS_ACCEPT4, unix.SYS_CONNECT,
+	unix.SYS_GETSOCKNAME, unix.SYS_GETPEERNAME, unix.SYS_GETSOCKOPT, unix.SYS_SETSOCKOPT,
+	unix.SYS_SENDTO, unix.SYS_RECVFROM, unix.SYS_SENDMSG, unix.SYS_RECVMSG, unix.SYS_SENDMMSG,
+	unix.SYS_RECVMMSG, unix.SYS_SHUTDOWN,
+}
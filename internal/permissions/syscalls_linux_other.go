@@ -0,0 +1,13 @@
+//go:build linux && !amd64 && !arm64
+// +build linux,!amd64,!arm64
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package permissions
+
+// The seccomp filter only has syscall lists for amd64 and arm64
+const seccompArch = 0
+
+var seccompSyscalls = []uintptr{}
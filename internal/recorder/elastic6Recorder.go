@@ -8,6 +8,7 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"log"
 	"net"
 	"net/http"
@@ -51,19 +52,19 @@ func (r Elastic6Recorder) Record(record *HoneypokeRecord) error {
 	return nil
 }
 
-func NewElastic6Recorder(config map[string]interface{}) *Elastic6Recorder {
+func NewElastic6Recorder(config map[string]interface{}) (*Elastic6Recorder, error) {
 
 	host, ok := config["host"].(string)
 	if !ok {
-		log.Fatalln("Could not find 'host' entry for elasticsearch6")
+		return nil, errors.New("Could not find 'host' entry for elasticsearch6")
 	}
 	username, ok := config["username"].(string)
 	if !ok {
-		log.Fatalln("Could not find 'username' entry for elasticsearch6")
+		return nil, errors.New("Could not find 'username' entry for elasticsearch6")
 	}
 	password, ok := config["password"].(string)
 	if !ok {
-		log.Fatalln("Could not find 'password' entry for elasticsearch6")
+		return nil, errors.New("Could not find 'password' entry for elasticsearch6")
 	}
 
 	es6rec := new(Elastic6Recorder)
@@ -83,10 +84,13 @@ func NewElastic6Recorder(config map[string]interface{}) *Elastic6Recorder {
 		},
 	}
 
-	client, _ := elasticsearch6.NewClient(cfg)
+	client, err := elasticsearch6.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
 	es6rec.client = client
 
 	log.Println("Created elasticsearch6 recorder")
 
-	return es6rec
+	return es6rec, nil
 }
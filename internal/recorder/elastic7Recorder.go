@@ -8,6 +8,7 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"log"
 	"net"
 	"net/http"
@@ -51,19 +52,19 @@ func (r Elastic7Recorder) Record(record *HoneypokeRecord) error {
 	return nil
 }
 
-func NewElastic7Recorder(config map[string]interface{}) *Elastic7Recorder {
+func NewElastic7Recorder(config map[string]interface{}) (*Elastic7Recorder, error) {
 
 	host, ok := config["host"].(string)
 	if !ok {
-		log.Fatalln("Could not find 'host' entry for elasticsearch7")
+		return nil, errors.New("Could not find 'host' entry for elasticsearch7")
 	}
 	username, ok := config["username"].(string)
 	if !ok {
-		log.Fatalln("Could not find 'username' entry for elasticsearch7")
+		return nil, errors.New("Could not find 'username' entry for elasticsearch7")
 	}
 	password, ok := config["password"].(string)
 	if !ok {
-		log.Fatalln("Could not find 'password' entry for elasticsearch7")
+		return nil, errors.New("Could not find 'password' entry for elasticsearch7")
 	}
 
 	es6rec := new(Elastic7Recorder)
@@ -83,10 +84,13 @@ func NewElastic7Recorder(config map[string]interface{}) *Elastic7Recorder {
 		},
 	}
 
-	client, _ := elasticsearch7.NewClient(cfg)
+	client, err := elasticsearch7.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
 	es6rec.client = client
 
 	log.Println("Created elasticsearch7 recorder")
 
-	return es6rec
+	return es6rec, nil
 }
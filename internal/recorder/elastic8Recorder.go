@@ -8,6 +8,7 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"log"
 	"net"
 	"net/http"
@@ -51,19 +52,19 @@ func (r Elastic8Recorder) Record(record *HoneypokeRecord) error {
 	return nil
 }
 
-func NewElastic8Recorder(config map[string]interface{}) *Elastic8Recorder {
+func NewElastic8Recorder(config map[string]interface{}) (*Elastic8Recorder, error) {
 
 	host, ok := config["host"].(string)
 	if !ok {
-		log.Fatalln("Could not find 'host' entry for elasticsearch8")
+		return nil, errors.New("Could not find 'host' entry for elasticsearch8")
 	}
 	username, ok := config["username"].(string)
 	if !ok {
-		log.Fatalln("Could not find 'username' entry for elasticsearch8")
+		return nil, errors.New("Could not find 'username' entry for elasticsearch8")
 	}
 	password, ok := config["password"].(string)
 	if !ok {
-		log.Fatalln("Could not find 'password' entry for elasticsearch8")
+		return nil, errors.New("Could not find 'password' entry for elasticsearch8")
 	}
 
 	es8rec := new(Elastic8Recorder)
@@ -83,10 +84,13 @@ func NewElastic8Recorder(config map[string]interface{}) *Elastic8Recorder {
 		},
 	}
 
-	client, _ := elasticsearch8.NewClient(cfg)
+	client, err := elasticsearch8.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
 	es8rec.client = client
 
 	log.Println("Created elasticsearch8 recorder")
 
-	return es8rec
+	return es8rec, nil
 }
@@ -5,30 +5,99 @@
 package recorder
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/oschwald/geoip2-golang"
 )
 
+// TLSInfo holds what was learned from a client's TLS ClientHello
+type TLSInfo struct {
+	SNI                 string   `json:"sni"`
+	ALPN                []string `json:"alpn"`
+	Version             uint16   `json:"version"`
+	SupportedVersions   []uint16 `json:"supported_versions"`
+	Ciphers             []uint16 `json:"ciphers"`
+	Extensions          []uint16 `json:"extensions"`
+	SupportedGroups     []uint16 `json:"supported_groups"`
+	SignatureAlgorithms []uint16 `json:"signature_algorithms"`
+	JA3                 string   `json:"ja3"`
+	JA3Hash             string   `json:"ja3_hash"`
+	JA4                 string   `json:"ja4"`
+	HandshakeError      string   `json:"handshake_error"`
+}
+
 // HoneypokeRecord represents a record of input
 type HoneypokeRecord struct {
-	Time       string             `json:"time"`
-	RemoteIP   string             `json:"remote_ip"`
-	RemotePort int                `json:"remote_port"`
-	Protocol   string             `json:"protocol"`
-	Port       int                `json:"port"`
-	Input      string             `json:"input"`
-	IsBinary   bool               `json:"is_binary"`
-	UseSSL     bool               `json:"use_ssl"`
-	Location   map[string]float64 `json:"location"`
-	Host       string             `json:"host"`
+	Time            string             `json:"time"`
+	RemoteIP        string             `json:"remote_ip"`
+	RemotePort      int                `json:"remote_port"`
+	Protocol        string             `json:"protocol"`
+	Port            int                `json:"port"`
+	Input           string             `json:"input"`
+	IsBinary        bool               `json:"is_binary"`
+	UseSSL          bool               `json:"use_ssl"`
+	Location        map[string]float64 `json:"location"`
+	Host            string             `json:"host"`
+	RateLimited     bool               `json:"rate_limited"`
+	TLS             *TLSInfo           `json:"tls,omitempty"`
+	StartTLSOffset  int                `json:"starttls_offset,omitempty"`
+	Kind            string             `json:"kind,omitempty"`
+	TCPFlags        string             `json:"tcp_flags,omitempty"`
+	Count           int                `json:"count,omitempty"`
+	Ports           []int              `json:"ports,omitempty"`
+	DistinctSources int                `json:"distinct_sources,omitempty"`
+	DistinctTargets int                `json:"distinct_targets,omitempty"`
+	ScanType        string             `json:"scan_type,omitempty"`
+	ScanTechnique   string             `json:"scan_technique,omitempty"`
+	Rate            float64            `json:"rate,omitempty"`
+	Duration        float64            `json:"duration,omitempty"`
+	OSGuess         string             `json:"os_guess,omitempty"`
+	ScannerTool     string             `json:"scanner_tool,omitempty"`
+	TCPFingerprint  string             `json:"tcp_fingerprint,omitempty"`
+	PcapPath        string             `json:"pcap_path,omitempty"`
+	BackscatterType string             `json:"backscatter_type,omitempty"`
+	VictimIP        string             `json:"victim_ip,omitempty"`
+	VictimPort      int                `json:"victim_port,omitempty"`
+	IPVersion       int                `json:"ip_version,omitempty"`
+	Listener        string             `json:"listener,omitempty"`
+	Persona         string             `json:"persona,omitempty"`
+	ProxyIP         string             `json:"proxy_ip,omitempty"`
+	ProxyError      string             `json:"proxy_error,omitempty"`
+}
+
+// MarshalJSON writes records that aren't from a single host, like listener announcements
+// and missed ports aggregated by port, with a null remote_ip. An empty string isn't an IP.
+func (record *HoneypokeRecord) MarshalJSON() ([]byte, error) {
+	type plainRecord HoneypokeRecord
+	var remoteIP *string
+	if record.RemoteIP != "" {
+		remoteIP = &record.RemoteIP
+	}
+	return json.Marshal(&struct {
+		*plainRecord
+		RemoteIP *string `json:"remote_ip"`
+	}{(*plainRecord)(record), remoteIP})
 }
 
+// KindNewListener marks records announcing a listener opened at runtime
+const KindNewListener = "new_listener"
+
+// KindMissed marks records for packets sent to ports without a listener
+const KindMissed = "missed"
+
+// KindScan marks records summarizing a port scan or sweep from a source
+const KindScan = "scan"
+
+// KindBackscatter is for replies to attacks on others that spoofed our address
+const KindBackscatter = "backscatter"
+
 type HoneypokeRecorder interface {
 	Record(record *HoneypokeRecord) error
 }
@@ -40,43 +109,108 @@ func NewRecord(remote_ip string, remote_port uint16) *HoneypokeRecord {
 	return rec
 }
 
-func recorderConsumer(recorders []HoneypokeRecorder, c chan *HoneypokeRecord) {
+// sendToRecorders adds the location to a record and sends it to every recorder
+func sendToRecorders(db *geoip2.Reader, record *HoneypokeRecord) {
+	if record.RemoteIP != "" {
+		ip := net.ParseIP(record.RemoteIP)
+		if ip != nil {
+			// IPv4 clients of IPv6 sockets can show up as ::ffff:a.b.c.d
+			if ip.To4() != nil {
+				ip = ip.To4()
+				record.IPVersion = 4
+			} else {
+				record.IPVersion = 6
+			}
+			record.RemoteIP = ip.String()
+		}
+		cityData, err := db.City(ip)
+
+		record.Location = make(map[string]float64)
+		record.Location["lat"] = 0.0
+		record.Location["lon"] = 0.0
+
+		if err == nil {
+			lat, err := strconv.ParseFloat(fmt.Sprintf("%.2f", cityData.Location.Latitude), 64)
+			if err != nil {
+				lat = 0.0
+			}
+			record.Location["lat"] = lat
+			lon, err := strconv.ParseFloat(fmt.Sprintf("%.2f", cityData.Location.Longitude), 64)
+			if err != nil {
+				lon = 0.0
+			}
+			record.Location["lon"] = lon
+		}
+
+	}
+	for _, recorder := range currentRecorders() {
+		recorder.Record(record)
+	}
+	recorded++
+	// fmt.Printf("Got a record: %s\nData: \n%s\n\n", record.Host, record.Input)
+}
+
+func recorderConsumer(c chan *HoneypokeRecord) {
 
 	db, err := geoip2.Open("GeoLite2-City.mmdb")
 	if err != nil {
 		log.Fatal(err)
 	}
 	for {
-		record := <-c
-		if record.RemoteIP != "" {
-			ip := net.ParseIP(record.RemoteIP)
-			cityData, err := db.City(ip)
-
-			record.Location = make(map[string]float64)
-			record.Location["lat"] = 0.0
-			record.Location["lon"] = 0.0
-
-			if err == nil {
-				lat, err := strconv.ParseFloat(fmt.Sprintf("%.2f", cityData.Location.Latitude), 64)
-				if err != nil {
-					lat = 0.0
-				}
-				record.Location["lat"] = lat
-				lon, err := strconv.ParseFloat(fmt.Sprintf("%.2f", cityData.Location.Longitude), 64)
-				if err != nil {
-					lon = 0.0
+		select {
+		case next := <-c:
+			sendToRecorders(db, next)
+		case <-consumerStop:
+			// Senders already waiting still get recorded, anything sent later never is
+			for {
+				select {
+				case next := <-c:
+					sendToRecorders(db, next)
+				default:
+					close(consumerDone)
+					return
 				}
-				record.Location["lon"] = lon
 			}
-
-		}
-		for _, recorder := range recorders {
-			recorder.Record(record)
 		}
-		// fmt.Printf("Got a record: %s\nData: \n%s\n\n", record.Host, record.Input)
 	}
 }
 
+// Closed to tell the consumer to finish up
+var consumerStop = make(chan bool)
+
+// Closed once the consumer has recorded everything sent to it
+var consumerDone = make(chan bool)
+
+// How many records the consumer has handled, only read once it's done
+var recorded int
+
+// The recorders records are sent to, which can be swapped while running
+var recordersLock sync.Mutex
+var activeRecorders []HoneypokeRecorder
+
+func currentRecorders() []HoneypokeRecorder {
+	recordersLock.Lock()
+	defer recordersLock.Unlock()
+	return activeRecorders
+}
+
+// SetRecorders swaps the recorders, starting with the next record
+func SetRecorders(recorders []HoneypokeRecorder) {
+	recordersLock.Lock()
+	defer recordersLock.Unlock()
+	activeRecorders = recorders
+}
+
 func StartRecorders(recorders []HoneypokeRecorder, c chan *HoneypokeRecord) {
-	go recorderConsumer(recorders, c)
+	SetRecorders(recorders)
+	go recorderConsumer(c)
+}
+
+// StopRecorders waits for the records being sent to be recorded, then stops the recorders.
+// The channel isn't closed, so handlers that are still running can't panic sending on it,
+// their records are just never received. Returns how many records there were in total.
+func StopRecorders() int {
+	close(consumerStop)
+	<-consumerDone
+	return recorded
 }
@@ -0,0 +1,43 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package recorder
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRecordRemoteIP(t *testing.T) {
+	tests := []struct {
+		name     string
+		remoteIP string
+		expected interface{}
+	}{
+		{"client", "198.51.100.7", "198.51.100.7"},
+		{"no client", "", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			record := NewRecord(test.remoteIP, 0)
+			record.RemoteIP = test.remoteIP
+			record.Port = 22
+			data, err := json.Marshal(record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fields := make(map[string]interface{})
+			if err := json.Unmarshal(data, &fields); err != nil {
+				t.Fatal(err)
+			}
+			remoteIP, ok := fields["remote_ip"]
+			if !ok || remoteIP != test.expected {
+				t.Errorf("Got remote_ip %v, expected %v", remoteIP, test.expected)
+			}
+			if fields["port"] != 22.0 || fields["remote_port"] != 0.0 {
+				t.Errorf("Other fields weren't kept: %s", data)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// Set in the environment of the bind helper, so it knows what it is
+const bindHelperEnv = "HONEYPOKE_BIND_HELPER"
+
+// Only set once the bind helper is started
+var helper *bindHelper
+
+// IsBindHelper reports if this process was started as the bind helper
+func IsBindHelper() bool {
+	return os.Getenv(bindHelperEnv) == "1"
+}
+
+// needsHelper checks if a bind failed because permissions were dropped and the helper can do it
+func needsHelper(err error) bool {
+	return helper != nil && errors.Is(err, os.ErrPermission)
+}
+
+// listenTCP opens a TCP listener, going through the bind helper if we aren't allowed to
+func listenTCP(address string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err == nil || !needsHelper(err) {
+		return listener, err
+	}
+	file, err := helper.bind("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return net.FileListener(file)
+}
+
+// listenUDP opens a UDP listener, going through the bind helper if we aren't allowed to
+func listenUDP(address string) (net.PacketConn, error) {
+	udpList, err := net.ListenPacket("udp", address)
+	if err == nil || !needsHelper(err) {
+		return udpList, err
+	}
+	file, err := helper.bind("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return net.FilePacketConn(file)
+}
@@ -0,0 +1,161 @@
+//go:build linux
+// +build linux
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// The bind helper is a copy of HoneyPoke that stays root after permissions are dropped, so
+// listeners can still be opened on privileged ports. All it does is bind sockets and pass them
+// back over a unix socket.
+type bindHelper struct {
+	lock sync.Mutex
+	conn *net.UnixConn
+}
+
+// The helper gets its end of the socket as its first extra file
+const bindHelperFd = 3
+
+// Longest request or reply
+const bindHelperMessageSize = 512
+
+// StartBindHelper starts the bind helper. It has to be done while still root.
+func StartBindHelper() error {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	ours := os.NewFile(uintptr(fds[0]), "bind-helper")
+	theirs := os.NewFile(uintptr(fds[1]), "bind-helper")
+	defer ours.Close()
+	defer theirs.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(executable)
+	cmd.Env = append(os.Environ(), bindHelperEnv+"=1")
+	cmd.ExtraFiles = []*os.File{theirs}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// Don't leave a root process behind if we die
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	go cmd.Wait()
+
+	conn, err := net.FileConn(ours)
+	if err != nil {
+		return err
+	}
+	helper = &bindHelper{conn: conn.(*net.UnixConn)}
+	log.Printf("Started bind helper as pid %d\n", cmd.Process.Pid)
+	return nil
+}
+
+// bind asks the helper for a socket bound to address, network is "tcp" or "udp"
+func (h *bindHelper) bind(network string, address string) (*os.File, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	_, err := h.conn.Write([]byte(network + " " + address))
+	if err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, bindHelperMessageSize)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := h.conn.ReadMsgUnix(reply, oob)
+	if err != nil {
+		return nil, err
+	}
+	if oobn == 0 {
+		return nil, errors.New(string(reply[:n]))
+	}
+
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(messages) != 1 {
+		return nil, errors.New("Bad reply from bind helper")
+	}
+	fds, err := syscall.ParseUnixRights(&messages[0])
+	if err != nil || len(fds) != 1 {
+		return nil, errors.New("Bad reply from bind helper")
+	}
+	return os.NewFile(uintptr(fds[0]), network+" "+address), nil
+}
+
+// bindSocket opens a socket for the helper to pass back
+func bindSocket(network string, address string) (*os.File, error) {
+	switch network {
+	case "tcp":
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		defer listener.Close()
+		return listener.(*net.TCPListener).File()
+	case "udp":
+		udpList, err := net.ListenPacket("udp", address)
+		if err != nil {
+			return nil, err
+		}
+		defer udpList.Close()
+		return udpList.(*net.UDPConn).File()
+	}
+	return nil, fmt.Errorf("Invalid network %s", network)
+}
+
+// RunBindHelper is the bind helper's side, it runs until HoneyPoke closes its end
+func RunBindHelper() {
+	conn, err := net.FileConn(os.NewFile(bindHelperFd, "bind-helper"))
+	if err != nil {
+		log.Fatalf("Bind helper could not open its socket: %s\n", err)
+	}
+	unixConn := conn.(*net.UnixConn)
+
+	// HoneyPoke handles these and closes our socket when it's done
+	signal.Ignore(syscall.SIGINT, syscall.SIGHUP)
+
+	request := make([]byte, bindHelperMessageSize)
+	for {
+		n, err := unixConn.Read(request)
+		if err != nil || n == 0 {
+			return
+		}
+
+		fields := strings.SplitN(string(request[:n]), " ", 2)
+		if len(fields) != 2 {
+			unixConn.Write([]byte("Invalid request"))
+			continue
+		}
+		file, err := bindSocket(fields[0], fields[1])
+		if err != nil {
+			unixConn.Write([]byte(err.Error()))
+			continue
+		}
+		log.Printf("Bind helper opened %s %s\n", fields[0], fields[1])
+		_, _, err = unixConn.WriteMsgUnix([]byte("ok"), syscall.UnixRights(int(file.Fd())), nil)
+		file.Close()
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+// +build !linux
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package server
+
+import (
+	"errors"
+	"log"
+	"os"
+)
+
+var errBindHelperUnsupported = errors.New("The bind helper is only supported on Linux")
+
+type bindHelper struct{}
+
+func StartBindHelper() error {
+	return errBindHelperUnsupported
+}
+
+func (h *bindHelper) bind(network string, address string) (*os.File, error) {
+	return nil, errBindHelperUnsupported
+}
+
+func RunBindHelper() {
+	log.Fatalln(errBindHelperUnsupported)
+}
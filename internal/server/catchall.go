@@ -0,0 +1,96 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"strconv"
+
+	"github.com/bocajspear1/honeypoke-go/internal/permissions"
+	"github.com/bocajspear1/honeypoke-go/internal/recorder"
+)
+
+// CatchAllRedirect is for connections sent to the listener with a NAT REDIRECT rule
+const CatchAllRedirect = "redirect"
+
+// CatchAllTProxy is for connections sent to the listener with a TPROXY rule
+const CatchAllTProxy = "tproxy"
+
+// There's only ever one catch-all listener
+const catchAllKey = "catch-all"
+
+func runCatchAllServer(port int, mode string, tlsMode TLSMode, tlsConfig *tls.Config, recChan chan *recorder.HoneypokeRecord, contChan chan bool) {
+	log.Printf("Started catch-all server for port %d in %s mode", port, mode)
+
+	listenConfig := net.ListenConfig{}
+	if mode == CatchAllTProxy {
+		listenConfig.Control = setTransparent
+	}
+
+	listener, err := listenConfig.Listen(context.Background(), "tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		log.Fatalf("Failed to start catch-all server on port %d: %s\n", port, err)
+		return
+	}
+
+	contChan <- true
+
+	permissions.WaitUntilDropped()
+
+	if !active.addListener(catchAllKey, listener) {
+		return
+	}
+	defer active.serverDone(catchAllKey, listener)
+	defer listener.Close()
+
+	for {
+		conn, aerr := listener.Accept()
+
+		if aerr != nil {
+			if active.isOpen(catchAllKey, listener) {
+				log.Printf("Failed connection")
+			}
+			return
+		}
+
+		var originalPort int
+		if mode == CatchAllTProxy {
+			// TPROXY keeps the original destination as the local address
+			originalPort = conn.LocalAddr().(*net.TCPAddr).Port
+		} else {
+			originalPort, err = originalDestinationPort(conn.(*net.TCPConn))
+			if err != nil {
+				log.Printf("Could not get original destination for catch-all connection: %s\n", err)
+				conn.Close()
+				continue
+			}
+		}
+
+		active.handle(conn, func() {
+			tcpAccept(originalPort, listenerTag{}, false, tlsMode, tlsConfig, conn, recChan)
+		})
+	}
+}
+
+// StartCatchAll starts a listener that receives connections redirected from every other port
+func StartCatchAll(port int, mode string, tlsMode TLSMode, recChan chan *recorder.HoneypokeRecord, contChan chan bool) {
+	if mode != CatchAllRedirect && mode != CatchAllTProxy {
+		log.Fatalf("Invalid catch-all mode %s\n", mode)
+	}
+
+	var tlsConfig *tls.Config
+	if tlsMode != TLSOff {
+		var err error
+		tlsConfig, err = newTLSConfig(nil)
+		if err != nil {
+			log.Fatalf("Could not load certificates for catch-all port %d: %s\n", port, err)
+		}
+	}
+
+	go runCatchAllServer(port, mode, tlsMode, tlsConfig, recChan, contChan)
+}
@@ -0,0 +1,73 @@
+//go:build linux
+// +build linux
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package server
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// From linux/netfilter_ipv4.h and linux/netfilter_ipv6/ip6_tables.h
+const soOriginalDst = 80
+const ip6tSoOriginalDst = 80
+
+// From linux/in6.h
+const ipv6Transparent = 75
+
+// setTransparent lets a listener accept connections for addresses that aren't ours, for TPROXY
+func setTransparent(network string, address string, rawConn syscall.RawConn) error {
+	var sockErr error
+	err := rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+		if sockErr == nil && network != "tcp4" {
+			// Only fails on IPv4-only sockets, where it isn't needed
+			syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// originalDestinationPort gets the port a connection was sent to before a NAT REDIRECT
+func originalDestinationPort(conn *net.TCPConn) (int, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	isIPv4 := conn.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+
+	port := 0
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		// The kernel fills in a sockaddr_in or sockaddr_in6, these getsockopt helpers
+		// are just used for having a buffer big enough to hold them
+		if isIPv4 {
+			var addr *syscall.IPv6Mreq
+			addr, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+			if sockErr == nil {
+				port = int(binary.BigEndian.Uint16(addr.Multiaddr[2:4]))
+			}
+		} else {
+			var info *syscall.IPv6MTUInfo
+			info, sockErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, ip6tSoOriginalDst)
+			if sockErr == nil {
+				portBytes := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+				port = int(binary.BigEndian.Uint16(portBytes[:]))
+			}
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return port, sockErr
+}
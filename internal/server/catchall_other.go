@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package server
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+var errCatchAllUnsupported = errors.New("Catch-all listeners are only supported on Linux")
+
+func setTransparent(network string, address string, rawConn syscall.RawConn) error {
+	return errCatchAllUnsupported
+}
+
+func originalDestinationPort(conn *net.TCPConn) (int, error) {
+	return 0, errCatchAllUnsupported
+}
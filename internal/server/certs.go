@@ -0,0 +1,236 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultCertPath and DefaultKeyPath are used when no certificates are configured
+const DefaultCertPath = "honeypoke_cert.pem"
+const DefaultKeyPath = "honeypoke_key.pem"
+
+const defaultCertDays = 365
+
+// CertificatePair is the location of a certificate and its key
+type CertificatePair struct {
+	CertPath string
+	KeyPath  string
+}
+
+// CertificateSubject sets what generated self-signed certificates look like
+type CertificateSubject struct {
+	CommonName         string
+	Organization       string
+	OrganizationalUnit string
+	Country            string
+	Province           string
+	Locality           string
+	DNSNames           []string
+	Days               int
+}
+
+type namedCertificate struct {
+	cert  *tls.Certificate
+	names []string
+}
+
+// Certificates shared by every TLS listener, in the order they were configured
+var sharedCerts []namedCertificate
+
+var certSubject CertificateSubject
+
+// LoadCertificates loads the shared certificate set, generating self-signed certificates for any that don't exist
+func LoadCertificates(pairs []CertificatePair, subject CertificateSubject) error {
+	certSubject = subject
+
+	if len(pairs) == 0 {
+		pairs = []CertificatePair{{CertPath: DefaultCertPath, KeyPath: DefaultKeyPath}}
+	}
+
+	sharedCerts = make([]namedCertificate, 0, len(pairs))
+	for _, pair := range pairs {
+		named, err := loadCertificate(pair)
+		if err != nil {
+			return err
+		}
+		sharedCerts = append(sharedCerts, *named)
+	}
+
+	return nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// EnsureCertificate generates a self-signed certificate for a pair if neither of its files exist
+func EnsureCertificate(pair CertificatePair) error {
+	if !fileExists(pair.CertPath) && !fileExists(pair.KeyPath) {
+		log.Printf("Certificate %s not found, generating a self-signed certificate\n", pair.CertPath)
+		return generateCertificate(pair, certSubject)
+	}
+	return nil
+}
+
+func loadCertificate(pair CertificatePair) (*namedCertificate, error) {
+	err := EnsureCertificate(pair)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(pair.CertPath, pair.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	names := leaf.DNSNames
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = []string{leaf.Subject.CommonName}
+	}
+
+	return &namedCertificate{cert: &cert, names: names}, nil
+}
+
+func subjectList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return []string{value}
+}
+
+// generateCertificate creates a self-signed certificate and key with the given subject
+func generateCertificate(pair CertificatePair, subject CertificateSubject) error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	days := subject.Days
+	if days <= 0 {
+		days = defaultCertDays
+	}
+
+	commonName := subject.CommonName
+	if commonName == "" {
+		commonName, _ = os.Hostname()
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:         commonName,
+			Organization:       subjectList(subject.Organization),
+			OrganizationalUnit: subjectList(subject.OrganizationalUnit),
+			Country:            subjectList(subject.Country),
+			Province:           subjectList(subject.Province),
+			Locality:           subjectList(subject.Locality),
+		},
+		NotBefore:             time.Now().Add(-24 * time.Hour),
+		NotAfter:              time.Now().Add(time.Duration(days) * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	for _, name := range subject.DNSNames {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(pair.KeyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(pair.CertPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// matchesName checks a requested server name against a certificate name, which may be a wildcard
+func matchesName(serverName string, certName string) bool {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	certName = strings.ToLower(certName)
+
+	if serverName == certName {
+		return true
+	}
+	if strings.HasPrefix(certName, "*.") {
+		dot := strings.Index(serverName, ".")
+		return dot > 0 && serverName[dot:] == certName[1:]
+	}
+	return false
+}
+
+// newTLSConfig creates the TLS config for a listener. The listener's own certificate, if
+// it has one, is tried first, then the shared set. Certificates are picked by SNI, falling
+// back to the first one.
+func newTLSConfig(pair *CertificatePair) (*tls.Config, error) {
+	certs := make([]namedCertificate, 0, len(sharedCerts)+1)
+	if pair != nil {
+		named, err := loadCertificate(*pair)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, *named)
+	}
+	certs = append(certs, sharedCerts...)
+
+	if len(certs) == 0 {
+		return nil, errors.New("No certificates loaded")
+	}
+
+	config := &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "" {
+				for _, named := range certs {
+					for _, name := range named.names {
+						if matchesName(hello.ServerName, name) {
+							return named.cert, nil
+						}
+					}
+				}
+			}
+			return certs[0].cert, nil
+		},
+	}
+
+	return config, nil
+}
@@ -0,0 +1,173 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMatchesName(t *testing.T) {
+	tests := []struct {
+		serverName string
+		certName   string
+		expected   bool
+	}{
+		{"example.com", "example.com", true},
+		{"Example.COM.", "example.com", true},
+		{"www.example.com", "*.example.com", true},
+		{"WWW.example.com", "*.Example.com", true},
+		{"example.com", "*.example.com", false},
+		{"a.b.example.com", "*.example.com", false},
+		{".example.com", "*.example.com", false},
+		{"www.example.org", "*.example.com", false},
+		{"example.com", "example.org", false},
+	}
+	for _, test := range tests {
+		t.Run(test.serverName+"/"+test.certName, func(t *testing.T) {
+			if matches := matchesName(test.serverName, test.certName); matches != test.expected {
+				t.Errorf("Got %v, expected %v", matches, test.expected)
+			}
+		})
+	}
+}
+
+// testPair generates a certificate with the subject in dir
+func testPair(t *testing.T, dir string, name string, subject CertificateSubject) CertificatePair {
+	pair := CertificatePair{CertPath: filepath.Join(dir, name+"_cert.pem"), KeyPath: filepath.Join(dir, name+"_key.pem")}
+	certSubject = subject
+	if _, err := loadCertificate(pair); err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+func TestGenerateCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "honeypoke")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	subject := CertificateSubject{
+		CommonName:   "honeypoke.example.com",
+		Organization: "Example",
+		Country:      "US",
+		DNSNames:     []string{"honeypoke.example.com", "*.example.org", "192.0.2.10"},
+		Days:         30,
+	}
+	pair := testPair(t, dir, "test", subject)
+
+	cert, err := tls.LoadX509KeyPair(pair.CertPath, pair.KeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.Subject.CommonName != subject.CommonName || !reflect.DeepEqual(leaf.Subject.Organization, []string{"Example"}) {
+		t.Errorf("Got subject %s", leaf.Subject)
+	}
+	if len(leaf.Subject.Locality) != 0 {
+		t.Errorf("Got locality %v when none was set", leaf.Subject.Locality)
+	}
+	if !reflect.DeepEqual(leaf.DNSNames, []string{"honeypoke.example.com", "*.example.org"}) {
+		t.Errorf("Got DNS names %v", leaf.DNSNames)
+	}
+	if len(leaf.IPAddresses) != 1 || leaf.IPAddresses[0].String() != "192.0.2.10" {
+		t.Errorf("Got IP addresses %v", leaf.IPAddresses)
+	}
+	if days := leaf.NotAfter.Sub(time.Now()).Hours() / 24; days < 29 || days > 30 {
+		t.Errorf("Certificate is valid for %.1f more days, expected 30", days)
+	}
+
+	info, err := os.Stat(pair.KeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Key was written with mode %o", info.Mode().Perm())
+	}
+
+	// Existing certificates are loaded, not replaced
+	before, _ := ioutil.ReadFile(pair.CertPath)
+	named, err := loadCertificate(pair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, _ := ioutil.ReadFile(pair.CertPath)
+	if string(before) != string(after) {
+		t.Error("Existing certificate was regenerated")
+	}
+	if !reflect.DeepEqual(named.names, []string{"honeypoke.example.com", "*.example.org"}) {
+		t.Errorf("Got names %v", named.names)
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "honeypoke")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { sharedCerts = nil }()
+
+	// Without DNS names the common name is used
+	first := testPair(t, dir, "first", CertificateSubject{CommonName: "first.example.com"})
+	second := testPair(t, dir, "second", CertificateSubject{CommonName: "second", DNSNames: []string{"*.example.org"}})
+	own := testPair(t, dir, "own", CertificateSubject{CommonName: "own.example.net"})
+	if err := LoadCertificates([]CertificatePair{first, second}, CertificateSubject{}); err != nil {
+		t.Fatal(err)
+	}
+
+	commonName := func(cert *tls.Certificate) string {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+
+	tests := []struct {
+		name       string
+		pair       *CertificatePair
+		serverName string
+		expected   string
+	}{
+		{"no SNI", nil, "", "first.example.com"},
+		{"common name", nil, "first.example.com", "first.example.com"},
+		{"wildcard", nil, "www.example.org", "second"},
+		{"unknown name", nil, "www.example.net", "first.example.com"},
+		{"own certificate first", &own, "", "own.example.net"},
+		{"shared after own", &own, "www.example.org", "second"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := newTLSConfig(test.pair)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: test.serverName})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name := commonName(cert); name != test.expected {
+				t.Errorf("Got %s, expected %s", name, test.expected)
+			}
+		})
+	}
+
+	sharedCerts = nil
+	if _, err := newTLSConfig(nil); err == nil {
+		t.Error("No error without any certificates")
+	}
+}
@@ -0,0 +1,268 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const tlsRecordHeaderLen = 5
+
+// Biggest ClientHello we are willing to buffer, spread over as many records as needed
+const maxClientHelloSize = 16 * 1024
+
+const handshakeTypeClientHello = 0x01
+
+const (
+	extensionServerName          = 0x0000
+	extensionSupportedGroups     = 0x000a
+	extensionECPointFormats      = 0x000b
+	extensionSignatureAlgorithms = 0x000d
+	extensionALPN                = 0x0010
+	extensionSupportedVersions   = 0x002b
+)
+
+// clientHello holds the fields of a ClientHello used for fingerprinting, in the order the client sent them
+type clientHello struct {
+	version             uint16
+	ciphers             []uint16
+	extensions          []uint16
+	serverName          string
+	alpn                []string
+	supportedGroups     []uint16
+	pointFormats        []uint8
+	signatureAlgorithms []uint16
+	supportedVersions   []uint16
+}
+
+var errShortClientHello = errors.New("ClientHello is truncated")
+
+// readClientHello peeks the handshake message out of the TLS records at the start of
+// the connection, leaving everything in place for the real handshake
+func (p *peekConn) readClientHello() ([]byte, error) {
+	message := make([]byte, 0)
+	offset := 0
+
+	for {
+		header, err := p.reader.Peek(offset + tlsRecordHeaderLen)
+		if err != nil {
+			return nil, err
+		}
+		header = header[offset:]
+		if header[0] != tlsRecordHandshake {
+			return nil, errors.New("not a TLS handshake record")
+		}
+		recordLen := int(binary.BigEndian.Uint16(header[3:5]))
+		if offset+tlsRecordHeaderLen+recordLen > maxClientHelloSize {
+			return nil, errors.New("ClientHello is too large")
+		}
+
+		record, err := p.reader.Peek(offset + tlsRecordHeaderLen + recordLen)
+		if err != nil {
+			return nil, err
+		}
+		message = append(message, record[offset+tlsRecordHeaderLen:]...)
+		offset += tlsRecordHeaderLen + recordLen
+
+		// The handshake message may be split over several records
+		if len(message) >= 4 {
+			messageLen := int(message[1])<<16 | int(message[2])<<8 | int(message[3])
+			if len(message) >= 4+messageLen {
+				return message[:4+messageLen], nil
+			}
+		}
+	}
+}
+
+// helloReader walks through the length-prefixed fields of a handshake message
+type helloReader struct {
+	data []byte
+}
+
+func (r *helloReader) bytes(count int) ([]byte, error) {
+	if count > len(r.data) {
+		return nil, errShortClientHello
+	}
+	out := r.data[:count]
+	r.data = r.data[count:]
+	return out, nil
+}
+
+func (r *helloReader) uint8() (uint8, error) {
+	out, err := r.bytes(1)
+	if err != nil {
+		return 0, err
+	}
+	return out[0], nil
+}
+
+func (r *helloReader) uint16() (uint16, error) {
+	out, err := r.bytes(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(out), nil
+}
+
+// vector reads a field prefixed with a length of lengthSize bytes
+func (r *helloReader) vector(lengthSize int) (*helloReader, error) {
+	var length int
+	if lengthSize == 1 {
+		value, err := r.uint8()
+		if err != nil {
+			return nil, err
+		}
+		length = int(value)
+	} else {
+		value, err := r.uint16()
+		if err != nil {
+			return nil, err
+		}
+		length = int(value)
+	}
+	out, err := r.bytes(length)
+	if err != nil {
+		return nil, err
+	}
+	return &helloReader{data: out}, nil
+}
+
+func (r *helloReader) uint16List() ([]uint16, error) {
+	list := make([]uint16, 0)
+	for len(r.data) > 0 {
+		value, err := r.uint16()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, value)
+	}
+	return list, nil
+}
+
+// parseClientHello parses a ClientHello handshake message
+func parseClientHello(message []byte) (*clientHello, error) {
+	reader := &helloReader{data: message}
+
+	msgType, err := reader.uint8()
+	if err != nil {
+		return nil, err
+	}
+	if msgType != handshakeTypeClientHello {
+		return nil, errors.New("handshake message is not a ClientHello")
+	}
+	// Skip the message length, readClientHello already trimmed the message
+	if _, err = reader.bytes(3); err != nil {
+		return nil, err
+	}
+
+	hello := new(clientHello)
+	if hello.version, err = reader.uint16(); err != nil {
+		return nil, err
+	}
+	// Random
+	if _, err = reader.bytes(32); err != nil {
+		return nil, err
+	}
+	// Session ID
+	if _, err = reader.vector(1); err != nil {
+		return nil, err
+	}
+	ciphers, err := reader.vector(2)
+	if err != nil {
+		return nil, err
+	}
+	if hello.ciphers, err = ciphers.uint16List(); err != nil {
+		return nil, err
+	}
+	// Compression methods
+	if _, err = reader.vector(1); err != nil {
+		return nil, err
+	}
+
+	// Very old clients don't send extensions at all
+	if len(reader.data) == 0 {
+		return hello, nil
+	}
+
+	extensions, err := reader.vector(2)
+	if err != nil {
+		return nil, err
+	}
+
+	for len(extensions.data) > 0 {
+		extType, err := extensions.uint16()
+		if err != nil {
+			return nil, err
+		}
+		extData, err := extensions.vector(2)
+		if err != nil {
+			return nil, err
+		}
+		hello.extensions = append(hello.extensions, extType)
+
+		// Extensions we can't parse are still counted for the fingerprint
+		switch extType {
+		case extensionServerName:
+			hello.parseServerName(extData)
+		case extensionALPN:
+			hello.parseALPN(extData)
+		case extensionSupportedGroups:
+			if list, err := extData.vector(2); err == nil {
+				hello.supportedGroups, _ = list.uint16List()
+			}
+		case extensionECPointFormats:
+			if list, err := extData.vector(1); err == nil {
+				hello.pointFormats = append([]uint8{}, list.data...)
+			}
+		case extensionSignatureAlgorithms:
+			if list, err := extData.vector(2); err == nil {
+				hello.signatureAlgorithms, _ = list.uint16List()
+			}
+		case extensionSupportedVersions:
+			if list, err := extData.vector(1); err == nil {
+				hello.supportedVersions, _ = list.uint16List()
+			}
+		}
+	}
+
+	return hello, nil
+}
+
+func (hello *clientHello) parseServerName(extData *helloReader) {
+	list, err := extData.vector(2)
+	if err != nil {
+		return
+	}
+	for len(list.data) > 0 {
+		nameType, err := list.uint8()
+		if err != nil {
+			return
+		}
+		name, err := list.vector(2)
+		if err != nil {
+			return
+		}
+		// Type 0 is a host name, the only one defined
+		if nameType == 0 {
+			hello.serverName = string(name.data)
+			return
+		}
+	}
+}
+
+func (hello *clientHello) parseALPN(extData *helloReader) {
+	list, err := extData.vector(2)
+	if err != nil {
+		return
+	}
+	for len(list.data) > 0 {
+		proto, err := list.vector(1)
+		if err != nil {
+			return
+		}
+		hello.alpn = append(hello.alpn, string(proto.data))
+	}
+}
@@ -0,0 +1,180 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package server
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func appendUint16(out []byte, value uint16) []byte {
+	return append(out, byte(value>>8), byte(value))
+}
+
+// prefixed puts a length of lengthSize bytes in front of data
+func prefixed(lengthSize int, data []byte) []byte {
+	out := make([]byte, 0, lengthSize+len(data))
+	if lengthSize == 1 {
+		out = append(out, byte(len(data)))
+	} else {
+		out = appendUint16(out, uint16(len(data)))
+	}
+	return append(out, data...)
+}
+
+func uint16Bytes(values ...uint16) []byte {
+	out := make([]byte, 0, 2*len(values))
+	for _, value := range values {
+		out = appendUint16(out, value)
+	}
+	return out
+}
+
+type testExtension struct {
+	extType uint16
+	data    []byte
+}
+
+// buildClientHello makes a ClientHello handshake message, without extensions if there are none
+func buildClientHello(version uint16, ciphers []uint16, extensions []testExtension) []byte {
+	body := appendUint16(nil, version)
+	body = append(body, make([]byte, 32)...)
+	body = append(body, prefixed(1, []byte{1, 2, 3, 4})...)
+	body = append(body, prefixed(2, uint16Bytes(ciphers...))...)
+	body = append(body, prefixed(1, []byte{0})...)
+	if len(extensions) > 0 {
+		extensionData := make([]byte, 0)
+		for _, extension := range extensions {
+			extensionData = appendUint16(extensionData, extension.extType)
+			extensionData = append(extensionData, prefixed(2, extension.data)...)
+		}
+		body = append(body, prefixed(2, extensionData)...)
+	}
+
+	message := []byte{handshakeTypeClientHello, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	return append(message, body...)
+}
+
+// tlsRecords splits a handshake message into records of at most size bytes
+func tlsRecords(message []byte, size int) []byte {
+	out := make([]byte, 0)
+	for len(message) > 0 {
+		chunk := message
+		if len(chunk) > size {
+			chunk = chunk[:size]
+		}
+		message = message[len(chunk):]
+		out = append(out, tlsRecordHandshake, tlsMajorVersion, 0x01)
+		out = append(out, prefixed(2, chunk)...)
+	}
+	return out
+}
+
+// A browser-like ClientHello, with GREASE values mixed in
+func testClientHello() []byte {
+	serverName := append([]byte{0}, prefixed(2, []byte("example.com"))...)
+	alpn := append(prefixed(1, []byte("h2")), prefixed(1, []byte("http/1.1"))...)
+	return buildClientHello(0x0303, []uint16{0x0a0a, 0x1301, 0x1302, 0xc02b, 0x002f}, []testExtension{
+		{0x1a1a, nil},
+		{extensionServerName, prefixed(2, serverName)},
+		{extensionSupportedGroups, prefixed(2, uint16Bytes(0x2a2a, 0x001d, 0x0017))},
+		{extensionECPointFormats, prefixed(1, []byte{0})},
+		{extensionSignatureAlgorithms, prefixed(2, uint16Bytes(0x0403, 0x0804, 0x0401))},
+		{extensionALPN, prefixed(2, alpn)},
+		{extensionSupportedVersions, prefixed(1, uint16Bytes(0x3a3a, 0x0304, 0x0303))},
+		{0xff01, []byte{0}},
+	})
+}
+
+// An old client that sends no extensions at all
+func testOldClientHello() []byte {
+	return buildClientHello(0x0301, []uint16{0x0035}, nil)
+}
+
+func TestParseClientHello(t *testing.T) {
+	hello, err := parseClientHello(testClientHello())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &clientHello{
+		version:             0x0303,
+		ciphers:             []uint16{0x0a0a, 0x1301, 0x1302, 0xc02b, 0x002f},
+		extensions:          []uint16{0x1a1a, 0x0000, 0x000a, 0x000b, 0x000d, 0x0010, 0x002b, 0xff01},
+		serverName:          "example.com",
+		alpn:                []string{"h2", "http/1.1"},
+		supportedGroups:     []uint16{0x2a2a, 0x001d, 0x0017},
+		pointFormats:        []uint8{0},
+		signatureAlgorithms: []uint16{0x0403, 0x0804, 0x0401},
+		supportedVersions:   []uint16{0x3a3a, 0x0304, 0x0303},
+	}
+	if !reflect.DeepEqual(hello, expected) {
+		t.Errorf("Got %+v, expected %+v", hello, expected)
+	}
+
+	hello, err = parseClientHello(testOldClientHello())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.version != 0x0301 || !reflect.DeepEqual(hello.ciphers, []uint16{0x0035}) || hello.extensions != nil {
+		t.Errorf("Got %+v for a ClientHello without extensions", hello)
+	}
+}
+
+func TestParseBadClientHello(t *testing.T) {
+	full := testClientHello()
+	serverHello := append([]byte{}, full...)
+	serverHello[0] = 0x02
+	// An extension claiming to be longer than what's left
+	badExtension := buildClientHello(0x0303, []uint16{0x1301}, []testExtension{{0x0000, []byte{0, 9}}})
+	badExtension[len(badExtension)-4] = 0xff
+
+	tests := []struct {
+		name    string
+		message []byte
+	}{
+		{"empty", []byte{}},
+		{"not a ClientHello", serverHello},
+		{"no random", full[:20]},
+		{"cut off in the ciphers", full[:44]},
+		{"cut off in the extensions", full[:len(full)-1]},
+		{"bad extension length", badExtension},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := parseClientHello(test.message); err == nil {
+				t.Error("No error")
+			}
+		})
+	}
+}
+
+func TestReadClientHello(t *testing.T) {
+	message := testClientHello()
+	tests := []struct {
+		name    string
+		records []byte
+		valid   bool
+	}{
+		{"one record", tlsRecords(message, 16384), true},
+		{"split over records", tlsRecords(message, 40), true},
+		{"followed by more data", append(tlsRecords(message, 16384), tlsRecords([]byte{0x10, 0, 0, 0}, 100)...), true},
+		{"truncated", tlsRecords(message, 16384)[:50], false},
+		{"not a handshake", []byte("GET / HTTP/1.1\r\n\r\n"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := newPeekConn(&replayConn{reader: bytes.NewReader(test.records), local: &net.TCPAddr{}, remote: &net.TCPAddr{}})
+			read, err := conn.readClientHello()
+			if (err == nil) != test.valid {
+				t.Fatalf("Got error %v, expected valid to be %v", err, test.valid)
+			}
+			if test.valid && !bytes.Equal(read, message) {
+				t.Errorf("Got %x, expected %x", read, message)
+			}
+		})
+	}
+}
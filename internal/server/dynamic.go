@@ -0,0 +1,86 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/bocajspear1/honeypoke-go/internal/recorder"
+)
+
+// startListener opens a listener after permissions have been dropped, using the bind
+// helper for privileged ports if it's running
+func startListener(config ListenerConfig, recChan chan *recorder.HoneypokeRecord) error {
+	if active.isClosing() {
+		return errShuttingDown
+	}
+
+	if config.Protocol == layers.LayerTypeTCP {
+		var tlsConfig *tls.Config
+		if config.TLSMode != TLSOff {
+			var err error
+			tlsConfig, err = newTLSConfig(config.Cert)
+			if err != nil {
+				return err
+			}
+		}
+
+		listener, err := listenTCP(config.address())
+		if err != nil {
+			return err
+		}
+		go serveTCP(listener, config, tlsConfig, recChan)
+	} else if config.Protocol == layers.LayerTypeUDP {
+		udpList, err := listenUDP(config.address())
+		if err != nil {
+			return err
+		}
+		go serveUDP(udpList, config, recChan)
+	} else {
+		return errors.New("Invalid protocol for listener")
+	}
+	return nil
+}
+
+// StartDynamicServer opens a listener while HoneyPoke is running, after permissions have
+// been dropped, and sends a record announcing it
+func StartDynamicServer(config ListenerConfig, reason string, recChan chan *recorder.HoneypokeRecord) error {
+	err := startListener(config, recChan)
+	if err != nil {
+		return err
+	}
+
+	record := recorder.NewRecord("", 0)
+	record.Kind = recorder.KindNewListener
+	record.Port = config.Port
+	record.Input = reason
+	if config.Protocol == layers.LayerTypeTCP {
+		record.Protocol = "tcp"
+		record.UseSSL = config.TLSMode != TLSOff
+	} else {
+		record.Protocol = "udp"
+	}
+
+	log.Printf("Opened dynamic %s listener on port %d: %s\n", record.Protocol, config.Port, reason)
+	recChan <- record
+
+	return nil
+}
+
+// AddListener opens a configured listener while HoneyPoke is running, like when the
+// config is reloaded
+func AddListener(config ListenerConfig, recChan chan *recorder.HoneypokeRecord) error {
+	return startListener(config, recChan)
+}
+
+// StopListener closes a listener opened from config, connections it already accepted
+// carry on. Returns if there was one.
+func StopListener(config ListenerConfig) bool {
+	return active.stopListener(config.String())
+}
@@ -0,0 +1,185 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package server
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bocajspear1/honeypoke-go/internal/recorder"
+)
+
+// isGREASE checks for the reserved values from RFC 8701, which are left out of fingerprints
+func isGREASE(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	out := make([]uint16, 0, len(values))
+	for _, value := range values {
+		if !isGREASE(value) {
+			out = append(out, value)
+		}
+	}
+	return out
+}
+
+func joinDecimal(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = strconv.Itoa(int(value))
+	}
+	return strings.Join(parts, "-")
+}
+
+func joinHex(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = fmt.Sprintf("%04x", value)
+	}
+	return strings.Join(parts, ",")
+}
+
+// ja3 builds the JA3 string for a ClientHello, https://github.com/salesforce/ja3
+func (hello *clientHello) ja3() string {
+	formats := make([]uint16, len(hello.pointFormats))
+	for i, format := range hello.pointFormats {
+		formats[i] = uint16(format)
+	}
+
+	return strings.Join([]string{
+		strconv.Itoa(int(hello.version)),
+		joinDecimal(withoutGREASE(hello.ciphers)),
+		joinDecimal(withoutGREASE(hello.extensions)),
+		joinDecimal(withoutGREASE(hello.supportedGroups)),
+		joinDecimal(formats),
+	}, ",")
+}
+
+func ja4Version(version uint16) string {
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	case 0xfeff:
+		return "d1"
+	case 0xfefd:
+		return "d2"
+	case 0xfefc:
+		return "d3"
+	}
+	return "00"
+}
+
+func isAlphanumeric(value byte) bool {
+	return (value >= '0' && value <= '9') || (value >= 'a' && value <= 'z') || (value >= 'A' && value <= 'Z')
+}
+
+func ja4ALPN(alpn []string) string {
+	if len(alpn) == 0 || len(alpn[0]) == 0 {
+		return "00"
+	}
+	first := alpn[0]
+	if !isAlphanumeric(first[0]) || !isAlphanumeric(first[len(first)-1]) {
+		encoded := hex.EncodeToString([]byte(first))
+		return string(encoded[0]) + string(encoded[len(encoded)-1])
+	}
+	return string(first[0]) + string(first[len(first)-1])
+}
+
+func ja4Hash(value string) string {
+	if value == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func sortedCopy(values []uint16) []uint16 {
+	out := append([]uint16{}, values...)
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// ja4 builds the JA4 fingerprint for a ClientHello received over TCP, https://github.com/FoxIO-LLC/ja4
+func (hello *clientHello) ja4() string {
+	// TLS 1.3 clients put their real versions in the supported_versions extension
+	version := hello.version
+	supported := withoutGREASE(hello.supportedVersions)
+	if len(supported) > 0 {
+		version = sortedCopy(supported)[len(supported)-1]
+	}
+
+	sni := "i"
+	if hello.serverName != "" {
+		sni = "d"
+	}
+
+	ciphers := withoutGREASE(hello.ciphers)
+	extensions := withoutGREASE(hello.extensions)
+
+	partA := fmt.Sprintf("t%s%s%02d%02d%s", ja4Version(version), sni, minInt(len(ciphers), 99), minInt(len(extensions), 99), ja4ALPN(hello.alpn))
+
+	partB := ja4Hash(joinHex(sortedCopy(ciphers)))
+
+	// SNI and ALPN are already covered in the first part
+	hashedExtensions := make([]uint16, 0, len(extensions))
+	for _, ext := range extensions {
+		if ext != extensionServerName && ext != extensionALPN {
+			hashedExtensions = append(hashedExtensions, ext)
+		}
+	}
+	extensionString := joinHex(sortedCopy(hashedExtensions))
+	if len(hello.signatureAlgorithms) > 0 {
+		extensionString += "_" + joinHex(withoutGREASE(hello.signatureAlgorithms))
+	}
+	partC := ja4Hash(extensionString)
+	if len(hashedExtensions) == 0 {
+		partC = "000000000000"
+	}
+
+	return partA + "_" + partB + "_" + partC
+}
+
+// tlsInfo turns a ClientHello into the information stored on a record
+func (hello *clientHello) tlsInfo() *recorder.TLSInfo {
+	info := new(recorder.TLSInfo)
+	info.SNI = hello.serverName
+	info.ALPN = hello.alpn
+	info.Version = hello.version
+	info.SupportedVersions = hello.supportedVersions
+	info.Ciphers = hello.ciphers
+	info.Extensions = hello.extensions
+	info.SupportedGroups = hello.supportedGroups
+	info.SignatureAlgorithms = hello.signatureAlgorithms
+
+	info.JA3 = hello.ja3()
+	ja3Sum := md5.Sum([]byte(info.JA3))
+	info.JA3Hash = hex.EncodeToString(ja3Sum[:])
+	info.JA4 = hello.ja4()
+
+	return info
+}
@@ -0,0 +1,119 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package server
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestIsGREASE(t *testing.T) {
+	tests := map[uint16]bool{
+		0x0a0a: true,
+		0x1a1a: true,
+		0xfafa: true,
+		0x0a1a: false,
+		0x1301: false,
+		0x0000: false,
+		0x0a0b: false,
+	}
+	for value, expected := range tests {
+		if isGREASE(value) != expected {
+			t.Errorf("isGREASE(%04x) should be %v", value, expected)
+		}
+	}
+}
+
+func TestJA4Version(t *testing.T) {
+	tests := map[uint16]string{
+		0x0304: "13",
+		0x0303: "12",
+		0x0301: "10",
+		0x0300: "s3",
+		0xfefd: "d2",
+		0x1234: "00",
+	}
+	for version, expected := range tests {
+		if got := ja4Version(version); got != expected {
+			t.Errorf("ja4Version(%04x) gave %s, expected %s", version, got, expected)
+		}
+	}
+}
+
+func TestJA4ALPN(t *testing.T) {
+	tests := []struct {
+		alpn     []string
+		expected string
+	}{
+		{nil, "00"},
+		{[]string{""}, "00"},
+		{[]string{"h2", "http/1.1"}, "h2"},
+		{[]string{"http/1.1"}, "h1"},
+		{[]string{"x"}, "xx"},
+		// Not alphanumeric at the ends, so the first and last hex digits are used
+		{[]string{"\xabh2\xcd"}, "ad"},
+	}
+	for _, test := range tests {
+		if got := ja4ALPN(test.alpn); got != test.expected {
+			t.Errorf("ja4ALPN(%q) gave %s, expected %s", test.alpn, got, test.expected)
+		}
+	}
+}
+
+func TestFingerprints(t *testing.T) {
+	tests := []struct {
+		name    string
+		message []byte
+		ja3     string
+		ja3Hash string
+		ja4     string
+	}{
+		{
+			"browser",
+			testClientHello(),
+			"771,4865-4866-49195-47,0-10-11-13-16-43-65281,29-23,0",
+			"ffafad555af9ff8a660b19f64c3b1d5b",
+			"t13d0407h2_52f89ac5ce33_3fb681c9c60b",
+		},
+		{
+			"no extensions",
+			testOldClientHello(),
+			"769,53,,,",
+			"851235d5e9d490f3e2b43db94ac71961",
+			"t10i010000_692296a295db_000000000000",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hello, err := parseClientHello(test.message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info := hello.tlsInfo()
+			if info.JA3 != test.ja3 {
+				t.Errorf("Got JA3 %s, expected %s", info.JA3, test.ja3)
+			}
+			if info.JA3Hash != test.ja3Hash {
+				t.Errorf("Got JA3 hash %s, expected %s", info.JA3Hash, test.ja3Hash)
+			}
+			if info.JA4 != test.ja4 {
+				t.Errorf("Got JA4 %s, expected %s", info.JA4, test.ja4)
+			}
+		})
+	}
+}
+
+func TestJA4Counts(t *testing.T) {
+	// Counts top out at 99
+	ciphers := make([]uint16, 0, 120)
+	for i := 0; i < 120; i++ {
+		ciphers = append(ciphers, uint16(0x1000+i))
+	}
+	hello := &clientHello{version: 0x0303, ciphers: ciphers}
+	expected := fmt.Sprintf("t12i990000_%s_000000000000", ja4Hash(joinHex(ciphers)))
+	if got := hello.ja4(); got != expected {
+		t.Errorf("Got %s, expected %s", got, expected)
+	}
+}
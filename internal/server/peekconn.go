@@ -0,0 +1,47 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package server
+
+import (
+	"bufio"
+	"net"
+	"time"
+)
+
+// TLS record content type for a handshake and the major version every TLS/SSLv3 version uses
+const tlsRecordHandshake = 0x16
+const tlsMajorVersion = 0x03
+
+// How long a client gets to start a handshake before it's treated as plaintext. Clients
+// that wait for a banner never send anything first.
+const tlsDetectTimeout = 3 * time.Second
+
+// peekConn lets us look at the start of a connection without consuming it
+type peekConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func newPeekConn(conn net.Conn) *peekConn {
+	return &peekConn{
+		Conn:   conn,
+		reader: bufio.NewReaderSize(conn, maxClientHelloSize),
+	}
+}
+
+func (p *peekConn) Read(b []byte) (int, error) {
+	return p.reader.Read(b)
+}
+
+// looksLikeTLS checks if the connection starts with a TLS handshake record
+func (p *peekConn) looksLikeTLS() bool {
+	p.Conn.SetReadDeadline(time.Now().Add(tlsDetectTimeout))
+	start, err := p.reader.Peek(3)
+	p.Conn.SetReadDeadline(time.Time{})
+	if err != nil || len(start) < 3 {
+		return false
+	}
+	return start[0] == tlsRecordHandshake && start[1] == tlsMajorVersion
+}
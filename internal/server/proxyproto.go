@@ -0,0 +1,164 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long a proxy gets to send its header
+const proxyHeaderTimeout = 5 * time.Second
+
+// Longest v1 header, including the CRLF
+const maxProxyV1Len = 107
+
+const proxyV2HeaderLen = 16
+
+var proxyV1Prefix = []byte("PROXY ")
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// v2 commands and address families
+const (
+	proxyV2Local = 0x20
+	proxyV2Proxy = 0x21
+	proxyV2TCP4  = 0x11
+	proxyV2TCP6  = 0x21
+)
+
+// proxyHeader is what came of reading the PROXY protocol header of a connection
+type proxyHeader struct {
+	// The proxy, which is who actually connected to us
+	proxy net.Addr
+	// Why the header couldn't be used, in which case the proxy's address is used for the client
+	err error
+}
+
+// proxyConn reports the client from the PROXY protocol header as the remote address
+type proxyConn struct {
+	net.Conn
+	client net.Addr
+}
+
+func (p *proxyConn) RemoteAddr() net.Addr {
+	return p.client
+}
+
+// readProxyHeader reads the PROXY protocol header at the start of a connection, v1 or v2.
+// If it's missing or bad, nothing is consumed, so whatever was sent is still recorded.
+func readProxyHeader(conn net.Conn) (net.Conn, *proxyHeader) {
+	header := &proxyHeader{proxy: conn.RemoteAddr()}
+	peeked := newPeekConn(conn)
+
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	client, length, err := parseProxyHeader(peeked)
+	conn.SetReadDeadline(time.Time{})
+
+	if err != nil {
+		header.err = err
+		return peeked, header
+	}
+	peeked.reader.Discard(length)
+	if client == nil {
+		// LOCAL and UNKNOWN headers are for the proxy's own connections, like health checks
+		return peeked, header
+	}
+	return &proxyConn{Conn: peeked, client: client}, header
+}
+
+func parseProxyHeader(peeked *peekConn) (net.Addr, int, error) {
+	start, err := peeked.reader.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, 0, errors.New("No PROXY protocol header")
+	}
+	if bytes.Equal(start, proxyV1Prefix) {
+		return parseProxyV1(peeked)
+	} else if bytes.HasPrefix(proxyV2Signature, start) {
+		return parseProxyV2(peeked)
+	}
+	return nil, 0, errors.New("No PROXY protocol header")
+}
+
+// parseProxyV1 reads a text header like "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"
+func parseProxyV1(peeked *peekConn) (net.Addr, int, error) {
+	var line []byte
+	for length := len(proxyV1Prefix) + 1; length <= maxProxyV1Len; length++ {
+		start, err := peeked.reader.Peek(length)
+		if err != nil {
+			return nil, 0, errors.New("PROXY v1 header is truncated")
+		}
+		if start[length-1] == '\n' {
+			line = start
+			break
+		}
+	}
+	if line == nil || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, 0, errors.New("PROXY v1 header is too long")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, len(line), nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, 0, errors.New("Invalid PROXY v1 header")
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, 0, errors.New("Invalid PROXY v1 source address")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, len(line), nil
+}
+
+// parseProxyV2 reads a binary header, skipping any TLVs after the addresses
+func parseProxyV2(peeked *peekConn) (net.Addr, int, error) {
+	header, err := peeked.reader.Peek(proxyV2HeaderLen)
+	if err != nil || !bytes.Equal(header[:len(proxyV2Signature)], proxyV2Signature) {
+		return nil, 0, errors.New("Invalid PROXY v2 signature")
+	}
+
+	command := header[12]
+	family := header[13]
+	length := proxyV2HeaderLen + int(binary.BigEndian.Uint16(header[14:16]))
+	if length > maxClientHelloSize {
+		return nil, 0, errors.New("PROXY v2 header is too long")
+	}
+
+	full, err := peeked.reader.Peek(length)
+	if err != nil {
+		return nil, 0, errors.New("PROXY v2 header is truncated")
+	}
+	addresses := full[proxyV2HeaderLen:]
+
+	if command == proxyV2Local {
+		return nil, length, nil
+	} else if command != proxyV2Proxy {
+		return nil, 0, errors.New("Invalid PROXY v2 command")
+	}
+
+	switch family {
+	case proxyV2TCP4:
+		if len(addresses) < 12 {
+			return nil, 0, errors.New("PROXY v2 addresses are truncated")
+		}
+		ip := net.IP(append([]byte{}, addresses[0:4]...))
+		return &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(addresses[8:10]))}, length, nil
+	case proxyV2TCP6:
+		if len(addresses) < 36 {
+			return nil, 0, errors.New("PROXY v2 addresses are truncated")
+		}
+		ip := net.IP(append([]byte{}, addresses[0:16]...))
+		return &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(addresses[32:34]))}, length, nil
+	}
+	// UDP and unix sockets aren't ours to record
+	return nil, length, nil
+}
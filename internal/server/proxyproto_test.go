@@ -0,0 +1,116 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func testConn(data []byte) *replayConn {
+	return &replayConn{
+		reader: bytes.NewReader(data),
+		local:  &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 80},
+		remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 50000},
+	}
+}
+
+// proxyV2 makes a v2 header with the command and family, followed by addresses
+func proxyV2(command byte, family byte, addresses []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, command, family)
+	return append(header, prefixed(2, addresses)...)
+}
+
+func TestParseProxyHeader(t *testing.T) {
+	tcp4 := []byte{198, 51, 100, 7, 192, 0, 2, 10, 0x9c, 0x40, 0, 80}
+	tcp6 := append(append(net.ParseIP("2001:db8::7").To16(), net.ParseIP("2001:db8::10").To16()...), 0x9c, 0x40, 0, 80)
+	tlv := []byte{0x04, 0x00, 0x02, 0xab, 0xcd}
+
+	tests := []struct {
+		name   string
+		header []byte
+		client string
+		length int
+		valid  bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 198.51.100.7 192.0.2.10 40000 80\r\n"), "198.51.100.7:40000", 45, true},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::7 2001:db8::10 40000 80\r\n"), "[2001:db8::7]:40000", 46, true},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", 15, true},
+		{"v1 unknown with addresses", []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"), "", 35, true},
+		{"v1 bad protocol", []byte("PROXY UDP4 198.51.100.7 192.0.2.10 40000 80\r\n"), "", 0, false},
+		{"v1 bad address", []byte("PROXY TCP4 198.51.100 192.0.2.10 40000 80\r\n"), "", 0, false},
+		{"v1 bad port", []byte("PROXY TCP4 198.51.100.7 192.0.2.10 70000 80\r\n"), "", 0, false},
+		{"v1 missing fields", []byte("PROXY TCP4 198.51.100.7\r\n"), "", 0, false},
+		{"v1 no CR", []byte("PROXY TCP4 198.51.100.7 192.0.2.10 40000 80\n"), "", 0, false},
+		{"v1 truncated", []byte("PROXY TCP4 198.51.100.7"), "", 0, false},
+		{"v1 too long", append([]byte("PROXY "), bytes.Repeat([]byte("A"), 200)...), "", 0, false},
+		{"v2 tcp4", proxyV2(proxyV2Proxy, proxyV2TCP4, tcp4), "198.51.100.7:40000", 28, true},
+		{"v2 tcp4 with TLVs", proxyV2(proxyV2Proxy, proxyV2TCP4, append(tcp4, tlv...)), "198.51.100.7:40000", 33, true},
+		{"v2 tcp6", proxyV2(proxyV2Proxy, proxyV2TCP6, tcp6), "[2001:db8::7]:40000", 52, true},
+		{"v2 local", proxyV2(proxyV2Local, 0x00, nil), "", 16, true},
+		{"v2 udp", proxyV2(proxyV2Proxy, 0x12, tcp4), "", 28, true},
+		{"v2 bad command", proxyV2(0x22, proxyV2TCP4, tcp4), "", 0, false},
+		{"v2 short addresses", proxyV2(proxyV2Proxy, proxyV2TCP4, tcp4[:8]), "", 0, false},
+		{"v2 truncated", proxyV2(proxyV2Proxy, proxyV2TCP4, tcp4)[:20], "", 0, false},
+		{"v2 bad signature", append([]byte("\r\n\r\n\x00\r\nQUIX\n"), 0x21, 0x11, 0, 0), "", 0, false},
+		{"no header", []byte("GET / HTTP/1.1\r\n\r\n"), "", 0, false},
+		{"too short", []byte("PRO"), "", 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, length, err := parseProxyHeader(newPeekConn(testConn(test.header)))
+			if (err == nil) != test.valid {
+				t.Fatalf("Got error %v, expected valid to be %v", err, test.valid)
+			}
+			clientString := ""
+			if client != nil {
+				clientString = client.String()
+			}
+			if clientString != test.client || length != test.length {
+				t.Errorf("Got client %q and length %d, expected %q and %d", clientString, length, test.client, test.length)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		client string
+		input  string
+		err    bool
+	}{
+		{"v1", "PROXY TCP4 198.51.100.7 192.0.2.10 40000 80\r\nGET / HTTP/1.1\r\n", "198.51.100.7:40000", "GET / HTTP/1.1\r\n", false},
+		{"v2", string(proxyV2(proxyV2Proxy, proxyV2TCP4, []byte{198, 51, 100, 7, 192, 0, 2, 10, 0x9c, 0x40, 0, 80})) + "SSH-2.0-x\r\n", "198.51.100.7:40000", "SSH-2.0-x\r\n", false},
+		{"local", string(proxyV2(proxyV2Local, 0x00, nil)) + "ping", "192.0.2.1:50000", "ping", false},
+		// Nothing is consumed, so the scanner's input is still recorded
+		{"missing", "GET / HTTP/1.1\r\n", "192.0.2.1:50000", "GET / HTTP/1.1\r\n", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, header := readProxyHeader(testConn([]byte(test.data)))
+			if (header.err != nil) != test.err {
+				t.Errorf("Got error %v, expected an error to be %v", header.err, test.err)
+			}
+			if header.proxy.String() != "192.0.2.1:50000" {
+				t.Errorf("Got proxy %s", header.proxy)
+			}
+			if conn.RemoteAddr().String() != test.client {
+				t.Errorf("Got client %s, expected %s", conn.RemoteAddr(), test.client)
+			}
+			input, err := ioutil.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(input) != test.input {
+				t.Errorf("Got input %q, expected %q", input, test.input)
+			}
+		})
+	}
+}
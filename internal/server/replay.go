@@ -0,0 +1,105 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/bocajspear1/honeypoke-go/internal/recorder"
+)
+
+// replayConn plays back what a client sent in a capture. Anything written to it is dropped.
+type replayConn struct {
+	reader *bytes.Reader
+	local  net.Addr
+	remote net.Addr
+}
+
+func (r *replayConn) Read(b []byte) (int, error)         { return r.reader.Read(b) }
+func (r *replayConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (r *replayConn) Close() error                       { return nil }
+func (r *replayConn) LocalAddr() net.Addr                { return r.local }
+func (r *replayConn) RemoteAddr() net.Addr               { return r.remote }
+func (r *replayConn) SetDeadline(t time.Time) error      { return nil }
+func (r *replayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (r *replayConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type replayListener struct {
+	tag           listenerTag
+	proxyProtocol bool
+	tlsMode       TLSMode
+	tlsConfig     *tls.Config
+}
+
+// Replayer passes TCP streams from a capture to the same handlers the listeners use.
+// TLS handshakes can't finish without the client, but the ClientHello is still fingerprinted.
+type Replayer struct {
+	listeners map[uint16]replayListener
+	recChan   chan *recorder.HoneypokeRecord
+}
+
+// NewReplayer sets up replaying for the given TCP listeners
+func NewReplayer(configs []ListenerConfig, recChan chan *recorder.HoneypokeRecord) (*Replayer, error) {
+	replayer := &Replayer{
+		listeners: make(map[uint16]replayListener),
+		recChan:   recChan,
+	}
+	for _, config := range configs {
+		if config.Protocol != layers.LayerTypeTCP {
+			continue
+		}
+		// Replays don't know which of our addresses was hit, so with the same port on
+		// more than one address, the first listener is used
+		if _, ok := replayer.listeners[uint16(config.Port)]; ok {
+			continue
+		}
+		listener := replayListener{tag: config.tag(), proxyProtocol: config.ProxyProtocol, tlsMode: config.TLSMode}
+		if config.TLSMode != TLSOff {
+			tlsConfig, err := newTLSConfig(config.Cert)
+			if err != nil {
+				return nil, err
+			}
+			listener.tlsConfig = tlsConfig
+		}
+		replayer.listeners[uint16(config.Port)] = listener
+	}
+	return replayer, nil
+}
+
+// Ports lists the ports there are listeners for
+func (r *Replayer) Ports() []uint16 {
+	ports := make([]uint16, 0, len(r.listeners))
+	for port := range r.listeners {
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+// Stream runs a captured client stream through the handler for its port, with the record
+// timed from the capture
+func (r *Replayer) Stream(port uint16, source string, sourcePort uint16, data []byte, started time.Time) {
+	listener, ok := r.listeners[port]
+	if !ok {
+		return
+	}
+
+	conn := &replayConn{
+		reader: bytes.NewReader(data),
+		local:  &net.TCPAddr{Port: int(port)},
+		remote: &net.TCPAddr{IP: net.ParseIP(source), Port: int(sourcePort)},
+	}
+
+	// The handler sends exactly one record
+	records := make(chan *recorder.HoneypokeRecord, 1)
+	tcpAccept(int(port), listener.tag, listener.proxyProtocol, listener.tlsMode, listener.tlsConfig, conn, records)
+	record := <-records
+	record.Time = started.UTC().Format("2006-01-02T15:04:05-0700")
+	r.recChan <- record
+}
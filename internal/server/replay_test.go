@@ -0,0 +1,105 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/bocajspear1/honeypoke-go/internal/recorder"
+)
+
+func TestReplayerStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "honeypoke")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert := &CertificatePair{CertPath: filepath.Join(dir, "cert.pem"), KeyPath: filepath.Join(dir, "key.pem")}
+	configs := []ListenerConfig{
+		{Protocol: layers.LayerTypeTCP, Port: 80, Name: "web"},
+		{Protocol: layers.LayerTypeTCP, Port: 8080, ProxyProtocol: true},
+		{Protocol: layers.LayerTypeTCP, Port: 443, TLSMode: TLSAuto, Cert: cert},
+		{Protocol: layers.LayerTypeUDP, Port: 53},
+	}
+	recChan := make(chan *recorder.HoneypokeRecord, 1)
+	replayer, err := NewReplayer(configs, recChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ports := replayer.Ports()
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+	if !reflect.DeepEqual(ports, []uint16{80, 443, 8080}) {
+		t.Errorf("Got ports %v, only the TCP listeners should be replayed", ports)
+	}
+
+	started := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		port     uint16
+		data     []byte
+		remoteIP string
+		proxyIP  string
+		input    string
+		ja4      string
+	}{
+		{"plain", 80, []byte("GET / HTTP/1.0\r\n\r\n"), "198.51.100.7", "", `GET / HTTP/1.0\r\n\r\n`, ""},
+		{
+			"proxy protocol",
+			8080,
+			[]byte("PROXY TCP4 203.0.113.9 192.0.2.10 41000 8080\r\nHELO\r\n"),
+			"203.0.113.9",
+			"198.51.100.7",
+			`HELO\r\n`,
+			"",
+		},
+		{"auto TLS with plaintext", 443, []byte("SSH-2.0-Go\r\n"), "198.51.100.7", "", `SSH-2.0-Go\r\n`, ""},
+		{"auto TLS", 443, tlsRecords(testClientHello(), 16384), "198.51.100.7", "", "", "t13d0407h2_52f89ac5ce33_3fb681c9c60b"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			replayer.Stream(test.port, "198.51.100.7", 40000, test.data, started)
+			record := <-recChan
+
+			if record.Time != "2026-10-19T12:00:00+0000" {
+				t.Errorf("Got time %s, expected the capture's", record.Time)
+			}
+			if record.Port != int(test.port) || record.Protocol != "tcp" {
+				t.Errorf("Got %s port %d", record.Protocol, record.Port)
+			}
+			if record.RemoteIP != test.remoteIP || record.ProxyIP != test.proxyIP {
+				t.Errorf("Got remote %s and proxy %s, expected %s and %s", record.RemoteIP, record.ProxyIP, test.remoteIP, test.proxyIP)
+			}
+			if test.ja4 == "" {
+				if record.Input != test.input || record.UseSSL {
+					t.Errorf("Got input %q with SSL %v, expected %q", record.Input, record.UseSSL, test.input)
+				}
+				return
+			}
+			if !record.UseSSL || record.TLS == nil {
+				t.Fatal("The ClientHello wasn't recognized")
+			}
+			if record.TLS.JA4 != test.ja4 || record.TLS.SNI != "example.com" {
+				t.Errorf("Got JA4 %s and SNI %s, expected %s and example.com", record.TLS.JA4, record.TLS.SNI, test.ja4)
+			}
+			// There's no client to finish the handshake with
+			if record.TLS.HandshakeError == "" {
+				t.Error("No handshake error recorded")
+			}
+		})
+	}
+
+	if records := len(recChan); records != 0 {
+		t.Errorf("Got %d extra records", records)
+	}
+}
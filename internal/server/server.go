@@ -11,28 +11,106 @@ import (
 	"os"
 	"strconv"
 	"strings"
-	"syscall"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 
+	"github.com/bocajspear1/honeypoke-go/internal/capture"
+	"github.com/bocajspear1/honeypoke-go/internal/fingerprint"
+	"github.com/bocajspear1/honeypoke-go/internal/permissions"
 	"github.com/bocajspear1/honeypoke-go/internal/recorder"
 )
 
+// TLSMode sets how a TCP listener handles TLS
+type TLSMode int
+
+const (
+	// TLSOff listens for plaintext only
+	TLSOff TLSMode = iota
+	// TLSOn expects every connection to use TLS
+	TLSOn
+	// TLSAuto detects a TLS ClientHello and falls back to plaintext
+	TLSAuto
+	// TLSStartTLS starts in plaintext and upgrades when the client asks to
+	TLSStartTLS
+)
+
+// ListenerConfig holds the settings for a single listener
+type ListenerConfig struct {
+	Protocol gopacket.LayerType
+	Port     int
+	TLSMode  TLSMode
+	// Certificate to prefer for this listener, otherwise the shared set is used
+	Cert *CertificatePair
+	// Address to listen on, every address if empty
+	Bind string
+	// Put on every record from the listener, to tell decoys apart
+	Name    string
+	Persona string
+	// Connections start with a PROXY protocol header from a load balancer
+	ProxyProtocol bool
+	// Sent back for every UDP packet, as far as the reflection guard allows
+	Response string
+}
+
+// listenerTag is what a listener puts on its records to say which one it is
+type listenerTag struct {
+	name    string
+	persona string
+}
+
+func (config ListenerConfig) tag() listenerTag {
+	return listenerTag{name: config.Name, persona: config.Persona}
+}
+
+func (config ListenerConfig) address() string {
+	return net.JoinHostPort(config.Bind, strconv.Itoa(config.Port))
+}
+
+// String names a listener by what it listens on, like "TCP 10.0.0.1:80". Listeners are
+// told apart by it, since there can only be one of each.
+func (config ListenerConfig) String() string {
+	return config.Protocol.String() + " " + config.address()
+}
+
+func (tag listenerTag) apply(record *recorder.HoneypokeRecord) {
+	record.Listener = tag.name
+	record.Persona = tag.persona
+}
+
+// LargeDirectory is where inputs too big to record are written
+const LargeDirectory = "./large"
+
 const toFileSize = 4096
 
 // Max 35k files
 const maxTCPSize = 40 * 1024
 
-func tcpHandler(port int, conn net.Conn, c chan *recorder.HoneypokeRecord) {
+// peerAddress splits a peer's address into its IP and port. IPv6 zones are left off,
+// since they only mean something on this host.
+func peerAddress(addr net.Addr) (string, int) {
+	host, portString, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String(), 0
+	}
+	if zone := strings.IndexByte(host, '%'); zone >= 0 {
+		host = host[:zone]
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		port = 0
+	}
+	return host, port
+}
 
-	addrSplit := strings.Split(conn.RemoteAddr().String(), ":")
+func tcpHandler(port int, tag listenerTag, proxy *proxyHeader, useSSL bool, tlsInfo *recorder.TLSInfo, conn net.Conn, started time.Time, c chan *recorder.HoneypokeRecord) {
 
-	remoteAddr := addrSplit[0]
-	remotePort, err := (strconv.Atoi(addrSplit[1]))
-	if err != nil {
-		remotePort = 0
+	remoteAddr, remotePort := peerAddress(conn.RemoteAddr())
+	// The session capture has the connection from the proxy, not the client
+	peerAddr, peerPort := remoteAddr, remotePort
+	if proxy != nil {
+		peerAddr, peerPort = peerAddress(proxy.proxy)
 	}
 
 	const chunkSize = 512
@@ -43,6 +121,8 @@ func tcpHandler(port int, conn net.Conn, c chan *recorder.HoneypokeRecord) {
 	var outFile *os.File
 	var outPath string
 
+	upgradable, canUpgrade := conn.(*upgradableConn)
+
 	for bytesReadTotal := 0; bytesReadTotal <= maxTCPSize && !connDied; {
 		smallBuffer := make([]byte, chunkSize)
 
@@ -54,7 +134,7 @@ func tcpHandler(port int, conn net.Conn, c chan *recorder.HoneypokeRecord) {
 				finalBuffer = append(finalBuffer, smallBuffer[0:bytesRead]...)
 			} else {
 				if outFile == nil {
-					outPath = "./large/tcp-" + strconv.Itoa(port) + "-" + strconv.FormatInt(time.Now().Unix(), 10) + ".large"
+					outPath = LargeDirectory + "/tcp-" + strconv.Itoa(port) + "-" + strconv.FormatInt(time.Now().Unix(), 10) + ".large"
 					outFile, err = os.OpenFile(outPath, os.O_RDWR|os.O_CREATE, 0444)
 					if err != nil {
 						log.Printf("Could not open large file: %s\n", err)
@@ -68,6 +148,15 @@ func tcpHandler(port int, conn net.Conn, c chan *recorder.HoneypokeRecord) {
 				outFile.Write(smallBuffer[0:bytesRead])
 			}
 
+			if canUpgrade && upgradable.tlsInfo == nil && outFile == nil {
+				if reply := starttlsReply(finalBuffer); reply != nil {
+					err = upgradable.StartTLS(reply)
+					if err != nil {
+						// There's nothing more to read from a failed upgrade
+						conn.Close()
+					}
+				}
+			}
 		}
 
 		if err != nil {
@@ -94,89 +183,172 @@ func tcpHandler(port int, conn net.Conn, c chan *recorder.HoneypokeRecord) {
 	record.RemotePort = remotePort
 	record.Port = port
 	record.Protocol = "tcp"
+	tag.apply(record)
+	if proxy != nil {
+		record.ProxyIP = peerAddr
+		if proxy.err != nil {
+			record.ProxyError = proxy.err.Error()
+		}
+	}
+	record.UseSSL = useSSL
+	record.TLS = tlsInfo
+	if canUpgrade && upgradable.tlsInfo != nil {
+		record.UseSSL = true
+		record.TLS = upgradable.tlsInfo
+		record.StartTLSOffset = upgradable.upgradeOffset
+	}
+	if result, ok := fingerprint.Lookup(remoteAddr, (uint16)(remotePort)); ok {
+		record.OSGuess = result.OSGuess
+		record.ScannerTool = result.ScannerTool
+		record.TCPFingerprint = result.Signature
+	}
+	if capture.Enabled() {
+		// Close first so our side of the teardown makes it into the capture
+		conn.Close()
+		pcapPath, err := capture.WriteSession(peerAddr, (uint16)(peerPort), (uint16)(port), started)
+		record.PcapPath = pcapPath
+		if err != nil {
+			log.Printf("Could not write session capture: %s\n", err)
+		}
+	}
 
 	c <- record
 
 }
 
-func runTCPServer(port int, ssl bool, recChan chan *recorder.HoneypokeRecord, contChan chan bool) {
-	log.Printf("Started server for port %d", port)
-
-	var listener net.Listener
+func runTCPServer(config ListenerConfig, tlsConfig *tls.Config, recChan chan *recorder.HoneypokeRecord, contChan chan bool) {
+	log.Printf("Started server for %s", config.address())
 
-	if !ssl {
-		var err error
-		listener, err = net.Listen("tcp", ":"+strconv.Itoa(port))
-		if err != nil {
-			log.Fatalf("Failed to start TCP server on port %d\n", port)
-			return
-		}
-	} else {
-		certs, err := tls.LoadX509KeyPair("honeypoke_cert.pem", "honeypoke_key.pem")
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		config := &tls.Config{Certificates: []tls.Certificate{certs}}
-		listener, err = tls.Listen("tcp", ":"+strconv.Itoa(port), config)
+	listener, err := net.Listen("tcp", config.address())
+	if err != nil {
+		log.Fatalf("Failed to start TCP server on %s: %s\n", config.address(), err)
+		return
 	}
 
-	defer listener.Close()
-
 	contChan <- true
 
-	for syscall.Getuid() == 0 {
-		log.Printf("TCP:%d Waiting for permissions to drop...", port)
-		time.Sleep(time.Second * 2)
+	permissions.WaitUntilDropped()
+
+	serveTCP(listener, config, tlsConfig, recChan)
+}
+
+func serveTCP(listener net.Listener, config ListenerConfig, tlsConfig *tls.Config, recChan chan *recorder.HoneypokeRecord) {
+	key := config.String()
+	if !active.addListener(key, listener) {
+		return
 	}
+	defer active.serverDone(key, listener)
+	defer listener.Close()
 
+	tag := config.tag()
 	for {
 		conn, aerr := listener.Accept()
 
 		if aerr != nil {
-			log.Printf("Failed connection")
+			if active.isOpen(key, listener) {
+				log.Printf("Failed connection")
+			}
 			return
 		}
 
-		go tcpHandler(port, conn, recChan)
+		active.handle(conn, func() {
+			tcpAccept(config.Port, tag, config.ProxyProtocol, config.TLSMode, tlsConfig, conn, recChan)
+		})
 	}
 
 }
 
-func runUDPServer(port int, recChan chan *recorder.HoneypokeRecord, contChan chan bool) {
-	udpList, err := net.ListenPacket("udp", ":"+strconv.Itoa(port))
+// tlsHandshake performs the server side of a TLS handshake, grabbing the ClientHello
+// before the handshake consumes it so failed handshakes still get fingerprinted
+func tlsHandshake(peeked *peekConn, tlsConfig *tls.Config) (*tls.Conn, *recorder.TLSInfo) {
+	tlsInfo := new(recorder.TLSInfo)
+	message, err := peeked.readClientHello()
+	if err == nil {
+		var hello *clientHello
+		hello, err = parseClientHello(message)
+		if err == nil {
+			tlsInfo = hello.tlsInfo()
+		}
+	}
+	if err != nil {
+		tlsInfo.HandshakeError = "Could not read ClientHello: " + err.Error()
+	}
 
-	contChan <- true
+	tlsConn := tls.Server(peeked, tlsConfig)
+	err = tlsConn.Handshake()
+	if err != nil && tlsInfo.HandshakeError == "" {
+		tlsInfo.HandshakeError = err.Error()
+	}
+
+	return tlsConn, tlsInfo
+}
+
+// tcpAccept sets up TLS on a new connection, if needed, before handing it to the handler
+func tcpAccept(port int, tag listenerTag, proxyProtocol bool, tlsMode TLSMode, tlsConfig *tls.Config, conn net.Conn, c chan *recorder.HoneypokeRecord) {
+	started := time.Now()
+	var proxy *proxyHeader
+	if proxyProtocol {
+		conn, proxy = readProxyHeader(conn)
+	}
+	if tlsMode == TLSOff {
+		tcpHandler(port, tag, proxy, false, nil, conn, started, c)
+		return
+	} else if tlsMode == TLSStartTLS {
+		tcpHandler(port, tag, proxy, false, nil, newUpgradableConn(conn, tlsConfig), started, c)
+		return
+	}
 
-	for syscall.Getuid() == 0 {
-		log.Printf("UDP:%d Waiting for permissions to drop...", port)
-		time.Sleep(time.Second * 2)
+	peeked := newPeekConn(conn)
+	useSSL := tlsMode == TLSOn || peeked.looksLikeTLS()
+	if !useSSL {
+		tcpHandler(port, tag, proxy, false, nil, peeked, started, c)
+		return
 	}
 
+	tlsConn, tlsInfo := tlsHandshake(peeked, tlsConfig)
+	tcpHandler(port, tag, proxy, true, tlsInfo, tlsConn, started, c)
+}
+
+func runUDPServer(config ListenerConfig, recChan chan *recorder.HoneypokeRecord, contChan chan bool) {
+	udpList, err := net.ListenPacket("udp", config.address())
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	contChan <- true
+
+	permissions.WaitUntilDropped()
+
+	serveUDP(udpList, config, recChan)
+}
+
+func serveUDP(udpList net.PacketConn, config ListenerConfig, recChan chan *recorder.HoneypokeRecord) {
+	key := config.String()
+	if !active.addListener(key, udpList) {
+		return
+	}
+	defer active.serverDone(key, udpList)
 	defer udpList.Close()
 
+	port := config.Port
+	tag := config.tag()
+
 	buffer := make([]byte, 2048)
 
 	for {
 
 		bytesRead, remoteAddrData, err := udpList.ReadFrom(buffer)
 
-		addrSplit := strings.Split(remoteAddrData.String(), ":")
-
-		remoteAddr := addrSplit[0]
-		remotePort, err := (strconv.Atoi(addrSplit[1]))
-		if err != nil {
-			remotePort = 0
-		}
-
 		if err != nil {
+			if !active.isOpen(key, udpList) {
+				return
+			}
 			log.Printf("Error getting packet: %s", err)
 
 		} else if bytesRead > 0 {
+			remoteAddr, remotePort := peerAddress(remoteAddrData)
 			record := recorder.NewRecord(remoteAddr, (uint16)(remotePort))
+			record.RateLimited = guard.observeRequest(remoteAddr, bytesRead)
 
 			input := strconv.Quote(string(buffer[0:bytesRead]))
 			record.Input = input[1 : len(input)-1]
@@ -184,6 +356,14 @@ func runUDPServer(port int, recChan chan *recorder.HoneypokeRecord, contChan cha
 			record.RemotePort = remotePort
 			record.Port = port
 			record.Protocol = "udp"
+			tag.apply(record)
+
+			if config.Response != "" {
+				_, err = sendUDPResponse(udpList, remoteAddrData, []byte(config.Response))
+				if err != nil {
+					log.Printf("Error responding to %s: %s", remoteAddr, err)
+				}
+			}
 
 			recChan <- record
 		}
@@ -194,10 +374,18 @@ func runUDPServer(port int, recChan chan *recorder.HoneypokeRecord, contChan cha
 }
 
 // StartServer starts a listener on a port
-func StartServer(protocol gopacket.LayerType, port int, ssl bool, recChan chan *recorder.HoneypokeRecord, contChan chan bool) {
-	if protocol == layers.LayerTypeTCP {
-		go runTCPServer(port, ssl, recChan, contChan)
-	} else if protocol == layers.LayerTypeUDP {
-		go runUDPServer(port, recChan, contChan)
+func StartServer(config ListenerConfig, recChan chan *recorder.HoneypokeRecord, contChan chan bool) {
+	if config.Protocol == layers.LayerTypeTCP {
+		var tlsConfig *tls.Config
+		if config.TLSMode != TLSOff {
+			var err error
+			tlsConfig, err = newTLSConfig(config.Cert)
+			if err != nil {
+				log.Fatalf("Could not load certificates for TCP port %d: %s\n", config.Port, err)
+			}
+		}
+		go runTCPServer(config, tlsConfig, recChan, contChan)
+	} else if config.Protocol == layers.LayerTypeUDP {
+		go runUDPServer(config, recChan, contChan)
 	}
 }
@@ -0,0 +1,181 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package server
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// How long handlers get to send their records after their connections are cut
+const shutdownGrace = 5 * time.Second
+
+var errShuttingDown = errors.New("Shutting down")
+
+// tracker keeps the open listeners and connections, so they can be stopped on shutdown
+type tracker struct {
+	lock    sync.Mutex
+	closing bool
+	// Listeners by what they were started from, see ListenerConfig.String
+	listeners map[string]io.Closer
+	conns     map[net.Conn]bool
+	// Serving loops, which can be sending UDP records
+	servers  sync.WaitGroup
+	handlers sync.WaitGroup
+}
+
+var active = &tracker{listeners: make(map[string]io.Closer), conns: make(map[net.Conn]bool)}
+
+// addListener tracks a listener for the loop serving it, which must call serverDone when
+// it stops. If we're shutting down, the listener is closed instead and false returned.
+func (t *tracker) addListener(key string, listener io.Closer) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closing {
+		listener.Close()
+		return false
+	}
+	t.listeners[key] = listener
+	t.servers.Add(1)
+	return true
+}
+
+func (t *tracker) serverDone(key string, listener io.Closer) {
+	t.lock.Lock()
+	if t.listeners[key] == listener {
+		delete(t.listeners, key)
+	}
+	t.lock.Unlock()
+	t.servers.Done()
+}
+
+// isOpen checks if a listener is still wanted, so errors from closing it aren't logged
+func (t *tracker) isOpen(key string, listener io.Closer) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.listeners[key] == listener
+}
+
+func (t *tracker) isClosing() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.closing
+}
+
+// stopListener closes a listener, connections it accepted carry on
+func (t *tracker) stopListener(key string) bool {
+	t.lock.Lock()
+	listener, ok := t.listeners[key]
+	delete(t.listeners, key)
+	t.lock.Unlock()
+	if ok {
+		listener.Close()
+	}
+	return ok
+}
+
+// handle runs handler for a connection in its own goroutine, and closes the connection
+// when it's done. Connections that come in while shutting down are closed right away.
+func (t *tracker) handle(conn net.Conn, handler func()) {
+	t.lock.Lock()
+	if t.closing {
+		t.lock.Unlock()
+		conn.Close()
+		return
+	}
+	t.conns[conn] = true
+	t.handlers.Add(1)
+	t.lock.Unlock()
+
+	go func() {
+		defer t.handlers.Done()
+		defer func() {
+			t.lock.Lock()
+			delete(t.conns, conn)
+			t.lock.Unlock()
+		}()
+		defer conn.Close()
+		handler()
+	}()
+}
+
+// openConns gets how many connections are still being handled
+func (t *tracker) openConns() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.conns)
+}
+
+// cutConns closes every connection still being handled, so their handlers finish up
+func (t *tracker) cutConns() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for conn := range t.conns {
+		conn.Close()
+	}
+}
+
+// waitTimeout waits for group, giving up after timeout. Returns if everything finished.
+func waitTimeout(group *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan bool)
+	go func() {
+		group.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// ShutdownStats is what happened to the connections open when shutting down
+type ShutdownStats struct {
+	Listeners int
+	// Connections that finished on their own
+	Drained int
+	// Connections closed on us after the timeout, their handlers still record what they got
+	Cut int
+	// Cut connections whose handlers still didn't finish, their records are lost
+	Abandoned int
+}
+
+// Shutdown stops every listener from accepting and waits up to timeout for the connections
+// being handled to finish. After that they're closed, and their handlers get a little longer
+// to send their records. Nothing is sent on the record channel once this returns, unless
+// handlers were abandoned.
+func Shutdown(timeout time.Duration) ShutdownStats {
+	active.lock.Lock()
+	active.closing = true
+	listeners := active.listeners
+	active.listeners = make(map[string]io.Closer)
+	active.lock.Unlock()
+
+	stats := ShutdownStats{Listeners: len(listeners)}
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	active.servers.Wait()
+
+	inFlight := active.openConns()
+	if inFlight > 0 {
+		log.Printf("Waiting up to %s for %d connections to finish...\n", timeout, inFlight)
+	}
+	if !waitTimeout(&active.handlers, timeout) {
+		stats.Cut = active.openConns()
+		log.Printf("Closing %d connections that are still open\n", stats.Cut)
+		active.cutConns()
+		if !waitTimeout(&active.handlers, shutdownGrace) {
+			stats.Abandoned = active.openConns()
+		}
+	}
+	stats.Drained = inFlight - stats.Cut
+	return stats
+}
@@ -0,0 +1,164 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/bocajspear1/honeypoke-go/internal/recorder"
+)
+
+// How long the client gets to finish the handshake once we've agreed to upgrade
+var starttlsHandshakeTimeout = 10 * time.Second
+
+// upgradableConn is a plaintext connection that a handler can switch to TLS partway
+// through, like STARTTLS does. Reads go through the same value before and after the
+// upgrade, so the handler keeps a single session.
+type upgradableConn struct {
+	net.Conn
+	plain     *peekConn
+	tlsConfig *tls.Config
+
+	bytesRead     int
+	upgraded      bool
+	upgradeOffset int
+	tlsInfo       *recorder.TLSInfo
+}
+
+func newUpgradableConn(conn net.Conn, tlsConfig *tls.Config) *upgradableConn {
+	plain := newPeekConn(conn)
+	return &upgradableConn{
+		Conn:      plain,
+		plain:     plain,
+		tlsConfig: tlsConfig,
+	}
+}
+
+func (u *upgradableConn) Read(b []byte) (int, error) {
+	bytesRead, err := u.Conn.Read(b)
+	if !u.upgraded {
+		u.bytesRead += bytesRead
+	}
+	return bytesRead, err
+}
+
+// StartTLS sends the plaintext reply that tells the client to go ahead, then performs the
+// TLS handshake. The number of plaintext bytes read before the upgrade is kept as the upgrade point.
+// tlsInfo is set even if it fails, with the error in HandshakeError.
+func (u *upgradableConn) StartTLS(reply []byte) error {
+	u.upgradeOffset = u.bytesRead
+	if len(reply) > 0 {
+		_, err := u.plain.Write(reply)
+		if err != nil {
+			u.tlsInfo = &recorder.TLSInfo{HandshakeError: "Could not send upgrade reply: " + err.Error()}
+			return err
+		}
+	}
+
+	u.plain.SetDeadline(time.Now().Add(starttlsHandshakeTimeout))
+	tlsConn, tlsInfo := tlsHandshake(u.plain, u.tlsConfig)
+	u.plain.SetDeadline(time.Time{})
+
+	u.Conn = tlsConn
+	u.upgraded = true
+	u.tlsInfo = tlsInfo
+
+	if tlsInfo.HandshakeError != "" {
+		return errors.New(tlsInfo.HandshakeError)
+	}
+	return nil
+}
+
+// PostgreSQL SSLRequest message, sent before the startup message
+var postgresSSLRequest = []byte{0x00, 0x00, 0x00, 0x08, 0x04, 0xd2, 0x16, 0x2f}
+
+const ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+
+// Longest line that could be an upgrade command, so longer lines aren't scanned
+const maxStartTLSLine = 64
+
+// lastLine returns the newest line of the input if it is complete, without the line ending.
+// Only the end of the input is looked at, since it's checked after every read.
+func lastLine(input []byte) string {
+	if len(input) == 0 || input[len(input)-1] != '\n' {
+		return ""
+	}
+	line := input[:len(input)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	start := 0
+	if len(line) > maxStartTLSLine {
+		start = len(line) - maxStartTLSLine - 1
+	}
+	newline := bytes.LastIndexByte(line[start:], '\n')
+	if newline < 0 && start > 0 {
+		return ""
+	}
+	return strings.TrimSpace(string(line[start+newline+1:]))
+}
+
+// ldapStartTLSReply builds the ExtendedResponse for a StartTLS ExtendedRequest. The
+// request has to be all of the input so far.
+func ldapStartTLSReply(input []byte) []byte {
+	// LDAPMessage SEQUENCE, then the messageID INTEGER, only short form lengths are handled
+	if len(input) < 5 || input[0] != 0x30 || input[2] != 0x02 || int(input[1])+2 != len(input) {
+		return nil
+	}
+	idLen := int(input[3])
+	if idLen < 1 || idLen > 4 || len(input) < 4+idLen+1 {
+		return nil
+	}
+	// ExtendedRequest is [APPLICATION 23]
+	if input[4+idLen] != 0x77 || !bytes.Contains(input, []byte(ldapStartTLSOID)) {
+		return nil
+	}
+	messageID := input[4 : 4+idLen]
+
+	// ExtendedResponse [APPLICATION 24] with resultCode success, empty matchedDN and diagnosticMessage
+	response := []byte{0x78, 0x07, 0x0a, 0x01, 0x00, 0x04, 0x00, 0x04, 0x00}
+	body := append([]byte{0x02, byte(idLen)}, messageID...)
+	body = append(body, response...)
+	return append([]byte{0x30, byte(len(body))}, body...)
+}
+
+// starttlsReply checks if the client has asked to upgrade to TLS, returning the reply
+// that tells it to start the handshake, or nil if it hasn't
+func starttlsReply(input []byte) []byte {
+	if bytes.Equal(input, postgresSSLRequest) {
+		return []byte("S")
+	}
+
+	if reply := ldapStartTLSReply(input); reply != nil {
+		return reply
+	}
+
+	line := lastLine(input)
+	upper := strings.ToUpper(line)
+	fields := strings.Fields(upper)
+
+	switch {
+	case upper == "STARTTLS":
+		// SMTP
+		return []byte("220 2.0.0 Ready to start TLS\r\n")
+	case upper == "STLS":
+		// POP3
+		return []byte("+OK Begin TLS negotiation\r\n")
+	case upper == "AUTH TLS" || upper == "AUTH SSL" || upper == "AUTH TLS-C":
+		// FTP
+		return []byte("234 AUTH TLS successful\r\n")
+	case len(fields) == 2 && fields[1] == "STARTTLS":
+		// IMAP, which has a tag before the command
+		tag := strings.Fields(line)[0]
+		return []byte(tag + " OK Begin TLS negotiation now\r\n")
+	}
+
+	return nil
+}
@@ -0,0 +1,143 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bocajspear1/honeypoke-go/internal/recorder"
+)
+
+func TestLastLine(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"", ""},
+		{"STARTTLS", ""},
+		{"STARTTLS\r\n", "STARTTLS"},
+		{"STARTTLS\n", "STARTTLS"},
+		{"EHLO x\r\n  STARTTLS \r\n", "STARTTLS"},
+		{"STARTTLS\r\n\r\n", ""},
+		{strings.Repeat("A", 100) + "\nSTLS\n", "STLS"},
+		{strings.Repeat("A", 100) + "\n", ""},
+		{strings.Repeat("A", maxStartTLSLine) + "\n", strings.Repeat("A", maxStartTLSLine)},
+	}
+	for _, test := range tests {
+		if line := lastLine([]byte(test.input)); line != test.expected {
+			t.Errorf("lastLine(%q) gave %q, expected %q", test.input, line, test.expected)
+		}
+	}
+}
+
+func TestStartTLSReply(t *testing.T) {
+	ldapRequest := "0\x1d\x02\x01\x01w\x18\x80\x16" + ldapStartTLSOID
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"smtp", "EHLO client\r\nSTARTTLS\r\n", "220 2.0.0 Ready to start TLS\r\n"},
+		{"smtp lowercase", "starttls\r\n", "220 2.0.0 Ready to start TLS\r\n"},
+		{"pop3", "CAPA\r\nSTLS\r\n", "+OK Begin TLS negotiation\r\n"},
+		{"ftp", "AUTH TLS\r\n", "234 AUTH TLS successful\r\n"},
+		{"imap", "a1 CAPABILITY\r\na2 starttls\r\n", "a2 OK Begin TLS negotiation now\r\n"},
+		{"postgres", string(postgresSSLRequest), "S"},
+		{"ldap", ldapRequest, "0\x0c\x02\x01\x01x\x07\x0a\x01\x00\x04\x00\x04\x00"},
+		{"ldap with more after it", ldapRequest + "0\x05", ""},
+		{"ldap bind", "0\x0c\x02\x01\x01`\x07\x02\x01\x03\x04\x00\x80\x00", ""},
+		{"incomplete line", "STARTTLS", ""},
+		{"only the newest line", "STARTTLS\r\nQUIT\r\n", ""},
+		{"other command", "HELO client\r\n", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if reply := starttlsReply([]byte(test.input)); string(reply) != test.expected {
+				t.Errorf("Got %q, expected %q", reply, test.expected)
+			}
+		})
+	}
+}
+
+// startTLSSession runs the handler on one end of a pipe and the client on the other
+func startTLSSession(t *testing.T, client func(net.Conn)) *recorder.HoneypokeRecord {
+	dir, err := ioutil.TempDir("", "honeypoke")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pair := testPair(t, dir, "starttls", CertificateSubject{CommonName: "example.com"})
+	tlsConfig, err := newTLSConfig(&pair)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	recChan := make(chan *recorder.HoneypokeRecord, 1)
+	go tcpHandler(25, listenerTag{}, nil, false, nil, newUpgradableConn(serverConn, tlsConfig), time.Now(), recChan)
+	client(clientConn)
+	clientConn.Close()
+
+	select {
+	case record := <-recChan:
+		return record
+	case <-time.After(10 * time.Second):
+		t.Fatal("No record from the handler")
+	}
+	return nil
+}
+
+func TestStartTLSUpgrade(t *testing.T) {
+	plaintext := "EHLO client\r\nSTARTTLS\r\n"
+	record := startTLSSession(t, func(conn net.Conn) {
+		conn.Write([]byte(plaintext))
+		reply, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil || !strings.HasPrefix(reply, "220 ") {
+			t.Errorf("Got reply %q and error %v", reply, err)
+			return
+		}
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+		if err := tlsConn.Handshake(); err != nil {
+			t.Errorf("Handshake failed: %s", err)
+			return
+		}
+		tlsConn.Write([]byte("QUIT\r\n"))
+	})
+
+	if !record.UseSSL || record.TLS == nil || record.TLS.HandshakeError != "" {
+		t.Fatalf("Upgrade wasn't recorded: %+v", record)
+	}
+	if record.TLS.SNI != "example.com" {
+		t.Errorf("Got SNI %q", record.TLS.SNI)
+	}
+	if record.StartTLSOffset != len(plaintext) {
+		t.Errorf("Got upgrade offset %d, expected %d", record.StartTLSOffset, len(plaintext))
+	}
+	if record.Input != `EHLO client\r\nSTARTTLS\r\nQUIT\r\n` {
+		t.Errorf("Got input %q", record.Input)
+	}
+}
+
+func TestStartTLSHandshakeTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { starttlsHandshakeTimeout = timeout }(starttlsHandshakeTimeout)
+	starttlsHandshakeTimeout = 100 * time.Millisecond
+
+	record := startTLSSession(t, func(conn net.Conn) {
+		conn.Write([]byte("STARTTLS\r\n"))
+		// Wait without starting the handshake until the handler gives up
+		ioutil.ReadAll(conn)
+	})
+
+	if record.TLS == nil || record.TLS.HandshakeError == "" {
+		t.Errorf("No handshake error recorded: %+v", record.TLS)
+	}
+}
@@ -0,0 +1,227 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package server
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const defaultGuardWindow = 60 * time.Second
+const defaultGuardMaxPackets = 20
+const defaultGuardMaxBytes = 8192
+
+// How many observations between sweeps of idle peers
+const guardSweepInterval = 1024
+
+// Most peers tracked at once. Every spoofed source is a new peer, so a flood would
+// otherwise grow the map without end.
+const guardMaxPeers = 65536
+
+// The window is split into this many buckets, which are dropped as they slide out of it
+const guardBuckets = 10
+
+// Counts for one source over one bucket of the window
+type guardBucket struct {
+	index         int64
+	requests      int
+	requestBytes  int
+	responses     int
+	responseBytes int
+}
+
+// Counts for one source over the last window
+type udpPeer struct {
+	buckets  [guardBuckets]guardBucket
+	lastSeen time.Time
+	flagged  bool
+}
+
+// udpGuard keeps UDP listeners from being used as reflectors. UDP sources
+// can be spoofed, so every response is checked against what the same
+// destination sent us over the last window, which slides a bucket at a time.
+type udpGuard struct {
+	lock       sync.Mutex
+	window     time.Duration
+	maxPackets int
+	maxBytes   int
+	peers      map[string]*udpPeer
+	seen       int
+	// When the guard last swept because it was full
+	fullSweep time.Time
+	full      bool
+	// Swapped out by tests
+	now func() time.Time
+}
+
+var guard = newUDPGuard(defaultGuardWindow, defaultGuardMaxPackets, defaultGuardMaxBytes)
+
+func newUDPGuard(window time.Duration, maxPackets int, maxBytes int) *udpGuard {
+	return &udpGuard{
+		window:     window,
+		maxPackets: maxPackets,
+		maxBytes:   maxBytes,
+		peers:      make(map[string]*udpPeer),
+		now:        time.Now,
+	}
+}
+
+// ConfigureUDPGuard sets the limits for the UDP reflection guard. Zero values keep the defaults.
+func ConfigureUDPGuard(window time.Duration, maxPackets int, maxBytes int) {
+	if window <= 0 {
+		window = defaultGuardWindow
+	}
+	if maxPackets <= 0 {
+		maxPackets = defaultGuardMaxPackets
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultGuardMaxBytes
+	}
+	guard.lock.Lock()
+	defer guard.lock.Unlock()
+	guard.window = window
+	guard.maxPackets = maxPackets
+	guard.maxBytes = maxBytes
+}
+
+// bucketIndex numbers the bucket now falls in. Expects the lock to be held.
+func (g *udpGuard) bucketIndex(now time.Time) int64 {
+	size := int64(g.window / guardBuckets)
+	if size <= 0 {
+		size = 1
+	}
+	return now.UnixNano() / size
+}
+
+// bucket gets the peer's bucket for now, clearing it if it was last used for an older one.
+// Expects the lock to be held.
+func (g *udpGuard) bucket(peer *udpPeer, now time.Time) *guardBucket {
+	index := g.bucketIndex(now)
+	bucket := &peer.buckets[index%guardBuckets]
+	if bucket.index != index {
+		*bucket = guardBucket{index: index}
+	}
+	return bucket
+}
+
+// totals adds up the peer's buckets that are still in the window. Expects the lock to be held.
+func (g *udpGuard) totals(peer *udpPeer, now time.Time) guardBucket {
+	index := g.bucketIndex(now)
+	var total guardBucket
+	for _, bucket := range peer.buckets {
+		// Buckets from before the window was changed can be ahead of us too
+		if bucket.index > index-guardBuckets && bucket.index <= index {
+			total.requests += bucket.requests
+			total.requestBytes += bucket.requestBytes
+			total.responses += bucket.responses
+			total.responseBytes += bucket.responseBytes
+		}
+	}
+	return total
+}
+
+// sweep removes peers that have been quiet for a full window. Expects the lock to be held.
+func (g *udpGuard) sweep(now time.Time) {
+	for key, peer := range g.peers {
+		if now.Sub(peer.lastSeen) >= g.window {
+			delete(g.peers, key)
+		}
+	}
+}
+
+// getPeer finds the peer for host, or nil if the guard is full. Expects the lock to be held.
+func (g *udpGuard) getPeer(host string, now time.Time) *udpPeer {
+	g.seen++
+	if g.seen%guardSweepInterval == 0 {
+		g.sweep(now)
+	}
+
+	peer, ok := g.peers[host]
+	if !ok {
+		if len(g.peers) >= guardMaxPeers && now.Sub(g.fullSweep) >= time.Second {
+			g.fullSweep = now
+			g.sweep(now)
+		}
+		if len(g.peers) >= guardMaxPeers {
+			if !g.full {
+				log.Printf("UDP guard: tracking %d sources, not responding to new ones\n", guardMaxPeers)
+				g.full = true
+			}
+			return nil
+		}
+		g.full = false
+		peer = &udpPeer{}
+		g.peers[host] = peer
+	} else if now.Sub(peer.lastSeen) >= g.window {
+		// Sources are forgiven once they have been quiet for a full window
+		peer.flagged = false
+	}
+	peer.lastSeen = now
+	return peer
+}
+
+// observeRequest records an incoming packet and returns if the source is being rate limited.
+// The guard only fills up during a flood of sources, so new sources are limited until it has room.
+func (g *udpGuard) observeRequest(host string, size int) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	now := g.now()
+	peer := g.getPeer(host, now)
+	if peer == nil {
+		return true
+	}
+	bucket := g.bucket(peer, now)
+	bucket.requests++
+	bucket.requestBytes += size
+
+	total := g.totals(peer, now)
+	if !peer.flagged && (total.requests > g.maxPackets || total.requestBytes > g.maxBytes) {
+		log.Printf("UDP guard: %s exceeded %d packets/%d bytes in %s, rate limiting it\n", host, g.maxPackets, g.maxBytes, g.window)
+		peer.flagged = true
+	}
+
+	return peer.flagged
+}
+
+// allowResponse checks if a response can be sent to a destination. Responses are
+// never larger than what was received, and flagged destinations get nothing.
+func (g *udpGuard) allowResponse(host string, size int) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	now := g.now()
+	peer := g.getPeer(host, now)
+	if peer == nil || peer.flagged {
+		return false
+	}
+
+	total := g.totals(peer, now)
+	if total.responseBytes+size > total.requestBytes {
+		return false
+	}
+	if total.responses+1 > g.maxPackets || total.responseBytes+size > g.maxBytes {
+		log.Printf("UDP guard: no longer responding to %s\n", host)
+		peer.flagged = true
+		return false
+	}
+
+	bucket := g.bucket(peer, now)
+	bucket.responses++
+	bucket.responseBytes += size
+	return true
+}
+
+// sendUDPResponse sends a response to a peer if the guard allows it
+func sendUDPResponse(conn net.PacketConn, addr net.Addr, response []byte) (bool, error) {
+	host, _ := peerAddress(addr)
+	if !guard.allowResponse(host, len(response)) {
+		return false, nil
+	}
+	_, err := conn.WriteTo(response, addr)
+	return err == nil, err
+}
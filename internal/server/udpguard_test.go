@@ -0,0 +1,139 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package server
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testGuard makes a guard with a clock that only moves when the test says so
+func testGuard(maxPackets int, maxBytes int) (*udpGuard, *time.Time) {
+	g := newUDPGuard(10*time.Second, maxPackets, maxBytes)
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	g.now = func() time.Time { return now }
+	return g, &now
+}
+
+func TestGuardSlidingWindow(t *testing.T) {
+	g, now := testGuard(10, 1<<20)
+
+	// Most of the limit at the end of one window...
+	*now = now.Add(9 * time.Second)
+	for i := 0; i < 8; i++ {
+		if g.observeRequest("198.51.100.7", 10) {
+			t.Fatalf("Rate limited after %d packets", i+1)
+		}
+	}
+	// ...and the rest at the start of the next still counts together
+	*now = now.Add(2 * time.Second)
+	g.observeRequest("198.51.100.7", 10)
+	g.observeRequest("198.51.100.7", 10)
+	if !g.observeRequest("198.51.100.7", 10) {
+		t.Error("A burst straddling the window boundary wasn't rate limited")
+	}
+	// Still limited while the source keeps sending
+	*now = now.Add(9 * time.Second)
+	if !g.observeRequest("198.51.100.7", 10) {
+		t.Error("Source was forgiven while it was still sending")
+	}
+	// And forgiven after a quiet window
+	*now = now.Add(10 * time.Second)
+	if g.observeRequest("198.51.100.7", 10) {
+		t.Error("Source wasn't forgiven after a quiet window")
+	}
+}
+
+func TestGuardOldBucketsSlideOut(t *testing.T) {
+	g, now := testGuard(10, 1<<20)
+
+	for i := 0; i < 10; i++ {
+		g.observeRequest("198.51.100.7", 10)
+		*now = now.Add(time.Second)
+	}
+	// The first packet's bucket has slid out, so there's room for one more
+	if g.observeRequest("198.51.100.7", 10) {
+		t.Error("Rate limited with only 10 packets in the window")
+	}
+	if !g.observeRequest("198.51.100.7", 10) {
+		t.Error("Not rate limited with 11 packets in the window")
+	}
+}
+
+func TestGuardByteLimit(t *testing.T) {
+	g, _ := testGuard(100, 1000)
+	if g.observeRequest("198.51.100.7", 1000) {
+		t.Error("Rate limited at the byte limit")
+	}
+	if !g.observeRequest("198.51.100.7", 1) {
+		t.Error("Not rate limited over the byte limit")
+	}
+	if g.observeRequest("198.51.100.8", 10) {
+		t.Error("Another source was rate limited")
+	}
+}
+
+func TestGuardResponses(t *testing.T) {
+	g, now := testGuard(3, 1000)
+
+	if g.allowResponse("198.51.100.7", 1) {
+		t.Error("Response allowed to a source that sent nothing")
+	}
+	g.observeRequest("198.51.100.7", 100)
+	if g.allowResponse("198.51.100.7", 101) {
+		t.Error("Response larger than the request was allowed")
+	}
+	if !g.allowResponse("198.51.100.7", 60) {
+		t.Error("Response smaller than the request wasn't allowed")
+	}
+	if g.allowResponse("198.51.100.7", 60) {
+		t.Error("Responses larger in total than the requests were allowed")
+	}
+
+	// Requests that slide out of the window take their allowance with them
+	*now = now.Add(11 * time.Second)
+	if g.allowResponse("198.51.100.7", 10) {
+		t.Error("Response allowed for requests outside the window")
+	}
+
+	// Going over the packet limit flags the destination
+	for i := 0; i < 3; i++ {
+		g.observeRequest("198.51.100.8", 100)
+	}
+	for i := 0; i < 3; i++ {
+		if !g.allowResponse("198.51.100.8", 10) {
+			t.Fatalf("Response %d wasn't allowed", i+1)
+		}
+	}
+	if g.allowResponse("198.51.100.8", 10) {
+		t.Error("Response over the packet limit was allowed")
+	}
+	if !g.observeRequest("198.51.100.8", 1) {
+		t.Error("Destination wasn't rate limited after going over the limit")
+	}
+}
+
+func TestGuardMaxPeers(t *testing.T) {
+	g, now := testGuard(10, 1<<20)
+	for i := 0; i < guardMaxPeers; i++ {
+		g.observeRequest(strconv.Itoa(i), 10)
+	}
+	if !g.observeRequest("198.51.100.7", 10) {
+		t.Error("New source wasn't rate limited with the guard full")
+	}
+	if g.observeRequest("0", 10) {
+		t.Error("Known source was rate limited with the guard full")
+	}
+
+	// Once everyone has been quiet for a window there's room again
+	*now = now.Add(11 * time.Second)
+	if g.observeRequest("198.51.100.7", 10) {
+		t.Error("New source was rate limited after the guard was swept")
+	}
+	if len(g.peers) > guardMaxPeers {
+		t.Errorf("Tracking %d peers", len(g.peers))
+	}
+}
@@ -0,0 +1,321 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package starter
+
+import (
+	"log"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/bocajspear1/honeypoke-go/internal/recorder"
+	"github.com/bocajspear1/honeypoke-go/internal/server"
+	"github.com/bocajspear1/honeypoke-go/internal/watcher"
+)
+
+// Config keys that can be changed by reloading, everything else needs a restart
+var reloadableKeys = map[string]bool{
+	"recorders":        true,
+	"tcp_ports":        true,
+	"udp_ports":        true,
+	"udp_listeners":    true,
+	"ignore_tcp_ports": true,
+	"udp_guard":        true,
+	"extra_filter":     true,
+	"shutdown_timeout": true,
+}
+
+// mergeReload takes the reloadable keys from loaded and keeps the rest from running. Keys
+// that were changed but can't be reloaded are returned.
+func mergeReload(running *honeyPokeConfig, loaded *honeyPokeConfig) (*honeyPokeConfig, []string) {
+	merged := *running
+	mergedValue := reflect.ValueOf(&merged).Elem()
+	loadedValue := reflect.ValueOf(loaded).Elem()
+	configType := mergedValue.Type()
+
+	unapplied := make([]string, 0)
+	for i := 0; i < configType.NumField(); i++ {
+		key := strings.Split(configType.Field(i).Tag.Get("json"), ",")[0]
+		if reloadableKeys[key] {
+			mergedValue.Field(i).Set(loadedValue.Field(i))
+		} else if !reflect.DeepEqual(mergedValue.Field(i).Interface(), loadedValue.Field(i).Interface()) {
+			unapplied = append(unapplied, key)
+		}
+	}
+	return &merged, unapplied
+}
+
+// checkListeners makes sure every port_range and UDP response can be used, since bad ones are
+// fatal at startup
+func checkListeners(config *honeyPokeConfig) error {
+	for _, item := range config.TCPPorts {
+		if item.PortRange != "" {
+			if _, _, err := parsePortRange(item.PortRange); err != nil {
+				return err
+			}
+		}
+	}
+	for _, item := range config.UDPListeners {
+		if item.PortRange != "" {
+			if _, _, err := parsePortRange(item.PortRange); err != nil {
+				return err
+			}
+		}
+		if _, err := udpResponse(item.Response); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffListeners finds the listeners that have to be closed and opened to go from running
+// to loaded. Listeners whose settings changed are in both.
+func diffListeners(running []server.ListenerConfig, loaded []server.ListenerConfig) ([]server.ListenerConfig, []server.ListenerConfig) {
+	runningByName := make(map[string]server.ListenerConfig)
+	for _, listener := range running {
+		runningByName[listener.String()] = listener
+	}
+	loadedByName := make(map[string]server.ListenerConfig)
+	for _, listener := range loaded {
+		loadedByName[listener.String()] = listener
+	}
+
+	removed := make([]server.ListenerConfig, 0)
+	for _, listener := range running {
+		if other, ok := loadedByName[listener.String()]; !ok || !reflect.DeepEqual(listener, other) {
+			removed = append(removed, listener)
+		}
+	}
+	added := make([]server.ListenerConfig, 0)
+	for _, listener := range loaded {
+		if other, ok := runningByName[listener.String()]; !ok || !reflect.DeepEqual(listener, other) {
+			added = append(added, listener)
+		}
+	}
+	return removed, added
+}
+
+// swapListeners opens the added listeners and closes the removed ones. New listeners are
+// bound before anything is closed, only one that needs the address of a removed listener
+// waits for it to close, and gets the old one back if it still can't be opened. Returns the
+// added listeners that couldn't be opened and the removed ones that were opened again.
+func swapListeners(removed []server.ListenerConfig, added []server.ListenerConfig, open func(server.ListenerConfig) error, stop func(server.ListenerConfig) bool) ([]server.ListenerConfig, []server.ListenerConfig) {
+	closed := make(map[string]bool)
+	closeListener := func(listener server.ListenerConfig) {
+		if !closed[listener.String()] {
+			closed[listener.String()] = true
+			if stop(listener) {
+				log.Printf("Closed listener %s\n", listener)
+			}
+		}
+	}
+
+	failed := make([]server.ListenerConfig, 0)
+	restored := make([]server.ListenerConfig, 0)
+	for _, listener := range added {
+		err := open(listener)
+		if err != nil {
+			// Removed listeners on the same port could be in the way
+			blocking := make([]server.ListenerConfig, 0)
+			for _, old := range removed {
+				if old.Protocol == listener.Protocol && old.Port == listener.Port && !closed[old.String()] {
+					blocking = append(blocking, old)
+				}
+			}
+			if len(blocking) > 0 {
+				for _, old := range blocking {
+					closeListener(old)
+				}
+				err = open(listener)
+				if err != nil {
+					for _, old := range blocking {
+						if open(old) == nil {
+							log.Printf("Opened listener %s again\n", old)
+							restored = append(restored, old)
+						}
+					}
+				}
+			}
+		}
+		if err != nil {
+			log.Printf("Could not open listener %s: %s\n", listener, err)
+			failed = append(failed, listener)
+		} else {
+			log.Printf("Opened listener %s\n", listener)
+		}
+	}
+
+	for _, listener := range removed {
+		closeListener(listener)
+	}
+	return failed, restored
+}
+
+// splitPorts gives the ports of an entry that are left when some of its listeners are
+// dropped, or nil if none of them are
+func splitPorts(listeners []server.ListenerConfig, dropped map[string]bool) []uint16 {
+	ports := make([]uint16, 0, len(listeners))
+	split := false
+	for _, listener := range listeners {
+		if dropped[listener.String()] {
+			split = true
+		} else {
+			ports = append(ports, (uint16)(listener.Port))
+		}
+	}
+	if !split {
+		return nil
+	}
+	return ports
+}
+
+// keepOpened makes merged match the listeners that are really open after some couldn't be,
+// so the next reload tries them again. Entries with failed listeners lose those ports, and
+// the entries of restored listeners come back from running for just their port.
+func keepOpened(merged *honeyPokeConfig, running *honeyPokeConfig, failed []server.ListenerConfig, restored []server.ListenerConfig) {
+	dropped := make(map[string]bool)
+	for _, listener := range failed {
+		dropped[listener.String()] = true
+	}
+	kept := make(map[string]bool)
+	for _, listener := range restored {
+		kept[listener.String()] = true
+	}
+
+	tcpPorts := make([]tcpConfig, 0, len(merged.TCPPorts))
+	for _, item := range merged.TCPPorts {
+		ports := splitPorts(tcpListenerConfigs(&honeyPokeConfig{TCPPorts: []tcpConfig{item}}), dropped)
+		if ports == nil {
+			tcpPorts = append(tcpPorts, item)
+		}
+		for _, port := range ports {
+			item.Port, item.PortRange = port, ""
+			tcpPorts = append(tcpPorts, item)
+		}
+	}
+	for _, item := range running.TCPPorts {
+		for _, listener := range tcpListenerConfigs(&honeyPokeConfig{TCPPorts: []tcpConfig{item}}) {
+			if kept[listener.String()] {
+				item.Port, item.PortRange = (uint16)(listener.Port), ""
+				tcpPorts = append(tcpPorts, item)
+			}
+		}
+	}
+	merged.TCPPorts = tcpPorts
+
+	udpPorts := make([]int, 0, len(merged.UDPPorts))
+	for _, port := range merged.UDPPorts {
+		if !dropped[server.ListenerConfig{Protocol: layers.LayerTypeUDP, Port: port}.String()] {
+			udpPorts = append(udpPorts, port)
+		}
+	}
+	for _, port := range running.UDPPorts {
+		if kept[server.ListenerConfig{Protocol: layers.LayerTypeUDP, Port: port}.String()] {
+			udpPorts = append(udpPorts, port)
+		}
+	}
+	merged.UDPPorts = udpPorts
+
+	udpListeners := make([]udpConfig, 0, len(merged.UDPListeners))
+	for _, item := range merged.UDPListeners {
+		ports := splitPorts(udpListenerConfigs(&honeyPokeConfig{UDPListeners: []udpConfig{item}}), dropped)
+		if ports == nil {
+			udpListeners = append(udpListeners, item)
+		}
+		for _, port := range ports {
+			item.Port, item.PortRange = port, ""
+			udpListeners = append(udpListeners, item)
+		}
+	}
+	for _, item := range running.UDPListeners {
+		for _, listener := range udpListenerConfigs(&honeyPokeConfig{UDPListeners: []udpConfig{item}}) {
+			if kept[listener.String()] {
+				item.Port, item.PortRange = (uint16)(listener.Port), ""
+				udpListeners = append(udpListeners, item)
+			}
+		}
+	}
+	merged.UDPListeners = udpListeners
+}
+
+func allListenerConfigs(config *honeyPokeConfig) []server.ListenerConfig {
+	return append(tcpListenerConfigs(config), udpListenerConfigs(config)...)
+}
+
+// reloadConfig re-reads the config file and applies what changed to the running HoneyPoke,
+// returning the config that's now running. Problems with the file leave everything as it was.
+func reloadConfig(running *honeyPokeConfig, recordChan chan *recorder.HoneypokeRecord) *honeyPokeConfig {
+	log.Printf("Reloading %s...\n", configPath)
+
+	loaded, err := parseJSON()
+	if err != nil {
+		log.Printf("Could not reload %s, keeping the running config: %s\n", configPath, err)
+		return running
+	}
+	err = checkListeners(loaded)
+	if err != nil {
+		log.Printf("Could not reload %s, keeping the running config: %s\n", configPath, err)
+		return running
+	}
+
+	merged, unapplied := mergeReload(running, loaded)
+	for _, key := range unapplied {
+		log.Printf("%s changed, restart HoneyPoke to apply it\n", key)
+	}
+
+	changed := false
+	if !reflect.DeepEqual(running.Recorders, merged.Recorders) {
+		recorders, err := newRecorders(merged)
+		if err != nil {
+			log.Printf("Could not create recorders, keeping the running ones: %s\n", err)
+			merged.Recorders = running.Recorders
+		} else {
+			recorder.SetRecorders(recorders)
+			log.Printf("Recorders changed, now recording to %d recorders\n", len(recorders))
+			changed = true
+		}
+	}
+
+	removed, added := diffListeners(allListenerConfigs(running), allListenerConfigs(merged))
+	open := func(listener server.ListenerConfig) error {
+		return server.AddListener(listener, recordChan)
+	}
+	failed, restored := swapListeners(removed, added, open, server.StopListener)
+	if len(failed) > 0 {
+		keepOpened(merged, running, failed, restored)
+	}
+
+	if !reflect.DeepEqual(running.UDPGuard, merged.UDPGuard) {
+		server.ConfigureUDPGuard(time.Duration(merged.UDPGuard.Window)*time.Second, merged.UDPGuard.MaxPackets, merged.UDPGuard.MaxBytes)
+		log.Println("UDP guard limits changed")
+		changed = true
+	}
+
+	if running.ShutdownTimeout != merged.ShutdownTimeout {
+		log.Printf("Shutdown timeout changed to %d seconds\n", merged.ShutdownTimeout)
+		changed = true
+	}
+
+	// The watcher's filter leaves out the listener ports
+	listenersChanged := len(removed) > 0 || len(added) > 0
+	if listenersChanged || !reflect.DeepEqual(running.IgnoreTCPPorts, merged.IgnoreTCPPorts) || running.ExtraFilter != merged.ExtraFilter {
+		err = watcher.Reload(watcherConfig(merged, recordChan))
+		if err != nil {
+			log.Printf("Could not update the watcher, it keeps the running filter: %s\n", err)
+			merged.IgnoreTCPPorts = running.IgnoreTCPPorts
+			merged.ExtraFilter = running.ExtraFilter
+		}
+		changed = true
+	}
+
+	if !changed && len(unapplied) == 0 {
+		log.Println("Nothing changed")
+	} else {
+		log.Println("Reload finished")
+	}
+	return merged
+}
@@ -0,0 +1,311 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package starter
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/bocajspear1/honeypoke-go/internal/server"
+)
+
+func TestCheckListeners(t *testing.T) {
+	tests := []struct {
+		name   string
+		config honeyPokeConfig
+		valid  bool
+	}{
+		{"empty", honeyPokeConfig{}, true},
+		{
+			"good",
+			honeyPokeConfig{
+				TCPPorts:     []tcpConfig{{Port: 80}, {PortRange: "8000-8100"}},
+				UDPListeners: []udpConfig{{PortRange: "5060-5061", Response: `\x00ok`}},
+			},
+			true,
+		},
+		{"bad tcp range", honeyPokeConfig{TCPPorts: []tcpConfig{{PortRange: "8100-8000"}}}, false},
+		{"bad udp range", honeyPokeConfig{UDPListeners: []udpConfig{{PortRange: "0-10"}}}, false},
+		{"bad udp response", honeyPokeConfig{UDPListeners: []udpConfig{{Port: 53, Response: `\z`}}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkListeners(&test.config)
+			if (err == nil) != test.valid {
+				t.Errorf("Got error %v, expected valid to be %v", err, test.valid)
+			}
+		})
+	}
+}
+
+func listenerNames(listeners []server.ListenerConfig) []string {
+	names := make([]string, 0, len(listeners))
+	for _, listener := range listeners {
+		names = append(names, listener.String())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDiffListeners(t *testing.T) {
+	tcp := func(port int) server.ListenerConfig {
+		return server.ListenerConfig{Protocol: layers.LayerTypeTCP, Port: port}
+	}
+	udp := func(port int) server.ListenerConfig {
+		return server.ListenerConfig{Protocol: layers.LayerTypeUDP, Port: port}
+	}
+	renamed := tcp(443)
+	renamed.Name = "web"
+	bound := tcp(22)
+	bound.Bind = "127.0.0.1"
+
+	tests := []struct {
+		name    string
+		running []server.ListenerConfig
+		loaded  []server.ListenerConfig
+		removed []string
+		added   []string
+	}{
+		{"unchanged", []server.ListenerConfig{tcp(22), udp(53)}, []server.ListenerConfig{udp(53), tcp(22)}, []string{}, []string{}},
+		{"added", []server.ListenerConfig{tcp(22)}, []server.ListenerConfig{tcp(22), tcp(23)}, []string{}, []string{"TCP :23"}},
+		{"removed", []server.ListenerConfig{tcp(22), udp(53)}, []server.ListenerConfig{tcp(22)}, []string{"UDP :53"}, []string{}},
+		{"same port other protocol", []server.ListenerConfig{tcp(53)}, []server.ListenerConfig{udp(53)}, []string{"TCP :53"}, []string{"UDP :53"}},
+		{"settings changed", []server.ListenerConfig{tcp(443)}, []server.ListenerConfig{renamed}, []string{"TCP :443"}, []string{"TCP :443"}},
+		{"bind changed", []server.ListenerConfig{tcp(22)}, []server.ListenerConfig{bound}, []string{"TCP :22"}, []string{"TCP 127.0.0.1:22"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			removed, added := diffListeners(test.running, test.loaded)
+			if names := listenerNames(removed); !reflect.DeepEqual(names, test.removed) {
+				t.Errorf("Got removed %v, expected %v", names, test.removed)
+			}
+			if names := listenerNames(added); !reflect.DeepEqual(names, test.added) {
+				t.Errorf("Got added %v, expected %v", names, test.added)
+			}
+		})
+	}
+}
+
+func TestMergeReload(t *testing.T) {
+	running := &honeyPokeConfig{
+		TCPPorts:        []tcpConfig{{Port: 22}},
+		NewUser:         "nobody",
+		ExtraFilter:     "not net 10.0.0.0/8",
+		ShutdownTimeout: 5,
+		Sandbox:         sandboxConfig{Enabled: true, Filesystem: "landlock"},
+	}
+
+	loaded := *running
+	loaded.TCPPorts = []tcpConfig{{Port: 22}, {Port: 23}}
+	loaded.UDPPorts = []int{53}
+	loaded.ExtraFilter = ""
+	loaded.ShutdownTimeout = 10
+	merged, unapplied := mergeReload(running, &loaded)
+	if !reflect.DeepEqual(merged, &loaded) {
+		t.Errorf("Reloadable keys weren't all taken: %+v", merged)
+	}
+	if len(unapplied) != 0 {
+		t.Errorf("Got unapplied keys %v when only reloadable keys changed", unapplied)
+	}
+
+	loaded = *running
+	loaded.UDPPorts = []int{161}
+	loaded.NewUser = "honeypoke"
+	loaded.Sandbox = sandboxConfig{}
+	loaded.Fingerprint = true
+	merged, unapplied = mergeReload(running, &loaded)
+	if !reflect.DeepEqual(merged.UDPPorts, []int{161}) {
+		t.Errorf("udp_ports wasn't reloaded: %v", merged.UDPPorts)
+	}
+	if merged.NewUser != "nobody" || !merged.Sandbox.Enabled || merged.Fingerprint {
+		t.Errorf("Keys that need a restart were changed: %+v", merged)
+	}
+	sort.Strings(unapplied)
+	expected := []string{"passive_fingerprinting", "sandbox", "user"}
+	if !reflect.DeepEqual(unapplied, expected) {
+		t.Errorf("Got unapplied keys %v, expected %v", unapplied, expected)
+	}
+	if running.NewUser != "nobody" || len(running.UDPPorts) != 0 {
+		t.Errorf("The running config was changed: %+v", running)
+	}
+}
+
+// fakePorts opens listeners like the kernel would bind them, a port can only be taken once
+// and some can't be taken at all
+type fakePorts struct {
+	open    map[string]server.ListenerConfig
+	blocked map[int]bool
+	opened  []string
+}
+
+func (ports *fakePorts) portKey(listener server.ListenerConfig) string {
+	return listener.Protocol.String() + " " + strconv.Itoa(listener.Port)
+}
+
+func (ports *fakePorts) listen(listener server.ListenerConfig) error {
+	if ports.blocked[listener.Port] {
+		return errors.New("permission denied")
+	}
+	if _, ok := ports.open[ports.portKey(listener)]; ok {
+		return errors.New("address already in use")
+	}
+	ports.open[ports.portKey(listener)] = listener
+	ports.opened = append(ports.opened, listener.String())
+	return nil
+}
+
+func (ports *fakePorts) stop(listener server.ListenerConfig) bool {
+	if current, ok := ports.open[ports.portKey(listener)]; ok && current.String() == listener.String() {
+		delete(ports.open, ports.portKey(listener))
+		return true
+	}
+	return false
+}
+
+func TestSwapListeners(t *testing.T) {
+	tcp := func(port int, name string) server.ListenerConfig {
+		return server.ListenerConfig{Protocol: layers.LayerTypeTCP, Port: port, Name: name}
+	}
+	bound := tcp(22, "")
+	bound.Bind = "127.0.0.1"
+
+	tests := []struct {
+		name     string
+		running  []server.ListenerConfig
+		loaded   []server.ListenerConfig
+		blocked  map[int]bool
+		open     []string
+		failed   []string
+		restored []string
+	}{
+		{"added", []server.ListenerConfig{tcp(22, "")}, []server.ListenerConfig{tcp(22, ""), tcp(23, "")}, nil, []string{"TCP :22", "TCP :23"}, []string{}, []string{}},
+		{"removed", []server.ListenerConfig{tcp(22, ""), tcp(23, "")}, []server.ListenerConfig{tcp(22, "")}, nil, []string{"TCP :22"}, []string{}, []string{}},
+		{"renamed", []server.ListenerConfig{tcp(443, "")}, []server.ListenerConfig{tcp(443, "web")}, nil, []string{"TCP :443"}, []string{}, []string{}},
+		{"bind changed", []server.ListenerConfig{tcp(22, "")}, []server.ListenerConfig{bound}, nil, []string{"TCP 127.0.0.1:22"}, []string{}, []string{}},
+		{"add failed", []server.ListenerConfig{tcp(22, "")}, []server.ListenerConfig{tcp(22, ""), tcp(23, "")}, map[int]bool{23: true}, []string{"TCP :22"}, []string{"TCP :23"}, []string{}},
+		{"moved failed", []server.ListenerConfig{tcp(22, "")}, []server.ListenerConfig{tcp(23, "")}, map[int]bool{23: true}, []string{}, []string{"TCP :23"}, []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ports := &fakePorts{open: make(map[string]server.ListenerConfig), blocked: test.blocked}
+			for _, listener := range test.running {
+				ports.listen(listener)
+			}
+			removed, added := diffListeners(test.running, test.loaded)
+			failed, restored := swapListeners(removed, added, ports.listen, ports.stop)
+
+			open := make([]server.ListenerConfig, 0, len(ports.open))
+			for _, listener := range ports.open {
+				open = append(open, listener)
+			}
+			if names := listenerNames(open); !reflect.DeepEqual(names, test.open) {
+				t.Errorf("Got open listeners %v, expected %v", names, test.open)
+			}
+			if names := listenerNames(failed); !reflect.DeepEqual(names, test.failed) {
+				t.Errorf("Got failed %v, expected %v", names, test.failed)
+			}
+			if names := listenerNames(restored); !reflect.DeepEqual(names, test.restored) {
+				t.Errorf("Got restored %v, expected %v", names, test.restored)
+			}
+		})
+	}
+}
+
+func TestSwapListenersOrder(t *testing.T) {
+	ports := &fakePorts{open: make(map[string]server.ListenerConfig)}
+	old := server.ListenerConfig{Protocol: layers.LayerTypeTCP, Port: 22}
+	ports.listen(old)
+
+	// The new port is bound while the old one is still open
+	moved := server.ListenerConfig{Protocol: layers.LayerTypeTCP, Port: 2222}
+	stopped := false
+	stop := func(listener server.ListenerConfig) bool {
+		if _, ok := ports.open["TCP 2222"]; !ok {
+			t.Errorf("%s was closed before %s was opened", listener, moved)
+		}
+		stopped = true
+		return ports.stop(listener)
+	}
+	swapListeners([]server.ListenerConfig{old}, []server.ListenerConfig{moved}, ports.listen, stop)
+	if !stopped {
+		t.Errorf("%s wasn't closed", old)
+	}
+}
+
+func TestSwapListenersRestore(t *testing.T) {
+	old := server.ListenerConfig{Protocol: layers.LayerTypeTCP, Port: 443}
+	renamed := old
+	renamed.Name = "web"
+
+	// The old listener is in the way, then the new one can't be opened either
+	tries := 0
+	ports := &fakePorts{open: make(map[string]server.ListenerConfig)}
+	ports.listen(old)
+	listen := func(listener server.ListenerConfig) error {
+		if listener.Name == "web" {
+			tries++
+			if tries > 1 {
+				return errors.New("no certificate")
+			}
+		}
+		return ports.listen(listener)
+	}
+
+	failed, restored := swapListeners([]server.ListenerConfig{old}, []server.ListenerConfig{renamed}, listen, ports.stop)
+	if len(failed) != 1 || failed[0].Name != "web" {
+		t.Errorf("Got failed %v, expected the renamed listener", failed)
+	}
+	if len(restored) != 1 || restored[0].Name != "" {
+		t.Errorf("Got restored %v, expected the old listener", restored)
+	}
+	if current, ok := ports.open["TCP 443"]; !ok || current.Name != "" {
+		t.Errorf("The old listener isn't open again: %+v", ports.open)
+	}
+}
+
+func TestKeepOpened(t *testing.T) {
+	running := &honeyPokeConfig{
+		TCPPorts:     []tcpConfig{{Port: 22}, {Port: 443}},
+		UDPPorts:     []int{53},
+		UDPListeners: []udpConfig{{Port: 5060, Name: "sip"}},
+	}
+	merged := &honeyPokeConfig{
+		TCPPorts:     []tcpConfig{{Port: 22}, {Port: 443, Name: "web"}, {PortRange: "8000-8003", Name: "alt"}},
+		UDPPorts:     []int{53, 161},
+		UDPListeners: []udpConfig{{Port: 5060, Name: "voip"}},
+	}
+	tcp := func(port int, name string) server.ListenerConfig {
+		return server.ListenerConfig{Protocol: layers.LayerTypeTCP, Port: port, Name: name}
+	}
+	udp := func(port int, name string) server.ListenerConfig {
+		return server.ListenerConfig{Protocol: layers.LayerTypeUDP, Port: port, Name: name}
+	}
+	failed := []server.ListenerConfig{tcp(443, "web"), tcp(8001, "alt"), udp(161, ""), udp(5060, "voip")}
+	restored := []server.ListenerConfig{tcp(443, ""), udp(5060, "sip")}
+
+	keepOpened(merged, running, failed, restored)
+	expectedTCP := []tcpConfig{{Port: 22}, {Port: 8000, Name: "alt"}, {Port: 8002, Name: "alt"}, {Port: 8003, Name: "alt"}, {Port: 443}}
+	if !reflect.DeepEqual(merged.TCPPorts, expectedTCP) {
+		t.Errorf("Got TCP ports %+v, expected %+v", merged.TCPPorts, expectedTCP)
+	}
+	if !reflect.DeepEqual(merged.UDPPorts, []int{53}) {
+		t.Errorf("Got UDP ports %v, expected [53]", merged.UDPPorts)
+	}
+	expectedUDP := []udpConfig{{Port: 5060, Name: "sip"}}
+	if !reflect.DeepEqual(merged.UDPListeners, expectedUDP) {
+		t.Errorf("Got UDP listeners %+v, expected %+v", merged.UDPListeners, expectedUDP)
+	}
+
+	// The next reload starts from what's open now
+	expectedOpen := []string{"TCP :22", "TCP :443", "TCP :8000", "TCP :8002", "TCP :8003", "UDP :5060", "UDP :53"}
+	if names := listenerNames(allListenerConfigs(merged)); !reflect.DeepEqual(names, expectedOpen) {
+		t.Errorf("Got listeners %v, expected %v", names, expectedOpen)
+	}
+}
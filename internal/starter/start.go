@@ -5,16 +5,25 @@
 package starter
 
 import (
+	"crypto/x509"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
+	"os/signal"
+	"runtime"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/bocajspear1/honeypoke-go/internal/server"
+	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 
+	"github.com/bocajspear1/honeypoke-go/internal/capture"
 	"github.com/bocajspear1/honeypoke-go/internal/permissions"
 	"github.com/bocajspear1/honeypoke-go/internal/recorder"
 	"github.com/bocajspear1/honeypoke-go/internal/watcher"
@@ -29,18 +38,137 @@ type recorderConfig struct {
 }
 
 type tcpConfig struct {
-	Port uint16 `json:"port"`
-	SSL  bool   `json:"ssl"`
+	Port      uint16 `json:"port"`
+	PortRange string `json:"port_range"`
+	Bind      string `json:"bind"`
+	Name      string `json:"name"`
+	Persona   string `json:"persona"`
+	Proxy     bool   `json:"proxy_protocol"`
+	SSL       bool   `json:"ssl"`
+	AutoSSL   bool   `json:"auto_ssl"`
+	StartTLS  bool   `json:"starttls"`
+	Cert      string `json:"cert"`
+	Key       string `json:"key"`
+}
+
+type udpConfig struct {
+	Port      uint16 `json:"port"`
+	PortRange string `json:"port_range"`
+	Bind      string `json:"bind"`
+	Name      string `json:"name"`
+	Persona   string `json:"persona"`
+	Response  string `json:"response"`
+}
+
+type certConfig struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+type selfSignedConfig struct {
+	CommonName         string   `json:"common_name"`
+	Organization       string   `json:"organization"`
+	OrganizationalUnit string   `json:"organizational_unit"`
+	Country            string   `json:"country"`
+	Province           string   `json:"province"`
+	Locality           string   `json:"locality"`
+	DNSNames           []string `json:"dns_names"`
+	Days               int      `json:"days"`
+}
+
+type udpGuardConfig struct {
+	Window     int `json:"window"`
+	MaxPackets int `json:"max_packets"`
+	MaxBytes   int `json:"max_bytes"`
+}
+
+type catchAllConfig struct {
+	Enabled bool   `json:"enabled"`
+	Port    uint16 `json:"port"`
+	Mode    string `json:"mode"`
+	AutoSSL bool   `json:"auto_ssl"`
+}
+
+type adaptiveConfig struct {
+	Enabled      bool     `json:"enabled"`
+	Threshold    int      `json:"threshold"`
+	Window       int      `json:"window"`
+	MaxListeners int      `json:"max_listeners"`
+	Denylist     []uint16 `json:"denylist"`
+	AutoSSL      bool     `json:"auto_ssl"`
+}
+
+type missedEventsConfig struct {
+	Enabled   bool   `json:"enabled"`
+	Aggregate string `json:"aggregate"`
+	Window    int    `json:"window"`
+}
+
+type scanDetectionConfig struct {
+	Enabled  bool `json:"enabled"`
+	MinPorts int  `json:"min_ports"`
+	MinHosts int  `json:"min_hosts"`
+	Idle     int  `json:"idle"`
+}
+
+type sessionCaptureConfig struct {
+	Enabled bool `json:"enabled"`
+	Minutes int  `json:"minutes"`
+	MaxMB   int  `json:"max_mb"`
+}
+
+type afpacketConfig struct {
+	Enabled bool `json:"enabled"`
+	BlockKB int  `json:"block_kb"`
+	Blocks  int  `json:"blocks"`
+	Workers int  `json:"workers"`
+	Stats   int  `json:"stats_interval"`
+}
+
+type backscatterConfig struct {
+	Enabled bool `json:"enabled"`
+	Window  int  `json:"window"`
+}
+
+type sandboxConfig struct {
+	Enabled    bool     `json:"enabled"`
+	Filesystem string   `json:"filesystem"`
+	ReadOnly   []string `json:"read_only"`
+	Writable   []string `json:"writable"`
+	Seccomp    bool     `json:"seccomp"`
 }
 
 type honeyPokeConfig struct {
-	Recorders      []recorderConfig `json:"recorders"`
-	UDPPorts       []int            `json:"udp_ports"`
-	TCPPorts       []tcpConfig      `json:"tcp_ports"`
-	IgnoreTCPPorts []uint16         `json:"ignore_tcp_ports"`
-	NewUser        string           `json:"user"`
-	NewGroup       string           `json:"group"`
-	Interface      string           `json:"interface"`
+	Recorders      []recorderConfig     `json:"recorders"`
+	UDPPorts       []int                `json:"udp_ports"`
+	UDPListeners   []udpConfig          `json:"udp_listeners"`
+	TCPPorts       []tcpConfig          `json:"tcp_ports"`
+	IgnoreTCPPorts []uint16             `json:"ignore_tcp_ports"`
+	NewUser        string               `json:"user"`
+	NewGroup       string               `json:"group"`
+	Interface      string               `json:"interface"`
+	Interfaces     []string             `json:"interfaces"`
+	UDPGuard       udpGuardConfig       `json:"udp_guard"`
+	Certificates   []certConfig         `json:"certificates"`
+	SelfSigned     selfSignedConfig     `json:"self_signed"`
+	CatchAll       catchAllConfig       `json:"catch_all"`
+	Adaptive       adaptiveConfig       `json:"adaptive"`
+	MissedDB       string               `json:"missed_db"`
+	MissedEvents   missedEventsConfig   `json:"missed_events"`
+	ScanDetection  scanDetectionConfig  `json:"scan_detection"`
+	Fingerprint    bool                 `json:"passive_fingerprinting"`
+	SessionCapture sessionCaptureConfig `json:"session_capture"`
+	Backscatter    backscatterConfig    `json:"backscatter"`
+	AFPacket       afpacketConfig       `json:"afpacket"`
+	ExtraFilter    string               `json:"extra_filter"`
+	// Seconds to wait for open connections when shutting down
+	ShutdownTimeout int `json:"shutdown_timeout"`
+	// Keep a root helper around for binding privileged ports after startup
+	BindHelper bool `json:"bind_helper"`
+	// Run as user and group with only the capabilities to bind ports and capture
+	Capabilities bool `json:"capabilities"`
+	// Lock HoneyPoke down once it's running
+	Sandbox sandboxConfig `json:"sandbox"`
 }
 
 func waitForSetup(newUser string, newGroup string, contChan chan bool, serverCount int) {
@@ -51,6 +179,208 @@ func waitForSetup(newUser string, newGroup string, contChan chan bool, serverCou
 	permissions.DropPermissions(newUser, newGroup)
 }
 
+func loadCertificates(config *honeyPokeConfig) {
+	needed := (config.CatchAll.Enabled && config.CatchAll.AutoSSL) || (config.Adaptive.Enabled && config.Adaptive.AutoSSL)
+	for _, item := range config.TCPPorts {
+		if item.SSL || item.AutoSSL || item.StartTLS {
+			needed = true
+		}
+	}
+	if !needed {
+		return
+	}
+
+	pairs := make([]server.CertificatePair, 0)
+	for _, item := range config.Certificates {
+		pairs = append(pairs, server.CertificatePair{CertPath: item.Cert, KeyPath: item.Key})
+	}
+
+	subject := server.CertificateSubject{
+		CommonName:         config.SelfSigned.CommonName,
+		Organization:       config.SelfSigned.Organization,
+		OrganizationalUnit: config.SelfSigned.OrganizationalUnit,
+		Country:            config.SelfSigned.Country,
+		Province:           config.SelfSigned.Province,
+		Locality:           config.SelfSigned.Locality,
+		DNSNames:           config.SelfSigned.DNSNames,
+		Days:               config.SelfSigned.Days,
+	}
+
+	err := server.LoadCertificates(pairs, subject)
+	if err != nil {
+		log.Fatalf("Could not load certificates: %s\n", err)
+	}
+
+	// Listeners with their own certificates load them when they're opened, in the sandbox
+	// where they can't be generated
+	for _, listener := range tcpListenerConfigs(config) {
+		if listener.TLSMode != server.TLSOff && listener.Cert != nil {
+			err = server.EnsureCertificate(*listener.Cert)
+			if err != nil {
+				log.Fatalf("Could not generate certificate %s: %s\n", listener.Cert.CertPath, err)
+			}
+		}
+	}
+}
+
+func newAdaptiveConfig(config *honeyPokeConfig, recordChan chan *recorder.HoneypokeRecord) watcher.AdaptiveConfig {
+	tlsMode := server.TLSOff
+	if config.Adaptive.AutoSSL {
+		tlsMode = server.TLSAuto
+	}
+
+	adaptive := watcher.AdaptiveConfig{
+		Enabled:      config.Adaptive.Enabled,
+		Threshold:    config.Adaptive.Threshold,
+		Window:       time.Duration(config.Adaptive.Window) * time.Second,
+		MaxListeners: config.Adaptive.MaxListeners,
+		Denylist:     config.Adaptive.Denylist,
+		Spawn: func(protocol gopacket.LayerType, port uint16, reason string) error {
+			listenerConfig := server.ListenerConfig{Protocol: protocol, Port: (int)(port)}
+			if protocol == layers.LayerTypeTCP {
+				listenerConfig.TLSMode = tlsMode
+			}
+			return server.StartDynamicServer(listenerConfig, reason, recordChan)
+		},
+	}
+
+	if adaptive.Threshold <= 0 {
+		adaptive.Threshold = 50
+	}
+	if adaptive.Window <= 0 {
+		adaptive.Window = time.Hour
+	}
+	if adaptive.MaxListeners <= 0 {
+		adaptive.MaxListeners = 10
+	}
+
+	return adaptive
+}
+
+func newEventConfig(config *honeyPokeConfig, recordChan chan *recorder.HoneypokeRecord) watcher.EventConfig {
+	events := watcher.EventConfig{
+		Enabled:   config.MissedEvents.Enabled,
+		Aggregate: config.MissedEvents.Aggregate,
+		Window:    time.Duration(config.MissedEvents.Window) * time.Second,
+		RecChan:   recordChan,
+	}
+
+	if events.Aggregate == "" {
+		events.Aggregate = watcher.AggregateSource
+	} else if events.Aggregate != watcher.AggregateNone && events.Aggregate != watcher.AggregateSource && events.Aggregate != watcher.AggregatePort {
+		log.Fatalf("Invalid missed event aggregation %s\n", events.Aggregate)
+	}
+	if events.Window <= 0 {
+		events.Window = 5 * time.Minute
+	}
+
+	return events
+}
+
+func newScanConfig(config *honeyPokeConfig, recordChan chan *recorder.HoneypokeRecord) watcher.ScanConfig {
+	scans := watcher.ScanConfig{
+		Enabled:  config.ScanDetection.Enabled,
+		MinPorts: config.ScanDetection.MinPorts,
+		MinHosts: config.ScanDetection.MinHosts,
+		Idle:     time.Duration(config.ScanDetection.Idle) * time.Second,
+		RecChan:  recordChan,
+	}
+
+	if scans.MinPorts <= 0 {
+		scans.MinPorts = 10
+	}
+	if scans.MinHosts <= 0 {
+		scans.MinHosts = 3
+	}
+	if scans.Idle <= 0 {
+		scans.Idle = time.Minute
+	}
+
+	return scans
+}
+
+func missedPath(config *honeyPokeConfig) string {
+	if config.MissedDB == "" {
+		return watcher.DefaultMissedDB
+	}
+	return config.MissedDB
+}
+
+// ImportMissed adds the counts from a legacy missed.txt file to the missed port database
+func ImportMissed(legacyPath string) {
+	config, cerr := parseJSON()
+	if cerr != nil {
+		log.Fatalln(cerr)
+	}
+
+	store, err := watcher.OpenMissedStore(missedPath(config))
+	if err != nil {
+		log.Fatalf("Could not open missed port database: %s\n", err)
+	}
+	defer store.Close()
+
+	err = store.ImportLegacy(legacyPath)
+	if err != nil {
+		log.Fatalf("Could not import %s: %s\n", legacyPath, err)
+	}
+	log.Printf("Imported %s into %s\n", legacyPath, missedPath(config))
+}
+
+// ExportMissed writes the missed port database in the legacy missed.txt format
+func ExportMissed(legacyPath string) {
+	config, cerr := parseJSON()
+	if cerr != nil {
+		log.Fatalln(cerr)
+	}
+
+	store, err := watcher.OpenMissedStore(missedPath(config))
+	if err != nil {
+		log.Fatalf("Could not open missed port database: %s\n", err)
+	}
+	defer store.Close()
+
+	err = store.ExportLegacy(legacyPath)
+	if err != nil {
+		log.Fatalf("Could not export to %s: %s\n", legacyPath, err)
+	}
+	log.Printf("Exported %s to %s\n", missedPath(config), legacyPath)
+}
+
+// ShowMissed prints the most missed ports and their daily counts
+func ShowMissed(count int) {
+	config, cerr := parseJSON()
+	if cerr != nil {
+		log.Fatalln(cerr)
+	}
+
+	store, err := watcher.OpenMissedStore(missedPath(config))
+	if err != nil {
+		log.Fatalf("Could not open missed port database: %s\n", err)
+	}
+	defer store.Close()
+
+	ports, err := store.Ports()
+	if err != nil {
+		log.Fatalf("Could not read missed port database: %s\n", err)
+	}
+
+	fmt.Printf("%-8s %-6s %10s %8s  %-20s %-20s\n", "PROTOCOL", "PORT", "COUNT", "SOURCES", "FIRST SEEN", "LAST SEEN")
+	for i, stat := range ports {
+		if i >= count {
+			break
+		}
+		first := "unknown"
+		if !stat.FirstSeen.IsZero() {
+			first = stat.FirstSeen.Format(time.RFC3339)
+		}
+		last := "unknown"
+		if !stat.LastSeen.IsZero() {
+			last = stat.LastSeen.Format(time.RFC3339)
+		}
+		fmt.Printf("%-8s %-6d %10d %8d  %-20s %-20s\n", stat.Protocol, stat.Port, stat.Count, stat.Sources, first, last)
+	}
+}
+
 func parseJSON() (*honeyPokeConfig, error) {
 	configFile, ferr := ioutil.ReadFile(configPath)
 	if ferr != nil {
@@ -66,86 +396,460 @@ func parseJSON() (*honeyPokeConfig, error) {
 	return &config, nil
 }
 
-// StartHoneyPoke starts HoneyPoke and all the servers and recorders
-func StartHoneyPoke() {
-
-	config, cerr := parseJSON()
-	if cerr != nil {
-		log.Fatalln(cerr)
-		return
-	}
-
-	// Make our communication channels
-	recordChan := make(chan *recorder.HoneypokeRecord)
-	contChan := make(chan bool)
-
+// newRecorders creates the enabled recorders
+func newRecorders(config *honeyPokeConfig) ([]recorder.HoneypokeRecorder, error) {
 	if len(config.Recorders) == 0 {
-		log.Fatalln("No recorders in config file")
+		return nil, errors.New("No recorders in config file")
 	}
 
 	recoderList := make([]recorder.HoneypokeRecorder, 0)
 
-	// Start the recorders routine
 	for _, recorderData := range config.Recorders {
+		var newRecorder recorder.HoneypokeRecorder
+		var err error
 		if recorderData.RecorderName == "elasticsearch6" && recorderData.Enabled == true {
-			recoderList = append(recoderList, recorder.NewElastic6Recorder(recorderData.RecorderConfig))
+			newRecorder, err = recorder.NewElastic6Recorder(recorderData.RecorderConfig)
 		} else if recorderData.RecorderName == "elasticsearch7" && recorderData.Enabled == true {
-			recoderList = append(recoderList, recorder.NewElastic7Recorder(recorderData.RecorderConfig))
+			newRecorder, err = recorder.NewElastic7Recorder(recorderData.RecorderConfig)
 		} else if recorderData.RecorderName == "elasticsearch8" && recorderData.Enabled == true {
-			recoderList = append(recoderList, recorder.NewElastic8Recorder(recorderData.RecorderConfig))
+			newRecorder, err = recorder.NewElastic8Recorder(recorderData.RecorderConfig)
 		} else {
 			log.Printf("Invalid name %s\n", recorderData.RecorderName)
+			continue
 		}
+		if err != nil {
+			return nil, err
+		}
+		recoderList = append(recoderList, newRecorder)
 	}
 
 	if len(recoderList) == 0 {
-		log.Fatalln("No recorders configured")
+		return nil, errors.New("No recorders configured")
 	}
 
-	recorder.StartRecorders(recoderList, recordChan)
+	return recoderList, nil
+}
 
-	serverCount := 0
+// startRecorders starts the recorders routine for the enabled recorders
+func startRecorders(config *honeyPokeConfig, recordChan chan *recorder.HoneypokeRecord) {
+	recoderList, err := newRecorders(config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	recorder.StartRecorders(recoderList, recordChan)
+}
 
+// missedFilter builds the watcher's filter, which leaves out every port something is
+// listening on, and returns the TCP ports that were left out
+func missedFilter(config *honeyPokeConfig) (string, []uint16) {
 	pcapFilter := ""
+	excludedTCPPorts := make([]uint16, 0)
 
+	tcpPorts := make([]uint16, 0)
 	// Add the TCP ignores
-	for _, item := range config.IgnoreTCPPorts {
-		if pcapFilter != "" {
-			pcapFilter += " and not tcp port " + strconv.Itoa((int)(item))
-		} else {
-			pcapFilter = "not tcp port " + strconv.Itoa((int)(item))
+	tcpPorts = append(tcpPorts, config.IgnoreTCPPorts...)
+	tcpPorts = append(tcpPorts, listenerPorts(tcpListenerConfigs(config))...)
+	if config.CatchAll.Enabled {
+		tcpPorts = append(tcpPorts, config.CatchAll.Port)
+	}
+
+	excludedTCPPorts = append(excludedTCPPorts, tcpPorts...)
+
+	udpPorts := listenerPorts(udpListenerConfigs(config))
+
+	listening := watcher.PortFilter("tcp", tcpPorts)
+	if udpFilter := watcher.PortFilter("udp", udpPorts); udpFilter != "" {
+		if listening != "" {
+			listening += " or "
 		}
+		listening += udpFilter
+	}
+	if listening != "" {
+		pcapFilter = "not (" + listening + ")"
 	}
 
-	// Start the TCP servers
+	return pcapFilter, excludedTCPPorts
+}
+
+// parsePortRange gets the first and last port of a port_range, like 8000-8100
+func parsePortRange(portRange string) (uint64, uint64, error) {
+	bounds := strings.SplitN(portRange, "-", 2)
+	first, ferr := strconv.ParseUint(strings.TrimSpace(bounds[0]), 10, 16)
+	last := first
+	var lerr error
+	if len(bounds) == 2 {
+		last, lerr = strconv.ParseUint(strings.TrimSpace(bounds[1]), 10, 16)
+	}
+	if ferr != nil || lerr != nil || first == 0 || last < first {
+		return 0, 0, fmt.Errorf("Invalid port range %s", portRange)
+	}
+	return first, last, nil
+}
+
+// listenerPortList gets the ports for a listener entry, either its port or every port
+// in its port_range
+func listenerPortList(port uint16, portRange string) []uint16 {
+	if portRange == "" {
+		return []uint16{port}
+	}
+
+	first, last, err := parsePortRange(portRange)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	ports := make([]uint16, 0, last-first+1)
+	for port := first; port <= last; port++ {
+		ports = append(ports, (uint16)(port))
+	}
+	return ports
+}
+
+// listenerPorts lists the ports of some listeners, each only once
+func listenerPorts(listeners []server.ListenerConfig) []uint16 {
+	seen := make(map[int]bool)
+	ports := make([]uint16, 0, len(listeners))
+	for _, listener := range listeners {
+		if !seen[listener.Port] {
+			seen[listener.Port] = true
+			ports = append(ports, (uint16)(listener.Port))
+		}
+	}
+	return ports
+}
+
+// tcpListenerConfigs turns the configured TCP ports into listener configs
+func tcpListenerConfigs(config *honeyPokeConfig) []server.ListenerConfig {
+	listeners := make([]server.ListenerConfig, 0, len(config.TCPPorts))
 	for _, item := range config.TCPPorts {
-		if pcapFilter != "" {
-			pcapFilter += " and not tcp port " + strconv.Itoa((int)(item.Port))
-		} else {
-			pcapFilter = "not tcp port " + strconv.Itoa((int)(item.Port))
+		tlsMode := server.TLSOff
+		if item.StartTLS {
+			tlsMode = server.TLSStartTLS
+		} else if item.AutoSSL {
+			tlsMode = server.TLSAuto
+		} else if item.SSL {
+			tlsMode = server.TLSOn
+		}
+		for _, port := range listenerPortList(item.Port, item.PortRange) {
+			listenerConfig := server.ListenerConfig{
+				Protocol:      layers.LayerTypeTCP,
+				Port:          (int)(port),
+				TLSMode:       tlsMode,
+				Bind:          item.Bind,
+				Name:          item.Name,
+				Persona:       item.Persona,
+				ProxyProtocol: item.Proxy,
+			}
+			if item.Cert != "" && item.Key != "" {
+				listenerConfig.Cert = &server.CertificatePair{CertPath: item.Cert, KeyPath: item.Key}
+			}
+			listeners = append(listeners, listenerConfig)
+		}
+	}
+	return listeners
+}
+
+// udpResponse unescapes a UDP listener's response, which is written the same way inputs are recorded
+func udpResponse(response string) (string, error) {
+	if response == "" {
+		return "", nil
+	}
+	unescaped, err := strconv.Unquote("\"" + response + "\"")
+	if err != nil {
+		return "", fmt.Errorf("Invalid UDP response %q: %s", response, err)
+	}
+	return unescaped, nil
+}
+
+// udpListenerConfigs turns udp_ports and udp_listeners into listener configs
+func udpListenerConfigs(config *honeyPokeConfig) []server.ListenerConfig {
+	listeners := make([]server.ListenerConfig, 0, len(config.UDPPorts)+len(config.UDPListeners))
+	for _, port := range config.UDPPorts {
+		listeners = append(listeners, server.ListenerConfig{Protocol: layers.LayerTypeUDP, Port: port})
+	}
+	for _, item := range config.UDPListeners {
+		response, err := udpResponse(item.Response)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		for _, port := range listenerPortList(item.Port, item.PortRange) {
+			listeners = append(listeners, server.ListenerConfig{
+				Protocol: layers.LayerTypeUDP,
+				Port:     (int)(port),
+				Bind:     item.Bind,
+				Name:     item.Name,
+				Persona:  item.Persona,
+				Response: response,
+			})
+		}
+	}
+	return listeners
+}
+
+func watcherConfig(config *honeyPokeConfig, recordChan chan *recorder.HoneypokeRecord) watcher.Config {
+	pcapFilter, excludedTCPPorts := missedFilter(config)
+	sessionPorts := listenerPorts(tcpListenerConfigs(config))
+	udpPorts := listenerPorts(udpListenerConfigs(config))
+	// interfaces replaces interface, but the old key still works
+	interfaces := config.Interfaces
+	if len(interfaces) == 0 {
+		interfaces = []string{config.Interface}
+	}
+	return watcher.Config{
+		Interfaces: interfaces,
+		Filter:     pcapFilter,
+		MissedPath: missedPath(config),
+		Adaptive:   newAdaptiveConfig(config, recordChan),
+		Events:     newEventConfig(config, recordChan),
+		Scans:      newScanConfig(config, recordChan),
+
+		ExcludedTCPPorts: excludedTCPPorts,
+		Fingerprint:      config.Fingerprint,
+		Capture:          config.SessionCapture.Enabled,
+		SessionPorts:     sessionPorts,
+		UDPPorts:         udpPorts,
+		Backscatter:      newBackscatterConfig(config, recordChan),
+		AFPacket:         newAFPacketConfig(config),
+		ExtraFilter:      config.ExtraFilter,
+	}
+}
+
+func newBackscatterConfig(config *honeyPokeConfig, recordChan chan *recorder.HoneypokeRecord) watcher.BackscatterConfig {
+	backscatter := watcher.BackscatterConfig{
+		Enabled: config.Backscatter.Enabled,
+		Window:  time.Duration(config.Backscatter.Window) * time.Second,
+		RecChan: recordChan,
+	}
+	if backscatter.Window <= 0 {
+		backscatter.Window = 5 * time.Minute
+	}
+	return backscatter
+}
+
+func newAFPacketConfig(config *honeyPokeConfig) watcher.AFPacketConfig {
+	afpacketConfig := watcher.AFPacketConfig{
+		Enabled:       config.AFPacket.Enabled,
+		BlockSize:     config.AFPacket.BlockKB * 1024,
+		NumBlocks:     config.AFPacket.Blocks,
+		Workers:       config.AFPacket.Workers,
+		StatsInterval: time.Duration(config.AFPacket.Stats) * time.Second,
+	}
+	if afpacketConfig.BlockSize <= 0 {
+		afpacketConfig.BlockSize = 1024 * 1024
+	}
+	if afpacketConfig.NumBlocks <= 0 {
+		afpacketConfig.NumBlocks = 64
+	}
+	if afpacketConfig.Workers <= 0 {
+		afpacketConfig.Workers = runtime.NumCPU()
+	}
+	if afpacketConfig.StatsInterval <= 0 {
+		afpacketConfig.StatsInterval = 5 * time.Minute
+	}
+	return afpacketConfig
+}
+
+func newCaptureConfig(config *honeyPokeConfig) capture.Config {
+	captureConfig := capture.Config{
+		Enabled:   config.SessionCapture.Enabled,
+		Retention: time.Duration(config.SessionCapture.Minutes) * time.Minute,
+		MaxBytes:  config.SessionCapture.MaxMB * 1024 * 1024,
+	}
+	if captureConfig.Retention <= 0 {
+		captureConfig.Retention = 5 * time.Minute
+	}
+	if captureConfig.MaxBytes <= 0 {
+		captureConfig.MaxBytes = 64 * 1024 * 1024
+	}
+	return captureConfig
+}
+
+// ReplayCapture feeds a capture file through the watcher instead of a live interface, sending
+// the records to the recorders as usual. With listeners set, TCP streams to the configured TCP
+// ports are also passed through their handlers.
+func ReplayCapture(capturePath string, listeners bool) {
+	config, cerr := parseJSON()
+	if cerr != nil {
+		log.Fatalln(cerr)
+		return
+	}
+
+	recordChan := make(chan *recorder.HoneypokeRecord)
+	startRecorders(config, recordChan)
+
+	var streamPorts []uint16
+	var streams watcher.StreamFunc
+	if listeners {
+		loadCertificates(config)
+		replayer, err := server.NewReplayer(tcpListenerConfigs(config), recordChan)
+		if err != nil {
+			log.Fatalf("Could not set up listeners for replay: %s\n", err)
+		}
+		streamPorts = replayer.Ports()
+		streams = replayer.Stream
+	}
+
+	err := watcher.Replay(watcherConfig(config, recordChan), capturePath, streamPorts, streams)
+	if err != nil {
+		log.Fatalf("Could not replay %s: %s\n", capturePath, err)
+	}
+
+	// Make sure everything made it to the recorders before exiting
+	recorder.StopRecorders()
+}
+
+// Long enough for most sessions to finish, and well under systemd's default stop timeout
+const defaultShutdownTimeout = 20
+
+// shutdown stops everything that sends records, then waits for the recorders to catch up
+func shutdown(config *honeyPokeConfig) {
+	started := time.Now()
+	timeout := config.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+
+	stats := server.Shutdown(time.Duration(timeout) * time.Second)
+	// Stopped after the listeners so the last sessions still make it into the capture
+	watcher.StopWatcher()
+
+	// Abandoned handlers could still send records, they just won't be received
+	records := recorder.StopRecorders()
+	if stats.Abandoned > 0 {
+		log.Printf("%d connections were still being handled, their records are lost\n", stats.Abandoned)
+	}
+	log.Printf("Shut down in %s: closed %d listeners, %d connections finished, %d cut off, %d records sent\n", time.Since(started), stats.Listeners, stats.Drained, stats.Cut, records)
+}
+
+// sandboxWritable lists what HoneyPoke writes to, which is all the sandbox lets it write. The
+// missed port database is created first since Landlock can only allow files that exist, and
+// directories that don't exist aren't written to anyway.
+func sandboxWritable(config *honeyPokeConfig) []string {
+	writable := make([]string, 0, 3)
+
+	directories := []string{server.LargeDirectory}
+	if config.SessionCapture.Enabled {
+		directories = append(directories, capture.SessionDirectory)
+	}
+	for _, directory := range directories {
+		if _, err := os.Stat(directory); err == nil {
+			writable = append(writable, directory)
 		}
-		server.StartServer(layers.LayerTypeTCP, (int)(item.Port), item.SSL, recordChan, contChan)
+	}
+
+	db, err := os.OpenFile(missedPath(config), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		log.Fatalf("Could not create the missed port database: %s\n", err)
+	}
+	db.Close()
+	return append(writable, missedPath(config))
+}
+
+// RunBindHelper runs the bind helper if that's what this process was started as, returning
+// if it was
+func RunBindHelper() bool {
+	if !server.IsBindHelper() {
+		return false
+	}
+	server.RunBindHelper()
+	return true
+}
+
+// StartHoneyPoke starts HoneyPoke and all the servers and recorders
+func StartHoneyPoke() {
+
+	config, cerr := parseJSON()
+	if cerr != nil {
+		log.Fatalln(cerr)
+		return
+	}
+
+	// These have to be before anything is opened, since they can start HoneyPoke over. Missing
+	// certificates are made in between, as capability mode's user and before the sandbox.
+	if config.Capabilities {
+		permissions.EnterCapabilityMode(config.NewUser, config.NewGroup)
+	}
+	loadCertificates(config)
+	if config.Sandbox.Enabled {
+		err := permissions.EnterSandbox(permissions.SandboxConfig{
+			Filesystem: config.Sandbox.Filesystem,
+			ReadOnly:   config.Sandbox.ReadOnly,
+			Writable:   append(sandboxWritable(config), config.Sandbox.Writable...),
+			Seccomp:    config.Sandbox.Seccomp,
+		})
+		if err != nil {
+			log.Fatalf("Could not set up the sandbox: %s\n", err)
+		}
+	}
+
+	// Make our communication channels
+	recordChan := make(chan *recorder.HoneypokeRecord)
+	contChan := make(chan bool)
+
+	startRecorders(config, recordChan)
+
+	serverCount := 0
+
+	capture.Configure(newCaptureConfig(config))
+
+	// Start the TCP servers
+	for _, listenerConfig := range tcpListenerConfigs(config) {
+		server.StartServer(listenerConfig, recordChan, contChan)
 		serverCount++
 	}
 
-	// Start the UDP servers
-	for _, udpPort := range config.UDPPorts {
-		if pcapFilter != "" {
-			pcapFilter += " and not udp port " + strconv.Itoa((int)(udpPort))
-		} else {
-			pcapFilter = "not udp port " + strconv.Itoa((int)(udpPort))
+	// Start the catch-all server for connections redirected from other ports
+	if config.CatchAll.Enabled {
+		tlsMode := server.TLSOff
+		if config.CatchAll.AutoSSL {
+			tlsMode = server.TLSAuto
 		}
-		server.StartServer(layers.LayerTypeUDP, (int)(udpPort), false, recordChan, contChan)
+		server.StartCatchAll((int)(config.CatchAll.Port), config.CatchAll.Mode, tlsMode, recordChan, contChan)
+		serverCount++
+	}
+
+	server.ConfigureUDPGuard(time.Duration(config.UDPGuard.Window)*time.Second, config.UDPGuard.MaxPackets, config.UDPGuard.MaxBytes)
+
+	// Start the UDP servers
+	for _, listenerConfig := range udpListenerConfigs(config) {
+		server.StartServer(listenerConfig, recordChan, contChan)
 		serverCount++
 	}
 
 	// Start the missed port watching routine
-	watcher.StartWatcher(config.Interface, pcapFilter, contChan)
+	watcher.StartWatcher(watcherConfig(config, recordChan), contChan)
+
+	// Has to be started while we're still root
+	if config.BindHelper && config.Capabilities {
+		log.Println("Not starting the bind helper, capability mode can bind privileged ports")
+	} else if config.BindHelper {
+		err := server.StartBindHelper()
+		if err != nil {
+			log.Fatalf("Could not start bind helper: %s\n", err)
+		}
+	}
+
+	if config.Sandbox.Enabled {
+		// Loaded the first time a recorder checks a certificate, which could be after the chroot
+		x509.SystemCertPool()
+	}
 
 	// Wait for everybody to report they are running
 	waitForSetup(config.NewUser, config.NewGroup, contChan, serverCount)
 
-	for {
-		time.Sleep(time.Second * 10)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	for received := range signals {
+		if received == syscall.SIGHUP {
+			config = reloadConfig(config, recordChan)
+			continue
+		}
+		log.Printf("Got %s, shutting down...\n", received)
+		break
 	}
+
+	// A second signal skips the wait
+	signal.Stop(signals)
+	shutdown(config)
 }
@@ -0,0 +1,128 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package starter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		portRange string
+		first     uint64
+		last      uint64
+		valid     bool
+	}{
+		{"8000-8100", 8000, 8100, true},
+		{" 8000 - 8100 ", 8000, 8100, true},
+		{"22", 22, 22, true},
+		{"22-22", 22, 22, true},
+		{"1-65535", 1, 65535, true},
+		{"0-10", 0, 0, false},
+		{"100-99", 0, 0, false},
+		{"1-65536", 0, 0, false},
+		{"80-", 0, 0, false},
+		{"-80", 0, 0, false},
+		{"80-90-100", 0, 0, false},
+		{"http", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.portRange, func(t *testing.T) {
+			first, last, err := parsePortRange(test.portRange)
+			if (err == nil) != test.valid {
+				t.Fatalf("Got error %v, expected valid to be %v", err, test.valid)
+			}
+			if first != test.first || last != test.last {
+				t.Errorf("Got %d-%d, expected %d-%d", first, last, test.first, test.last)
+			}
+		})
+	}
+}
+
+func TestListenerPortList(t *testing.T) {
+	if ports := listenerPortList(22, ""); !reflect.DeepEqual(ports, []uint16{22}) {
+		t.Errorf("Got %v for a single port", ports)
+	}
+	if ports := listenerPortList(0, "8000-8003"); !reflect.DeepEqual(ports, []uint16{8000, 8001, 8002, 8003}) {
+		t.Errorf("Got %v for a port range", ports)
+	}
+}
+
+func TestMissedFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   honeyPokeConfig
+		filter   string
+		excluded []uint16
+	}{
+		{"nothing listening", honeyPokeConfig{}, "", []uint16{}},
+		{
+			"tcp and udp",
+			honeyPokeConfig{
+				TCPPorts:       []tcpConfig{{Port: 80}, {Port: 443}, {Port: 81}},
+				IgnoreTCPPorts: []uint16{22},
+				UDPPorts:       []int{53},
+				UDPListeners:   []udpConfig{{PortRange: "5060-5061"}},
+			},
+			"not (tcp port 22 or tcp portrange 80-81 or tcp port 443 or udp port 53 or udp portrange 5060-5061)",
+			[]uint16{22, 80, 443, 81},
+		},
+		{
+			"port range and catch all",
+			honeyPokeConfig{
+				TCPPorts: []tcpConfig{{PortRange: "8000-8002"}, {Port: 8001, Bind: "127.0.0.1"}},
+				CatchAll: catchAllConfig{Enabled: true, Port: 9999},
+			},
+			"not (tcp portrange 8000-8002 or tcp port 9999)",
+			[]uint16{8000, 8001, 8002, 9999},
+		},
+		{
+			"udp only",
+			honeyPokeConfig{UDPPorts: []int{161, 162}},
+			"not (udp portrange 161-162)",
+			[]uint16{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, excluded := missedFilter(&test.config)
+			if filter != test.filter {
+				t.Errorf("Got filter %q, expected %q", filter, test.filter)
+			}
+			if !reflect.DeepEqual(excluded, test.excluded) {
+				t.Errorf("Got excluded ports %v, expected %v", excluded, test.excluded)
+			}
+		})
+	}
+}
+
+func TestUDPResponse(t *testing.T) {
+	tests := []struct {
+		response string
+		expected string
+		valid    bool
+	}{
+		{"", "", true},
+		{"hello", "hello", true},
+		{`\x00\x01ok\r\n`, "\x00\x01ok\r\n", true},
+		{`say \"hi\"`, `say "hi"`, true},
+		{`\q`, "", false},
+		{`trailing \`, "", false},
+		{`"`, "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.response, func(t *testing.T) {
+			response, err := udpResponse(test.response)
+			if (err == nil) != test.valid {
+				t.Fatalf("Got error %v, expected valid to be %v", err, test.valid)
+			}
+			if response != test.expected {
+				t.Errorf("Got %q, expected %q", response, test.expected)
+			}
+		})
+	}
+}
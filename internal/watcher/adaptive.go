@@ -0,0 +1,123 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package watcher
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// SpawnFunc opens a listener on a port that keeps getting missed traffic
+type SpawnFunc func(protocol gopacket.LayerType, port uint16, reason string) error
+
+// AdaptiveConfig controls opening listeners on ports that get a lot of missed traffic
+type AdaptiveConfig struct {
+	Enabled      bool
+	Threshold    int
+	Window       time.Duration
+	MaxListeners int
+	Denylist     []uint16
+	Spawn        SpawnFunc
+}
+
+type portKey struct {
+	protocol gopacket.LayerType
+	port     uint16
+}
+
+type portWindow struct {
+	start time.Time
+	count int
+}
+
+// adaptiveTracker counts hits on ports without a listener and opens one once
+// a port goes over the threshold inside the window
+type adaptiveTracker struct {
+	config    AdaptiveConfig
+	lock      sync.Mutex
+	denied    map[uint16]bool
+	windows   map[portKey]*portWindow
+	attempted map[portKey]bool
+	served    map[portKey]bool
+	// Listeners still being opened, which count towards MaxListeners
+	spawning int
+}
+
+func newAdaptiveTracker(config AdaptiveConfig) *adaptiveTracker {
+	tracker := &adaptiveTracker{
+		config:    config,
+		denied:    make(map[uint16]bool),
+		windows:   make(map[portKey]*portWindow),
+		attempted: make(map[portKey]bool),
+		served:    make(map[portKey]bool),
+	}
+	for _, port := range config.Denylist {
+		tracker.denied[port] = true
+	}
+	return tracker
+}
+
+// isServed checks if a listener was opened on the port, so it's no longer missed
+func (a *adaptiveTracker) isServed(protocol gopacket.LayerType, port uint16) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.served[portKey{protocol: protocol, port: port}]
+}
+
+// observe counts a hit on a port and opens a listener if it goes over the threshold. It's
+// called from the capture loop, so the listener is opened in the background.
+func (a *adaptiveTracker) observe(protocol gopacket.LayerType, port uint16, now time.Time) {
+	if !a.config.Enabled || port == 0 || a.denied[port] {
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	key := portKey{protocol: protocol, port: port}
+	if a.attempted[key] || len(a.served)+a.spawning >= a.config.MaxListeners {
+		return
+	}
+
+	window, ok := a.windows[key]
+	if !ok || now.Sub(window.start) > a.config.Window {
+		window = &portWindow{start: now}
+		a.windows[key] = window
+	}
+	window.count++
+
+	if window.count < a.config.Threshold {
+		return
+	}
+
+	// Only try once, failures here are things like privileged ports after dropping permissions
+	a.attempted[key] = true
+	a.spawning++
+	delete(a.windows, key)
+
+	reason := fmt.Sprintf("Opened after %d hits in %s", window.count, now.Sub(window.start).Round(time.Second))
+	// Counted as running so the watcher doesn't stop while it can still send a record
+	running.Add(1)
+	go a.spawn(key, reason)
+}
+
+// spawn opens the listener for a port that went over the threshold
+func (a *adaptiveTracker) spawn(key portKey, reason string) {
+	defer running.Done()
+	err := a.config.Spawn(key.protocol, key.port, reason)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.spawning--
+	if err != nil {
+		log.Printf("Could not open dynamic listener on %s port %d: %s\n", key.protocol, key.port, err)
+		return
+	}
+	a.served[key] = true
+}
@@ -0,0 +1,22 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package watcher
+
+import (
+	"time"
+)
+
+// AFPacketConfig sets up capturing with memory mapped AF_PACKET rings instead of libpcap,
+// which keeps up better on busy sensors. Only on Linux.
+type AFPacketConfig struct {
+	Enabled bool
+	// Size in bytes of each block of a ring, and the number of blocks
+	BlockSize int
+	NumBlocks int
+	// Sockets per interface, each handled in its own goroutine
+	Workers int
+	// How often the kernel's drop counts are logged
+	StatsInterval time.Duration
+}
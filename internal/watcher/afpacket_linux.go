@@ -0,0 +1,208 @@
+//go:build linux
+// +build linux
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package watcher
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+)
+
+// Most bytes of a packet the filter lets through
+const afpacketSnapLength = 65535
+
+// How long a read waits for packets before checking if the watcher is stopping
+const afpacketPollTimeout = time.Second
+
+// afpacketSocket is one member of an interface's fanout group
+type afpacketSocket struct {
+	iface  string
+	handle *afpacket.TPacket
+}
+
+// compileFilter turns the pcap filter into BPF for the sockets. They're opened with
+// SOCK_DGRAM, so the filter sees packets from the IP header on, like raw IP in libpcap.
+func compileFilter(pcapFilter string) ([]bpf.RawInstruction, error) {
+	instructions, err := pcap.CompileBPFFilter(linkTypeRawDLT, afpacketSnapLength, pcapFilter)
+	if err != nil {
+		return nil, err
+	}
+	raw := make([]bpf.RawInstruction, 0, len(instructions))
+	for _, instruction := range instructions {
+		raw = append(raw, bpf.RawInstruction{
+			Op: instruction.Code,
+			Jt: instruction.Jt,
+			Jf: instruction.Jf,
+			K:  instruction.K,
+		})
+	}
+	return raw, nil
+}
+
+// openAFPacket opens the sockets for an interface, all in the fanout group so the kernel
+// spreads packets between them. Packets from the same flow go to the same socket.
+func openAFPacket(config AFPacketConfig, iface string, filter []bpf.RawInstruction, fanoutID uint16) []afpacketSocket {
+	options := []interface{}{
+		afpacket.TPacketVersion3,
+		afpacket.SocketDgram,
+		afpacket.OptBlockSize(config.BlockSize),
+		afpacket.OptNumBlocks(config.NumBlocks),
+		afpacket.OptPollTimeout(afpacketPollTimeout),
+	}
+	// Leaving out the interface captures on all of them
+	if iface != "any" {
+		options = append(options, afpacket.OptInterface(iface))
+	}
+
+	sockets := make([]afpacketSocket, 0, config.Workers)
+	for i := 0; i < config.Workers; i++ {
+		handle, err := afpacket.NewTPacket(options...)
+		if err != nil {
+			log.Fatalf("Could not open AF_PACKET socket on interface %s: %s\n", iface, err)
+			return nil
+		}
+
+		err = handle.SetBPF(filter)
+		if err != nil {
+			log.Fatalf("Could not set filter on AF_PACKET socket on interface %s: %s\n", iface, err)
+			return nil
+		}
+
+		err = handle.SetFanout(afpacket.FanoutHashWithDefrag, fanoutID)
+		if err != nil {
+			log.Fatalf("Could not join fanout group on interface %s: %s\n", iface, err)
+			return nil
+		}
+
+		sockets = append(sockets, afpacketSocket{iface: iface, handle: handle})
+	}
+	return sockets
+}
+
+// readAFPacket handles the packets from one socket until the watcher is stopped
+func readAFPacket(socket afpacketSocket, handler *packetHandler) {
+	for {
+		select {
+		case <-stopping:
+			return
+		default:
+		}
+
+		data, info, err := socket.handle.ReadPacketData()
+		if err == afpacket.ErrTimeout {
+			continue
+		} else if err != nil {
+			log.Printf("Stopped capturing on interface %s: %s\n", socket.iface, err)
+			return
+		}
+		handler.handle(data, info, layers.LinkTypeRaw, time.Now())
+	}
+}
+
+// logAFPacketStats logs how many packets the kernel dropped because the rings were full.
+// The counts are totals since the watcher started.
+func logAFPacketStats(sockets []afpacketSocket, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stopping:
+			return
+		}
+
+		type ifaceStats struct {
+			packets uint
+			drops   uint
+			freezes uint
+		}
+		totals := make(map[string]*ifaceStats)
+		for _, socket := range sockets {
+			_, stats, err := socket.handle.SocketStats()
+			if err != nil {
+				log.Printf("Could not get AF_PACKET stats for interface %s: %s\n", socket.iface, err)
+				continue
+			}
+			total, ok := totals[socket.iface]
+			if !ok {
+				total = &ifaceStats{}
+				totals[socket.iface] = total
+			}
+			total.packets += stats.Packets()
+			total.drops += stats.Drops()
+			total.freezes += stats.QueueFreezes()
+		}
+		for iface, total := range totals {
+			log.Printf("AF_PACKET on %s: %d packets, %d dropped, %d queue freezes\n", iface, total.packets, total.drops, total.freezes)
+		}
+	}
+}
+
+// runAFPacket captures with AF_PACKET sockets until the watcher is stopped, with each socket
+// handled in its own goroutine
+func runAFPacket(config Config, pcapFilter string, handler *packetHandler, contChan chan bool) {
+	filter, err := compileFilter(pcapFilter)
+	if err != nil {
+		log.Fatalf("Could not compile filter %s: %s\n", pcapFilter, err)
+		return
+	}
+
+	// Fanout groups are shared across the system, so they're based on our pid to
+	// keep from joining someone else's
+	sockets := make([]afpacketSocket, 0)
+	for i, iface := range config.Interfaces {
+		fanoutID := uint16(os.Getpid()) + uint16(i)
+		sockets = append(sockets, openAFPacket(config.AFPacket, iface, filter, fanoutID)...)
+	}
+
+	live.lock.Lock()
+	live.setFilter = func(pcapFilter string) error {
+		filter, err := compileFilter(pcapFilter)
+		if err != nil {
+			return err
+		}
+		for _, socket := range sockets {
+			err = socket.handle.SetBPF(filter)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	live.lock.Unlock()
+
+	log.Printf("Missed port watcher listening with AF_PACKET, %d sockets per interface...\n", config.AFPacket.Workers)
+	contChan <- true
+
+	var workers sync.WaitGroup
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		logAFPacketStats(sockets, config.AFPacket.StatsInterval)
+	}()
+
+	for _, socket := range sockets {
+		workers.Add(1)
+		go func(socket afpacketSocket) {
+			defer workers.Done()
+			readAFPacket(socket, handler.worker())
+		}(socket)
+	}
+	workers.Wait()
+
+	// Only closed once nothing is reading from the rings
+	for _, socket := range sockets {
+		socket.handle.Close()
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package watcher
+
+import (
+	"log"
+)
+
+func runAFPacket(config Config, pcapFilter string, handler *packetHandler, contChan chan bool) {
+	log.Fatalln("The AF_PACKET watcher backend is only supported on Linux")
+}
@@ -0,0 +1,239 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package watcher
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/bocajspear1/honeypoke-go/internal/recorder"
+)
+
+// Kinds of backscatter
+const (
+	BackscatterSYNACK       = "syn-ack"
+	BackscatterRST          = "rst"
+	BackscatterUnreachable  = "icmp-unreachable"
+	BackscatterTimeExceeded = "icmp-time-exceeded"
+	BackscatterICMPOther    = "icmp-other"
+	BackscatterEchoReply    = "icmp-echo-reply"
+	// ICMP errors about replies from our UDP listeners, so we were used to reflect traffic at the victim
+	BackscatterReflection = "reflection"
+)
+
+// Most victims tracked in a single window
+const maxBackscatterVictims = 10000
+
+// How long a connection we started is remembered without seeing anything from it
+const solicitedTimeout = 10 * time.Minute
+
+// BackscatterConfig controls sending backscatter events to the recorders
+type BackscatterConfig struct {
+	Enabled bool
+	Window  time.Duration
+	RecChan chan *recorder.HoneypokeRecord
+}
+
+type backscatterKey struct {
+	kind       string
+	protocol   string
+	victim     string
+	victimPort uint16
+}
+
+type backscatterAggregate struct {
+	record  *recorder.HoneypokeRecord
+	sources map[string]bool
+}
+
+// backscatterEvents aggregates backscatter by victim over a window
+type backscatterEvents struct {
+	config      BackscatterConfig
+	lock        sync.Mutex
+	aggregates  map[backscatterKey]*backscatterAggregate
+	windowStart time.Time
+}
+
+// newBackscatterEvents sets up backscatter events. Without background, windows are only
+// closed by calling advance, which is used to follow the packet times when replaying.
+func newBackscatterEvents(config BackscatterConfig, background bool) *backscatterEvents {
+	events := &backscatterEvents{
+		config:     config,
+		aggregates: make(map[backscatterKey]*backscatterAggregate),
+	}
+	if background && config.Enabled {
+		running.Add(1)
+		go events.run()
+	}
+	return events
+}
+
+// observe counts a backscatter packet sent to us by source about an attack on victim
+func (b *backscatterEvents) observe(kind string, protocol string, source string, victim string, victimPort uint16, now time.Time) {
+	if !b.config.Enabled {
+		return
+	}
+
+	key := backscatterKey{kind: kind, protocol: protocol, victim: victim, victimPort: victimPort}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	aggregate, ok := b.aggregates[key]
+	if !ok {
+		if len(b.aggregates) >= maxBackscatterVictims {
+			return
+		}
+		// The victim is used as the remote IP so it gets the location
+		record := recorder.NewRecord(victim, victimPort)
+		record.Time = now.UTC().Format("2006-01-02T15:04:05-0700")
+		record.Kind = recorder.KindBackscatter
+		record.BackscatterType = kind
+		record.Protocol = protocol
+		record.RemoteIP = victim
+		record.VictimIP = victim
+		record.VictimPort = int(victimPort)
+		aggregate = &backscatterAggregate{
+			record:  record,
+			sources: make(map[string]bool),
+		}
+		b.aggregates[key] = aggregate
+	}
+
+	aggregate.record.Count++
+	aggregate.sources[source] = true
+}
+
+// flush sends a record for each victim seen in the last window
+func (b *backscatterEvents) flush() {
+	b.lock.Lock()
+	aggregates := b.aggregates
+	b.aggregates = make(map[backscatterKey]*backscatterAggregate)
+	b.lock.Unlock()
+
+	for _, aggregate := range aggregates {
+		aggregate.record.DistinctSources = len(aggregate.sources)
+		b.config.RecChan <- aggregate.record
+	}
+}
+
+// advance closes the window once now has moved past it
+func (b *backscatterEvents) advance(now time.Time) {
+	if !b.config.Enabled {
+		return
+	}
+	if b.windowStart.IsZero() {
+		b.windowStart = now
+	} else if now.Sub(b.windowStart) >= b.config.Window {
+		b.flush()
+		b.windowStart = now
+	}
+}
+
+func (b *backscatterEvents) run() {
+	defer running.Done()
+	log.Printf("Sending backscatter events every %s\n", b.config.Window)
+	ticker := time.NewTicker(b.config.Window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.flush()
+		case <-stopping:
+			return
+		}
+	}
+}
+
+// flowKey identifies traffic between one of our ports and a remote port
+type flowKey struct {
+	protocol   gopacket.LayerType
+	remote     string
+	remotePort uint16
+	localPort  uint16
+}
+
+// solicitedFlows remembers connections and UDP traffic we started, so replies to them
+// aren't taken for missed ports or backscatter
+type solicitedFlows struct {
+	lock      sync.Mutex
+	flows     map[flowKey]time.Time
+	additions int
+}
+
+func newSolicitedFlows() *solicitedFlows {
+	return &solicitedFlows{flows: make(map[flowKey]time.Time)}
+}
+
+func (s *solicitedFlows) add(key flowKey, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.flows[key] = now
+	s.additions++
+	if s.additions%4096 == 0 {
+		for flow, seen := range s.flows {
+			if now.Sub(seen) > solicitedTimeout {
+				delete(s.flows, flow)
+			}
+		}
+	}
+}
+
+// check looks for a flow we started, keeping it alive if it's found
+func (s *solicitedFlows) check(key flowKey, now time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	seen, ok := s.flows[key]
+	if !ok || now.Sub(seen) > solicitedTimeout {
+		return false
+	}
+	s.flows[key] = now
+	return true
+}
+
+// quotedPacket pulls the addresses and ports out of the packet quoted in an ICMP error.
+// Only the first 8 bytes after the IP header are quoted, which is enough for the ports.
+func quotedPacket(quoted []byte) (protocol gopacket.LayerType, source string, sourcePort uint16, target string, targetPort uint16, ok bool) {
+	var next byte
+	var ports []byte
+	if len(quoted) >= 20 && quoted[0]>>4 == 4 {
+		headerLen := int(quoted[0]&0x0f) * 4
+		if headerLen < 20 || len(quoted) < headerLen+4 {
+			return
+		}
+		next = quoted[9]
+		source = net.IP(quoted[12:16]).String()
+		target = net.IP(quoted[16:20]).String()
+		ports = quoted[headerLen : headerLen+4]
+	} else if len(quoted) >= 44 && quoted[0]>>4 == 6 {
+		// Extension headers aren't followed
+		next = quoted[6]
+		source = net.IP(quoted[8:24]).String()
+		target = net.IP(quoted[24:40]).String()
+		ports = quoted[40:44]
+	} else {
+		return
+	}
+
+	switch layers.IPProtocol(next) {
+	case layers.IPProtocolTCP:
+		protocol = layers.LayerTypeTCP
+	case layers.IPProtocolUDP:
+		protocol = layers.LayerTypeUDP
+	default:
+		return
+	}
+
+	sourcePort = binary.BigEndian.Uint16(ports[0:2])
+	targetPort = binary.BigEndian.Uint16(ports[2:4])
+	ok = true
+	return
+}
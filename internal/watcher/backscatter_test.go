@@ -0,0 +1,148 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package watcher
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/bocajspear1/honeypoke-go/internal/recorder"
+)
+
+// quotedIPv4 makes the start of an IPv4 packet the way an ICMP error quotes it
+func quotedIPv4(protocol layers.IPProtocol, source string, sourcePort uint16, target string, targetPort uint16) []byte {
+	quoted := []byte{0x45, 0, 0, 40, 0, 0, 0, 0, 64, byte(protocol), 0, 0}
+	quoted = append(quoted, net.ParseIP(source).To4()...)
+	quoted = append(quoted, net.ParseIP(target).To4()...)
+	return append(quoted, byte(sourcePort>>8), byte(sourcePort), byte(targetPort>>8), byte(targetPort), 0, 0, 0, 0)
+}
+
+func TestQuotedPacket(t *testing.T) {
+	ipv6 := []byte{0x60, 0, 0, 0, 0, 20, byte(layers.IPProtocolTCP), 64}
+	ipv6 = append(ipv6, net.ParseIP("2001:db8::10").To16()...)
+	ipv6 = append(ipv6, net.ParseIP("2001:db8::7").To16()...)
+	ipv6 = append(ipv6, 0x01, 0xbb, 0x9c, 0x40)
+	options := quotedIPv4(layers.IPProtocolUDP, "192.0.2.10", 53, "198.51.100.7", 40000)
+	options[0] = 0x46
+	options = append(options[:20], append([]byte{1, 1, 1, 1}, options[20:]...)...)
+
+	tests := []struct {
+		name       string
+		quoted     []byte
+		protocol   gopacket.LayerType
+		source     string
+		sourcePort uint16
+		target     string
+		targetPort uint16
+		ok         bool
+	}{
+		{"tcp", quotedIPv4(layers.IPProtocolTCP, "192.0.2.10", 443, "198.51.100.7", 40000), layers.LayerTypeTCP, "192.0.2.10", 443, "198.51.100.7", 40000, true},
+		{"udp with options", options, layers.LayerTypeUDP, "192.0.2.10", 53, "198.51.100.7", 40000, true},
+		{"ipv6", ipv6, layers.LayerTypeTCP, "2001:db8::10", 443, "2001:db8::7", 40000, true},
+		{"icmp", quotedIPv4(layers.IPProtocolICMPv4, "192.0.2.10", 0, "198.51.100.7", 0), gopacket.LayerTypeZero, "", 0, "", 0, false},
+		{"no ports", quotedIPv4(layers.IPProtocolTCP, "192.0.2.10", 443, "198.51.100.7", 40000)[:22], gopacket.LayerTypeZero, "", 0, "", 0, false},
+		{"bad header length", append([]byte{0x44}, make([]byte, 27)...), gopacket.LayerTypeZero, "", 0, "", 0, false},
+		{"short ipv6", ipv6[:40], gopacket.LayerTypeZero, "", 0, "", 0, false},
+		{"empty", nil, gopacket.LayerTypeZero, "", 0, "", 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			protocol, source, sourcePort, target, targetPort, ok := quotedPacket(test.quoted)
+			if ok != test.ok {
+				t.Fatalf("Got ok %v, expected %v", ok, test.ok)
+			}
+			if !ok {
+				return
+			}
+			if protocol != test.protocol || source != test.source || sourcePort != test.sourcePort || target != test.target || targetPort != test.targetPort {
+				t.Errorf("Got %s %s:%d to %s:%d", protocol, source, sourcePort, target, targetPort)
+			}
+		})
+	}
+}
+
+func TestSolicitedFlows(t *testing.T) {
+	flows := newSolicitedFlows()
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	key := flowKey{protocol: layers.LayerTypeTCP, remote: "198.51.100.7", remotePort: 443, localPort: 40000}
+	flows.add(key, now)
+
+	if !flows.check(key, now.Add(solicitedTimeout)) {
+		t.Error("A flow we started wasn't found")
+	}
+	// Checking keeps the flow alive
+	if !flows.check(key, now.Add(2*solicitedTimeout)) {
+		t.Error("A flow that was still active timed out")
+	}
+	if flows.check(key, now.Add(3*solicitedTimeout+time.Second)) {
+		t.Error("A quiet flow didn't time out")
+	}
+	other := key
+	other.localPort = 40001
+	if flows.check(other, now) {
+		t.Error("Found a flow we never started")
+	}
+}
+
+func testBackscatterHandler() *packetHandler {
+	config := Config{
+		UDPPorts:    []uint16{53},
+		Backscatter: BackscatterConfig{Enabled: true, Window: time.Minute, RecChan: make(chan *recorder.HoneypokeRecord, 10)},
+	}
+	return newPacketHandler(config, nil, map[uint16]bool{}, map[string]bool{"192.0.2.10": true}, false)
+}
+
+func TestHandleICMP(t *testing.T) {
+	handler := testBackscatterHandler()
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	// An error about a SYN we never sent
+	handler.handleICMP("icmp", "203.0.113.1", BackscatterUnreachable, quotedIPv4(layers.IPProtocolTCP, "192.0.2.10", 40000, "198.51.100.7", 80), now)
+	handler.handleICMP("icmp", "203.0.113.2", BackscatterUnreachable, quotedIPv4(layers.IPProtocolTCP, "192.0.2.10", 40001, "198.51.100.7", 80), now)
+	// An error about a reply from our UDP listener
+	handler.handleICMP("icmp", "198.51.100.8", BackscatterUnreachable, quotedIPv4(layers.IPProtocolUDP, "192.0.2.10", 53, "198.51.100.8", 40000), now)
+	// Errors about someone else's packets aren't backscatter
+	handler.handleICMP("icmp", "203.0.113.1", BackscatterUnreachable, quotedIPv4(layers.IPProtocolTCP, "192.0.2.99", 40000, "198.51.100.7", 80), now)
+	// Nor are errors about connections we started
+	handler.solicited.add(flowKey{protocol: layers.LayerTypeTCP, remote: "198.51.100.9", remotePort: 443, localPort: 50000}, now)
+	handler.handleICMP("icmp", "198.51.100.9", BackscatterUnreachable, quotedIPv4(layers.IPProtocolTCP, "192.0.2.10", 50000, "198.51.100.9", 443), now)
+
+	handler.backscatter.flush()
+	records := make(map[string]*recorder.HoneypokeRecord)
+	for len(handler.backscatter.config.RecChan) > 0 {
+		record := <-handler.backscatter.config.RecChan
+		records[record.BackscatterType] = record
+	}
+	if len(records) != 2 {
+		t.Fatalf("Got %d backscatter records, expected 2", len(records))
+	}
+	unreachable := records[BackscatterUnreachable]
+	if unreachable == nil || unreachable.VictimIP != "198.51.100.7" || unreachable.VictimPort != 80 || unreachable.Count != 2 || unreachable.DistinctSources != 2 {
+		t.Errorf("Got %+v for the unreachable errors", unreachable)
+	}
+	if unreachable != nil && (unreachable.RemoteIP != "198.51.100.7" || unreachable.Kind != recorder.KindBackscatter) {
+		t.Errorf("Got remote IP %s and kind %s, expected the victim", unreachable.RemoteIP, unreachable.Kind)
+	}
+	reflection := records[BackscatterReflection]
+	if reflection == nil || reflection.VictimIP != "198.51.100.8" || reflection.Protocol != "icmp" {
+		t.Errorf("Got %+v for the reflection", reflection)
+	}
+}
+
+func TestBackscatterMaxVictims(t *testing.T) {
+	handler := testBackscatterHandler()
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	for i := 0; i <= maxBackscatterVictims; i++ {
+		handler.backscatter.observe(BackscatterRST, "tcp", strconv.Itoa(i), strconv.Itoa(i), 80, now)
+	}
+	if count := len(handler.backscatter.aggregates); count != maxBackscatterVictims {
+		t.Errorf("Tracking %d victims, expected %d", count, maxBackscatterVictims)
+	}
+}
@@ -0,0 +1,343 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package watcher
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/bocajspear1/honeypoke-go/internal/fingerprint"
+	"github.com/bocajspear1/honeypoke-go/internal/recorder"
+)
+
+// AggregateNone sends a record for every missed packet
+const AggregateNone = "none"
+
+// AggregateSource sends one record per source for each window
+const AggregateSource = "source"
+
+// AggregatePort sends one record per port for each window
+const AggregatePort = "port"
+
+// Most ports listed on a single source aggregated record
+const maxEventPorts = 1024
+
+// Most aggregated records in one window, and sources counted on one port aggregated record,
+// so a flood of spoofed sources can't use up all our memory
+const maxEventAggregates = 65536
+const maxEventSources = 65536
+
+// Most unaggregated records waiting for the recorders. The capture loop never waits on
+// them, records that don't fit are dropped.
+const eventQueueSize = 4096
+
+// How often dropped records are logged
+const eventDropLogInterval = time.Minute
+
+// EventConfig controls sending missed port hits to the recorders
+type EventConfig struct {
+	Enabled   bool
+	Aggregate string
+	Window    time.Duration
+	RecChan   chan *recorder.HoneypokeRecord
+}
+
+type eventKey struct {
+	protocol string
+	source   string
+	port     uint16
+}
+
+type eventAggregate struct {
+	record  *recorder.HoneypokeRecord
+	flags   map[string]bool
+	ports   map[int]bool
+	sources map[string]int
+}
+
+// missedEvents turns missed packets into records, optionally aggregating them over a window
+type missedEvents struct {
+	config      EventConfig
+	lock        sync.Mutex
+	aggregates  map[eventKey]*eventAggregate
+	windowStart time.Time
+	// Packets not aggregated this window because there were already too many records
+	overflow int
+	// Unaggregated records, only used when running live
+	queue   chan *recorder.HoneypokeRecord
+	dropped uint64
+}
+
+// newMissedEvents sets up missed port events. Without background, windows are only
+// closed by calling advance, which is used to follow the packet times when replaying.
+func newMissedEvents(config EventConfig, background bool) *missedEvents {
+	events := &missedEvents{
+		config:     config,
+		aggregates: make(map[eventKey]*eventAggregate),
+	}
+	if background && config.Enabled {
+		if config.Aggregate == AggregateNone {
+			events.queue = make(chan *recorder.HoneypokeRecord, eventQueueSize)
+		}
+		running.Add(1)
+		go events.run()
+	}
+	return events
+}
+
+// tcpFlagNames lists the flags set on a TCP packet
+func tcpFlagNames(tcp *layers.TCP) []string {
+	flags := make([]string, 0)
+	if tcp.FIN {
+		flags = append(flags, "FIN")
+	}
+	if tcp.SYN {
+		flags = append(flags, "SYN")
+	}
+	if tcp.RST {
+		flags = append(flags, "RST")
+	}
+	if tcp.PSH {
+		flags = append(flags, "PSH")
+	}
+	if tcp.ACK {
+		flags = append(flags, "ACK")
+	}
+	if tcp.URG {
+		flags = append(flags, "URG")
+	}
+	if tcp.ECE {
+		flags = append(flags, "ECE")
+	}
+	if tcp.CWR {
+		flags = append(flags, "CWR")
+	}
+	if tcp.NS {
+		flags = append(flags, "NS")
+	}
+	return flags
+}
+
+func addFingerprint(record *recorder.HoneypokeRecord, result fingerprint.Result) {
+	record.OSGuess = result.OSGuess
+	record.ScannerTool = result.ScannerTool
+	record.TCPFingerprint = result.Signature
+}
+
+// quoteInput escapes a payload snippet the same way the listeners do
+func quoteInput(input []byte) string {
+	if len(input) == 0 {
+		return ""
+	}
+	quoted := strconv.Quote(string(input))
+	return quoted[1 : len(quoted)-1]
+}
+
+// observe handles a packet to a port without a listener. flags is only set for TCP, and
+// input is a snippet of the payload for protocols that have one worth keeping.
+func (e *missedEvents) observe(protocol gopacket.LayerType, source string, sourcePort uint16, port uint16, flags []string, input []byte, now time.Time) {
+	if !e.config.Enabled || port == 0 {
+		return
+	}
+
+	if e.config.Aggregate == AggregateNone {
+		record := recorder.NewRecord(source, sourcePort)
+		record.Time = now.UTC().Format("2006-01-02T15:04:05-0700")
+		record.Kind = recorder.KindMissed
+		record.RemoteIP = source
+		record.RemotePort = int(sourcePort)
+		record.Port = int(port)
+		record.Protocol = protocolName(protocol)
+		record.TCPFlags = strings.Join(flags, ",")
+		record.Input = quoteInput(input)
+		if result, ok := fingerprint.Lookup(source, sourcePort); ok {
+			addFingerprint(record, result)
+		}
+		e.send(record)
+		return
+	}
+
+	key := eventKey{protocol: protocolName(protocol)}
+	if e.config.Aggregate == AggregateSource {
+		key.source = source
+	} else {
+		key.port = port
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	aggregate, ok := e.aggregates[key]
+	if !ok {
+		if len(e.aggregates) >= maxEventAggregates {
+			e.overflow++
+			return
+		}
+		record := recorder.NewRecord(key.source, 0)
+		record.Time = now.UTC().Format("2006-01-02T15:04:05-0700")
+		record.Kind = recorder.KindMissed
+		record.Protocol = key.protocol
+		record.RemoteIP = key.source
+		record.Port = int(key.port)
+		aggregate = &eventAggregate{
+			record:  record,
+			flags:   make(map[string]bool),
+			ports:   make(map[int]bool),
+			sources: make(map[string]int),
+		}
+		e.aggregates[key] = aggregate
+	}
+
+	aggregate.record.Count++
+	if aggregate.record.Input == "" {
+		aggregate.record.Input = quoteInput(input)
+	}
+	for _, flag := range flags {
+		aggregate.flags[flag] = true
+	}
+	if len(aggregate.ports) < maxEventPorts {
+		aggregate.ports[int(port)] = true
+	}
+	if _, ok := aggregate.sources[source]; ok || len(aggregate.sources) < maxEventSources {
+		aggregate.sources[source]++
+	}
+}
+
+// send hands an unaggregated record to the recorders, without waiting on them when live
+func (e *missedEvents) send(record *recorder.HoneypokeRecord) {
+	if e.queue == nil {
+		e.config.RecChan <- record
+		return
+	}
+	select {
+	case e.queue <- record:
+	default:
+		atomic.AddUint64(&e.dropped, 1)
+	}
+}
+
+// logDropped logs how many records were dropped since it was last called
+func (e *missedEvents) logDropped() {
+	dropped := atomic.SwapUint64(&e.dropped, 0)
+	if dropped > 0 {
+		log.Printf("Dropped %d missed port events the recorders couldn't keep up with\n", dropped)
+	}
+}
+
+// flush sends a record for everything aggregated in the last window, or everything queued
+func (e *missedEvents) flush() {
+	if e.queue != nil {
+		for {
+			select {
+			case record := <-e.queue:
+				e.config.RecChan <- record
+			default:
+				e.logDropped()
+				return
+			}
+		}
+	}
+
+	e.lock.Lock()
+	aggregates := e.aggregates
+	e.aggregates = make(map[eventKey]*eventAggregate)
+	overflow := e.overflow
+	e.overflow = 0
+	e.lock.Unlock()
+
+	if overflow > 0 {
+		log.Printf("Over %d missed port records this window, %d packets weren't included\n", maxEventAggregates, overflow)
+	}
+
+	for _, aggregate := range aggregates {
+		record := aggregate.record
+
+		flags := make([]string, 0, len(aggregate.flags))
+		for flag := range aggregate.flags {
+			flags = append(flags, flag)
+		}
+		sort.Strings(flags)
+		record.TCPFlags = strings.Join(flags, ",")
+
+		if e.config.Aggregate == AggregateSource {
+			if result, ok := fingerprint.LookupSource(record.RemoteIP); ok {
+				addFingerprint(record, result)
+			}
+			for port := range aggregate.ports {
+				record.Ports = append(record.Ports, port)
+			}
+			sort.Ints(record.Ports)
+		} else {
+			record.DistinctSources = len(aggregate.sources)
+			// The source that sent the most stands in for the rest, so the record gets a location
+			mostSent := 0
+			for source, count := range aggregate.sources {
+				if count > mostSent || (count == mostSent && source < record.RemoteIP) {
+					record.RemoteIP = source
+					mostSent = count
+				}
+			}
+		}
+
+		e.config.RecChan <- record
+	}
+}
+
+// advance closes the aggregation window once now has moved past it
+func (e *missedEvents) advance(now time.Time) {
+	if !e.config.Enabled || e.config.Aggregate == AggregateNone {
+		return
+	}
+	if e.windowStart.IsZero() {
+		e.windowStart = now
+	} else if now.Sub(e.windowStart) >= e.config.Window {
+		e.flush()
+		e.windowStart = now
+	}
+}
+
+func (e *missedEvents) run() {
+	defer running.Done()
+	if e.queue != nil {
+		e.forward()
+		return
+	}
+	log.Printf("Sending missed port events aggregated by %s every %s\n", e.config.Aggregate, e.config.Window)
+	ticker := time.NewTicker(e.config.Window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.flush()
+		case <-stopping:
+			return
+		}
+	}
+}
+
+// forward passes queued records to the recorders. What's left when stopping is sent by flush.
+func (e *missedEvents) forward() {
+	log.Println("Sending a missed port event for every packet")
+	ticker := time.NewTicker(eventDropLogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case record := <-e.queue:
+			e.config.RecChan <- record
+		case <-ticker.C:
+			e.logDropped()
+		case <-stopping:
+			return
+		}
+	}
+}
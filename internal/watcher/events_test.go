@@ -0,0 +1,149 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package watcher
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/bocajspear1/honeypoke-go/internal/recorder"
+)
+
+func TestTCPFlagNames(t *testing.T) {
+	tests := []struct {
+		tcp      layers.TCP
+		expected []string
+	}{
+		{layers.TCP{}, []string{}},
+		{layers.TCP{SYN: true}, []string{"SYN"}},
+		{layers.TCP{SYN: true, ACK: true}, []string{"SYN", "ACK"}},
+		{layers.TCP{FIN: true, PSH: true, URG: true}, []string{"FIN", "PSH", "URG"}},
+		{layers.TCP{ECE: true, CWR: true, NS: true}, []string{"ECE", "CWR", "NS"}},
+	}
+	for _, test := range tests {
+		if flags := tcpFlagNames(&test.tcp); !reflect.DeepEqual(flags, test.expected) {
+			t.Errorf("Got %v, expected %v", flags, test.expected)
+		}
+	}
+}
+
+// observeEvents feeds missed packets through events in one window and returns the records sent
+func observeEvents(events *missedEvents, observe func(now time.Time)) []*recorder.HoneypokeRecord {
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	events.advance(start)
+	observe(start.Add(time.Second))
+	events.advance(start.Add(events.config.Window))
+
+	records := make([]*recorder.HoneypokeRecord, 0)
+	for len(events.config.RecChan) > 0 {
+		records = append(records, <-events.config.RecChan)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Port != records[j].Port {
+			return records[i].Port < records[j].Port
+		}
+		if records[i].RemoteIP != records[j].RemoteIP {
+			return records[i].RemoteIP < records[j].RemoteIP
+		}
+		return records[i].Protocol < records[j].Protocol
+	})
+	return records
+}
+
+func TestMissedEventsNone(t *testing.T) {
+	events := newMissedEvents(EventConfig{Enabled: true, Aggregate: AggregateNone, RecChan: make(chan *recorder.HoneypokeRecord, 10)}, false)
+	records := observeEvents(events, func(now time.Time) {
+		events.observe(layers.LayerTypeTCP, "198.51.100.7", 40000, 23, []string{"SYN"}, nil, now)
+		events.observe(layers.LayerTypeUDP, "198.51.100.7", 40001, 161, nil, []byte("\x30\x26"), now)
+		events.observe(layers.LayerTypeUDP, "198.51.100.7", 40001, 0, nil, nil, now)
+	})
+	if len(records) != 2 {
+		t.Fatalf("Got %d records, expected 2", len(records))
+	}
+	if records[0].Protocol != "tcp" || records[0].RemotePort != 40000 || records[0].TCPFlags != "SYN" || records[0].Kind != recorder.KindMissed {
+		t.Errorf("Got %+v for the SYN", records[0])
+	}
+	if records[1].Protocol != "udp" || records[1].Input != `0&` || records[1].Time != "2026-10-19T12:00:01+0000" {
+		t.Errorf("Got %+v for the UDP packet", records[1])
+	}
+}
+
+func TestMissedEventsAggregateSource(t *testing.T) {
+	events := newMissedEvents(EventConfig{Enabled: true, Aggregate: AggregateSource, Window: time.Minute, RecChan: make(chan *recorder.HoneypokeRecord, 10)}, false)
+	records := observeEvents(events, func(now time.Time) {
+		events.observe(layers.LayerTypeTCP, "198.51.100.7", 40000, 25, []string{"SYN"}, nil, now)
+		events.observe(layers.LayerTypeTCP, "198.51.100.7", 40000, 23, []string{"FIN", "ACK"}, nil, now)
+		events.observe(layers.LayerTypeTCP, "198.51.100.7", 40000, 23, []string{"SYN"}, nil, now)
+		events.observe(layers.LayerTypeTCP, "198.51.100.8", 40000, 23, []string{"SYN"}, nil, now)
+		events.observe(layers.LayerTypeUDP, "198.51.100.7", 40000, 53, nil, nil, now)
+	})
+	if len(records) != 3 {
+		t.Fatalf("Got %d records, expected one per source and protocol", len(records))
+	}
+	tcp := records[0]
+	if tcp.RemoteIP != "198.51.100.7" || tcp.Protocol != "tcp" || tcp.Count != 3 {
+		t.Errorf("Got %+v for the first source", tcp)
+	}
+	if !reflect.DeepEqual(tcp.Ports, []int{23, 25}) || tcp.TCPFlags != "ACK,FIN,SYN" {
+		t.Errorf("Got ports %v and flags %s", tcp.Ports, tcp.TCPFlags)
+	}
+	if records[1].Protocol != "udp" || records[2].RemoteIP != "198.51.100.8" {
+		t.Errorf("Got %+v and %+v for the other records", records[1], records[2])
+	}
+}
+
+func TestMissedEventsAggregatePort(t *testing.T) {
+	events := newMissedEvents(EventConfig{Enabled: true, Aggregate: AggregatePort, Window: time.Minute, RecChan: make(chan *recorder.HoneypokeRecord, 10)}, false)
+	records := observeEvents(events, func(now time.Time) {
+		events.observe(layers.LayerTypeTCP, "198.51.100.7", 40000, 23, []string{"SYN"}, nil, now)
+		events.observe(layers.LayerTypeTCP, "198.51.100.8", 40000, 23, []string{"SYN"}, nil, now)
+		events.observe(layers.LayerTypeTCP, "198.51.100.8", 40001, 23, []string{"SYN"}, nil, now)
+		events.observe(layers.LayerTypeTCP, "198.51.100.9", 40000, 25, []string{"SYN"}, nil, now)
+	})
+	if len(records) != 2 {
+		t.Fatalf("Got %d records, expected one per port", len(records))
+	}
+	if records[0].Port != 23 || records[0].Count != 3 || records[0].DistinctSources != 2 || len(records[0].Ports) != 0 {
+		t.Errorf("Got %+v for port 23", records[0])
+	}
+	// The source that sent the most is used for the location
+	if records[0].RemoteIP != "198.51.100.8" {
+		t.Errorf("Got remote IP %q, expected the busiest source", records[0].RemoteIP)
+	}
+	if records[1].Port != 25 || records[1].RemoteIP != "198.51.100.9" {
+		t.Errorf("Got %+v for port 25", records[1])
+	}
+}
+
+func TestMissedEventsCaps(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	events := newMissedEvents(EventConfig{Enabled: true, Aggregate: AggregateSource, Window: time.Minute}, false)
+	for i := 0; i < maxEventAggregates+10; i++ {
+		events.observe(layers.LayerTypeTCP, strconv.Itoa(i), 40000, 23, nil, nil, now)
+	}
+	// Sources already being aggregated are still counted
+	events.observe(layers.LayerTypeTCP, "0", 40000, 25, nil, nil, now)
+	if len(events.aggregates) != maxEventAggregates || events.overflow != 10 {
+		t.Errorf("Got %d records and %d left out", len(events.aggregates), events.overflow)
+	}
+	if aggregate := events.aggregates[eventKey{protocol: "tcp", source: "0"}]; aggregate.record.Count != 2 {
+		t.Errorf("Got count %d for a source already aggregated", aggregate.record.Count)
+	}
+
+	events = newMissedEvents(EventConfig{Enabled: true, Aggregate: AggregatePort, Window: time.Minute}, false)
+	for i := 0; i < maxEventSources+10; i++ {
+		events.observe(layers.LayerTypeTCP, strconv.Itoa(i), 40000, 23, nil, nil, now)
+	}
+	aggregate := events.aggregates[eventKey{protocol: "tcp", port: 23}]
+	if len(aggregate.sources) != maxEventSources || aggregate.record.Count != maxEventSources+10 {
+		t.Errorf("Got %d sources and count %d", len(aggregate.sources), aggregate.record.Count)
+	}
+}
@@ -0,0 +1,86 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package watcher
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// PortFilter matches any of the ports for protocol ("tcp" or "udp"), with runs of
+// ports combined into portranges. Empty if there are no ports.
+func PortFilter(protocol string, ports []uint16) string {
+	sorted := make([]int, 0, len(ports))
+	seen := make(map[uint16]bool)
+	for _, port := range ports {
+		if !seen[port] {
+			seen[port] = true
+			sorted = append(sorted, int(port))
+		}
+	}
+	sort.Ints(sorted)
+
+	clauses := make([]string, 0)
+	for i := 0; i < len(sorted); {
+		end := i
+		for end+1 < len(sorted) && sorted[end+1] == sorted[end]+1 {
+			end++
+		}
+		if end == i {
+			clauses = append(clauses, protocol+" port "+strconv.Itoa(sorted[i]))
+		} else {
+			clauses = append(clauses, protocol+" portrange "+strconv.Itoa(sorted[i])+"-"+strconv.Itoa(sorted[end]))
+		}
+		i = end + 1
+	}
+	return strings.Join(clauses, " or ")
+}
+
+// filterHost cleans up an address for use in a filter. Zones like the %eth0 on link
+// local IPv6 addresses aren't understood by pcap, and aren't needed to match.
+func filterHost(addr string) (string, error) {
+	if zone := strings.IndexByte(addr, '%'); zone >= 0 {
+		addr = addr[:zone]
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return "", fmt.Errorf("%s is not an IP address", addr)
+	}
+	return ip.String(), nil
+}
+
+// hostFilter matches any of the addresses, direction is "src" or "dst"
+func hostFilter(direction string, addrs []string) string {
+	clauses := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		clauses = append(clauses, direction+" host "+addr)
+	}
+	return strings.Join(clauses, " or ")
+}
+
+// andFilter matches both filters, where an empty filter matches everything
+func andFilter(first string, second string) string {
+	if first == "" {
+		return second
+	} else if second == "" {
+		return first
+	}
+	return "(" + first + ") and (" + second + ")"
+}
+
+// ValidateFilter checks that pcap can compile a filter
+func ValidateFilter(filter string) error {
+	if filter == "" {
+		return nil
+	}
+	_, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, 1600, filter)
+	return err
+}
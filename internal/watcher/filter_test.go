@@ -0,0 +1,144 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package watcher
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPortFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol string
+		ports    []uint16
+		expected string
+	}{
+		{"none", "tcp", nil, ""},
+		{"single", "tcp", []uint16{22}, "tcp port 22"},
+		{"unsorted with duplicates", "udp", []uint16{161, 53, 161}, "udp port 53 or udp port 161"},
+		{"run", "tcp", []uint16{8002, 8000, 8001}, "tcp portrange 8000-8002"},
+		{"runs and singles", "tcp", []uint16{22, 80, 81, 82, 443, 8080, 8081}, "tcp port 22 or tcp portrange 80-82 or tcp port 443 or tcp portrange 8080-8081"},
+		{"top port", "tcp", []uint16{65534, 65535}, "tcp portrange 65534-65535"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter := PortFilter(test.protocol, test.ports)
+			if filter != test.expected {
+				t.Errorf("Got %q, expected %q", filter, test.expected)
+			}
+		})
+	}
+}
+
+func TestFilterHost(t *testing.T) {
+	tests := []struct {
+		addr     string
+		expected string
+		valid    bool
+	}{
+		{"192.0.2.1", "192.0.2.1", true},
+		{"2001:db8::1", "2001:db8::1", true},
+		{"fe80::1%eth0", "fe80::1", true},
+		{"2001:0db8:0000::0001", "2001:db8::1", true},
+		{"eth0", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.addr, func(t *testing.T) {
+			host, err := filterHost(test.addr)
+			if (err == nil) != test.valid {
+				t.Fatalf("Got error %v, expected valid to be %v", err, test.valid)
+			}
+			if host != test.expected {
+				t.Errorf("Got %q, expected %q", host, test.expected)
+			}
+		})
+	}
+}
+
+func TestHostFilter(t *testing.T) {
+	filter := hostFilter("src", []string{"192.0.2.1", "2001:db8::1"})
+	expected := "src host 192.0.2.1 or src host 2001:db8::1"
+	if filter != expected {
+		t.Errorf("Got %q, expected %q", filter, expected)
+	}
+}
+
+func TestAndFilter(t *testing.T) {
+	tests := []struct {
+		first    string
+		second   string
+		expected string
+	}{
+		{"", "", ""},
+		{"tcp", "", "tcp"},
+		{"", "udp", "udp"},
+		{"tcp or udp", "not port 22", "(tcp or udp) and (not port 22)"},
+	}
+	for _, test := range tests {
+		filter := andFilter(test.first, test.second)
+		if filter != test.expected {
+			t.Errorf("andFilter(%q, %q) gave %q, expected %q", test.first, test.second, filter, test.expected)
+		}
+	}
+}
+
+func TestWatcherFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   Config
+		expected string
+	}{
+		{"empty", Config{}, ""},
+		{"filter only", Config{Filter: "not (tcp port 22)"}, "not (tcp port 22)"},
+		{
+			"fingerprinting",
+			Config{Filter: "not (tcp port 22)", Fingerprint: true},
+			"(" + synFilter + ") or (not (tcp port 22))",
+		},
+		{
+			"sessions",
+			Config{Filter: "not (tcp port 80)", Capture: true, SessionPorts: []uint16{80, 81}},
+			"(not (tcp port 80)) or (tcp portrange 80-81)",
+		},
+		{
+			"sessions without capture",
+			Config{Filter: "not (tcp port 80)", SessionPorts: []uint16{80}},
+			"not (tcp port 80)",
+		},
+		{
+			"extra filter",
+			Config{Filter: "not (tcp port 80)", Capture: true, SessionPorts: []uint16{80}, ExtraFilter: "not net 10.0.0.0/8"},
+			"((not (tcp port 80)) or (tcp port 80)) and (not net 10.0.0.0/8)",
+		},
+		{"extra filter only", Config{ExtraFilter: "not net 10.0.0.0/8"}, "not net 10.0.0.0/8"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.config.ExcludedTCPPorts = []uint16{80, 443}
+			filter, excluded, local, err := watcherFilter(test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if filter != test.expected {
+				t.Errorf("Got %q, expected %q", filter, test.expected)
+			}
+			if !reflect.DeepEqual(excluded, map[uint16]bool{80: true, 443: true}) {
+				t.Errorf("Got excluded ports %v", excluded)
+			}
+			if len(local) != 0 {
+				t.Errorf("Got local addresses %v without interfaces", local)
+			}
+		})
+	}
+}
+
+func TestWatcherFilterMissingInterface(t *testing.T) {
+	_, _, _, err := watcherFilter(Config{Interfaces: []string{"honeypoke-missing0"}})
+	if err == nil {
+		t.Error("No error for an interface that doesn't exist")
+	}
+}
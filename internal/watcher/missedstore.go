@@ -0,0 +1,562 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package watcher
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	bolt "go.etcd.io/bbolt"
+)
+
+// DefaultMissedDB is where missed port data is stored if no path is configured
+const DefaultMissedDB = "missed.db"
+
+const dayFormat = "2006-01-02"
+
+// How often pending hits are written to the database
+const missedFlushInterval = time.Second
+
+// How often old source IPs are pruned
+const missedPruneInterval = time.Hour
+
+// Source IPs are kept this long after they were last seen, so they aren't counted again as
+// new when they come back, and at most this many are kept per port
+const sourceRetention = 30 * 24 * time.Hour
+const maxSourceIPs = 10000
+
+// The legacy missed.txt counters only have room for 5 digits
+const legacyMaxCount = 99999
+
+var (
+	bucketPorts     = []byte("ports")
+	bucketDays      = []byte("days")
+	bucketSourceIPs = []byte("source_ips")
+	bucketMeta      = []byte("meta")
+	keyCount        = []byte("count")
+	keyFirst        = []byte("first")
+	keyLast         = []byte("last")
+	keySources      = []byte("sources")
+	keyImported     = []byte("legacy_imported")
+)
+
+// MissedStats are the counts for a port, either overall or for a single day
+type MissedStats struct {
+	Protocol  string
+	Port      uint16
+	Day       string
+	Count     uint64
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Sources   uint64
+}
+
+type pendingHits struct {
+	count   uint64
+	first   time.Time
+	last    time.Time
+	sources map[string]time.Time
+}
+
+type pendingKey struct {
+	protocol string
+	port     uint16
+	day      string
+}
+
+// MissedStore keeps missed port hits in an embedded database. The database is laid out as:
+//
+//	ports/<protocol>/<port>/{count,first,last,sources,source_ips/}
+//	ports/<protocol>/<port>/days/<day>/{count,first,last,sources,source_ips/}
+//	meta/legacy_imported
+//
+// Hits are batched in memory and written once a second, since a single write per packet
+// can't keep up with a scan. Source IPs are only kept to tell new sources apart, so they're
+// pruned: a day's are dropped once the day is over, and a port's once they're older than
+// sourceRetention or there are more than maxSourceIPs.
+type MissedStore struct {
+	db      *bolt.DB
+	lock    sync.Mutex
+	pending map[pendingKey]*pendingHits
+	done    chan bool
+}
+
+// OpenMissedStore opens or creates the missed port database
+func OpenMissedStore(path string) (*MissedStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketPorts)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &MissedStore{
+		db:      db,
+		pending: make(map[pendingKey]*pendingHits),
+	}, nil
+}
+
+func protocolName(protocol gopacket.LayerType) string {
+	if protocol == layers.LayerTypeTCP {
+		return "tcp"
+	} else if protocol == layers.LayerTypeUDP {
+		return "udp"
+	} else if protocol == layers.LayerTypeICMPv4 {
+		return "icmp"
+	} else if protocol == layers.LayerTypeIPv4 || protocol == layers.LayerTypeIPv6 {
+		// Protocols we don't decode, the "port" is the IP protocol number
+		return "ip"
+	}
+	return strings.ToLower(protocol.String())
+}
+
+func portName(port uint16) []byte {
+	return []byte(fmt.Sprintf("%05d", port))
+}
+
+func encodeUint(value uint64) []byte {
+	out := make([]byte, 8)
+	binary.BigEndian.PutUint64(out, value)
+	return out
+}
+
+func decodeUint(value []byte) uint64 {
+	if len(value) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(value)
+}
+
+func decodeTime(value []byte) time.Time {
+	if len(value) != 8 {
+		return time.Time{}
+	}
+	return time.Unix(int64(binary.BigEndian.Uint64(value)), 0).UTC()
+}
+
+// Hit records a packet to a port without a listener
+func (s *MissedStore) Hit(protocol gopacket.LayerType, port uint16, source string, when time.Time) {
+	if port == 0 {
+		return
+	}
+
+	when = when.UTC()
+	key := pendingKey{protocol: protocolName(protocol), port: port, day: when.Format(dayFormat)}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	hits, ok := s.pending[key]
+	if !ok {
+		hits = &pendingHits{first: when, sources: make(map[string]time.Time)}
+		s.pending[key] = hits
+	}
+	hits.count++
+	hits.last = when
+	if source != "" {
+		hits.sources[source] = when
+	}
+}
+
+// addHits adds pending hits into a port or day bucket
+func addHits(bucket *bolt.Bucket, hits *pendingHits) error {
+	sourceIPs, err := bucket.CreateBucketIfNotExists(bucketSourceIPs)
+	if err != nil {
+		return err
+	}
+
+	newSources := uint64(0)
+	for source, when := range hits.sources {
+		if sourceIPs.Get([]byte(source)) == nil {
+			newSources++
+		}
+		err = sourceIPs.Put([]byte(source), encodeUint(uint64(when.Unix())))
+		if err != nil {
+			return err
+		}
+	}
+
+	return addCounts(bucket, hits.count, hits.first, hits.last, newSources)
+}
+
+func addCounts(bucket *bolt.Bucket, count uint64, first time.Time, last time.Time, newSources uint64) error {
+	err := bucket.Put(keyCount, encodeUint(decodeUint(bucket.Get(keyCount))+count))
+	if err != nil {
+		return err
+	}
+	err = bucket.Put(keySources, encodeUint(decodeUint(bucket.Get(keySources))+newSources))
+	if err != nil {
+		return err
+	}
+
+	if !first.IsZero() {
+		oldFirst := decodeTime(bucket.Get(keyFirst))
+		if oldFirst.IsZero() || first.Before(oldFirst) {
+			err = bucket.Put(keyFirst, encodeUint(uint64(first.Unix())))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if !last.IsZero() && last.After(decodeTime(bucket.Get(keyLast))) {
+		err = bucket.Put(keyLast, encodeUint(uint64(last.Unix())))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func portBucket(tx *bolt.Tx, protocol string, port uint16) (*bolt.Bucket, error) {
+	protoBucket, err := tx.Bucket(bucketPorts).CreateBucketIfNotExists([]byte(protocol))
+	if err != nil {
+		return nil, err
+	}
+	return protoBucket.CreateBucketIfNotExists(portName(port))
+}
+
+// Flush writes pending hits to the database
+func (s *MissedStore) Flush() error {
+	s.lock.Lock()
+	pending := s.pending
+	s.pending = make(map[pendingKey]*pendingHits)
+	s.lock.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for key, hits := range pending {
+			port, err := portBucket(tx, key.protocol, key.port)
+			if err != nil {
+				return err
+			}
+			err = addHits(port, hits)
+			if err != nil {
+				return err
+			}
+
+			days, err := port.CreateBucketIfNotExists(bucketDays)
+			if err != nil {
+				return err
+			}
+			day, err := days.CreateBucketIfNotExists([]byte(key.day))
+			if err != nil {
+				return err
+			}
+			err = addHits(day, hits)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// pruneSources drops source IPs last seen before cutoff, then the oldest ones over max
+func pruneSources(sourceIPs *bolt.Bucket, cutoff uint64, max int) (int, error) {
+	type seenSource struct {
+		source []byte
+		when   uint64
+	}
+	sources := make([]seenSource, 0)
+	err := sourceIPs.ForEach(func(source []byte, when []byte) error {
+		sources = append(sources, seenSource{source: append([]byte{}, source...), when: decodeUint(when)})
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	sort.Slice(sources, func(i, j int) bool { return sources[i].when < sources[j].when })
+	pruned := 0
+	for i, source := range sources {
+		if source.when >= cutoff && len(sources)-i <= max {
+			break
+		}
+		err = sourceIPs.Delete(source.source)
+		if err != nil {
+			return pruned, err
+		}
+		pruned++
+	}
+	return pruned, nil
+}
+
+// Prune drops the source IPs that are no longer needed, keeping the counts
+func (s *MissedStore) Prune(now time.Time) error {
+	cutoff := uint64(now.Add(-sourceRetention).Unix())
+	// A day is kept for a day after it's over, for hits flushed late
+	lastDay := now.UTC().Add(-48 * time.Hour).Format(dayFormat)
+
+	pruned := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		ports := tx.Bucket(bucketPorts)
+		protocols := make([][]byte, 0)
+		ports.ForEach(func(protocol []byte, _ []byte) error {
+			protocols = append(protocols, protocol)
+			return nil
+		})
+		for _, protocol := range protocols {
+			protoBucket := ports.Bucket(protocol)
+			if protoBucket == nil {
+				continue
+			}
+			portNames := make([][]byte, 0)
+			protoBucket.ForEach(func(port []byte, _ []byte) error {
+				portNames = append(portNames, port)
+				return nil
+			})
+			for _, name := range portNames {
+				port := protoBucket.Bucket(name)
+				if port == nil {
+					continue
+				}
+				if sourceIPs := port.Bucket(bucketSourceIPs); sourceIPs != nil {
+					count, err := pruneSources(sourceIPs, cutoff, maxSourceIPs)
+					pruned += count
+					if err != nil {
+						return err
+					}
+				}
+
+				days := port.Bucket(bucketDays)
+				if days == nil {
+					continue
+				}
+				oldDays := make([][]byte, 0)
+				days.ForEach(func(day []byte, _ []byte) error {
+					if string(day) <= lastDay && days.Bucket(day).Bucket(bucketSourceIPs) != nil {
+						oldDays = append(oldDays, day)
+					}
+					return nil
+				})
+				for _, day := range oldDays {
+					pruned += days.Bucket(day).Bucket(bucketSourceIPs).Stats().KeyN
+					err := days.Bucket(day).DeleteBucket(bucketSourceIPs)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	})
+	if pruned > 0 {
+		log.Printf("Pruned %d old source IPs from the missed port database\n", pruned)
+	}
+	return err
+}
+
+// StartFlushing writes pending hits and prunes old source IPs in the background until the
+// store is closed
+func (s *MissedStore) StartFlushing() {
+	s.done = make(chan bool)
+	go func() {
+		ticker := time.NewTicker(missedFlushInterval)
+		defer ticker.Stop()
+		lastPrune := time.Time{}
+		for {
+			select {
+			case now := <-ticker.C:
+				err := s.Flush()
+				if err != nil {
+					log.Printf("Could not write missed ports: %s\n", err)
+				}
+				if now.Sub(lastPrune) >= missedPruneInterval {
+					lastPrune = now
+					err = s.Prune(now)
+					if err != nil {
+						log.Printf("Could not prune missed ports: %s\n", err)
+					}
+				}
+			case <-s.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close writes anything pending and closes the database
+func (s *MissedStore) Close() error {
+	if s.done != nil {
+		close(s.done)
+	}
+	err := s.Flush()
+	closeErr := s.db.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func readStats(bucket *bolt.Bucket, protocol string, port uint16, day string) MissedStats {
+	return MissedStats{
+		Protocol:  protocol,
+		Port:      port,
+		Day:       day,
+		Count:     decodeUint(bucket.Get(keyCount)),
+		FirstSeen: decodeTime(bucket.Get(keyFirst)),
+		LastSeen:  decodeTime(bucket.Get(keyLast)),
+		Sources:   decodeUint(bucket.Get(keySources)),
+	}
+}
+
+// Ports returns the overall stats of every port, most hit first
+func (s *MissedStore) Ports() ([]MissedStats, error) {
+	stats := make([]MissedStats, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketPorts).ForEach(func(protocol []byte, _ []byte) error {
+			protoBucket := tx.Bucket(bucketPorts).Bucket(protocol)
+			return protoBucket.ForEach(func(portKey []byte, _ []byte) error {
+				port, err := strconv.Atoi(string(portKey))
+				if err != nil {
+					return nil
+				}
+				stats = append(stats, readStats(protoBucket.Bucket(portKey), string(protocol), uint16(port), ""))
+				return nil
+			})
+		})
+	})
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Count > stats[j].Count })
+	return stats, err
+}
+
+// Days returns the stats of a port for each day it was hit
+func (s *MissedStore) Days(protocol gopacket.LayerType, port uint16) ([]MissedStats, error) {
+	stats := make([]MissedStats, 0)
+	name := protocolName(protocol)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		protoBucket := tx.Bucket(bucketPorts).Bucket([]byte(name))
+		if protoBucket == nil {
+			return nil
+		}
+		portBucket := protoBucket.Bucket(portName(port))
+		if portBucket == nil || portBucket.Bucket(bucketDays) == nil {
+			return nil
+		}
+		days := portBucket.Bucket(bucketDays)
+		return days.ForEach(func(day []byte, _ []byte) error {
+			stats = append(stats, readStats(days.Bucket(day), name, port, string(day)))
+			return nil
+		})
+	})
+	return stats, err
+}
+
+// ImportLegacy adds the counts from an old missed.txt file. The old format has no
+// dates or sources, so only the overall counts are updated. This can only be done once
+// for a database, so the counts aren't added twice.
+func (s *MissedStore) ImportLegacy(path string) error {
+	legacyFile, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer legacyFile.Close()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(bucketMeta)
+		if err != nil {
+			return err
+		}
+		if imported := meta.Get(keyImported); imported != nil {
+			return fmt.Errorf("A missed.txt was already imported on %s", decodeTime(imported).Format(dayFormat))
+		}
+		err = meta.Put(keyImported, encodeUint(uint64(time.Now().Unix())))
+		if err != nil {
+			return err
+		}
+
+		scanner := bufio.NewScanner(legacyFile)
+		for scanner.Scan() {
+			parts := strings.Split(scanner.Text(), "|")
+			if len(parts) != 3 {
+				return errors.New("missed.txt is corrupted: " + scanner.Text())
+			}
+
+			values := make([]int, 3)
+			for i, part := range parts {
+				values[i], err = strconv.Atoi(strings.TrimSpace(part))
+				if err != nil {
+					return err
+				}
+			}
+
+			port := uint16(values[0])
+			for i, protocol := range []string{"tcp", "udp"} {
+				if values[i+1] == 0 {
+					continue
+				}
+				bucket, err := portBucket(tx, protocol, port)
+				if err != nil {
+					return err
+				}
+				err = addCounts(bucket, uint64(values[i+1]), time.Time{}, time.Time{}, 0)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return scanner.Err()
+	})
+}
+
+// ExportLegacy writes the overall counts in the old fixed-width missed.txt format
+func (s *MissedStore) ExportLegacy(path string) error {
+	stats, err := s.Ports()
+	if err != nil {
+		return err
+	}
+
+	counts := make(map[string][]uint64)
+	counts["tcp"] = make([]uint64, 65536)
+	counts["udp"] = make([]uint64, 65536)
+	for _, stat := range stats {
+		if list, ok := counts[stat.Protocol]; ok {
+			list[stat.Port] = stat.Count
+		}
+	}
+
+	legacyFile, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer legacyFile.Close()
+
+	writer := bufio.NewWriter(legacyFile)
+	for port := 1; port <= 65535; port++ {
+		tcpCount := counts["tcp"][port]
+		if tcpCount > legacyMaxCount {
+			tcpCount = legacyMaxCount
+		}
+		udpCount := counts["udp"][port]
+		if udpCount > legacyMaxCount {
+			udpCount = legacyMaxCount
+		}
+		fmt.Fprintf(writer, "%5d|%5d|%5d\n", port, tcpCount, udpCount)
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,250 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package watcher
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	bolt "go.etcd.io/bbolt"
+)
+
+// openTestStore opens a missed port database in a temporary directory, returning the directory
+func openTestStore(t *testing.T) (*MissedStore, string) {
+	dir, err := ioutil.TempDir("", "honeypoke")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenMissedStore(filepath.Join(dir, "missed.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return store, dir
+}
+
+// sourceCount counts the source IPs kept for a port, or one of its days
+func sourceCount(t *testing.T, store *MissedStore, protocol string, port uint16, day string) int {
+	count := 0
+	err := store.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketPorts).Bucket([]byte(protocol)).Bucket(portName(port))
+		if day != "" {
+			bucket = bucket.Bucket(bucketDays).Bucket([]byte(day))
+		}
+		if sourceIPs := bucket.Bucket(bucketSourceIPs); sourceIPs != nil {
+			count = sourceIPs.Stats().KeyN
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestMissedStoreHits(t *testing.T) {
+	store, dir := openTestStore(t)
+	defer os.RemoveAll(dir)
+	defer store.Close()
+
+	first := time.Date(2026, 10, 18, 23, 59, 0, 0, time.UTC)
+	second := first.Add(2 * time.Minute)
+	store.Hit(layers.LayerTypeTCP, 23, "198.51.100.7", first)
+	store.Hit(layers.LayerTypeTCP, 23, "198.51.100.7", second)
+	store.Hit(layers.LayerTypeTCP, 23, "198.51.100.8", second)
+	store.Hit(layers.LayerTypeUDP, 161, "198.51.100.7", second)
+	// Port 0 isn't a port
+	store.Hit(layers.LayerTypeTCP, 0, "198.51.100.7", second)
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Sources already seen aren't new after a flush
+	store.Hit(layers.LayerTypeTCP, 23, "198.51.100.8", second)
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	ports, err := store.Ports()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ports) != 2 {
+		t.Fatalf("Got %d ports, expected 2: %+v", len(ports), ports)
+	}
+	telnet := ports[0]
+	if telnet.Protocol != "tcp" || telnet.Port != 23 || telnet.Count != 4 || telnet.Sources != 2 {
+		t.Errorf("Got %+v for tcp port 23", telnet)
+	}
+	if !telnet.FirstSeen.Equal(first) || !telnet.LastSeen.Equal(second) {
+		t.Errorf("Got first %s and last %s, expected %s and %s", telnet.FirstSeen, telnet.LastSeen, first, second)
+	}
+	if ports[1].Protocol != "udp" || ports[1].Port != 161 || ports[1].Count != 1 {
+		t.Errorf("Got %+v for udp port 161", ports[1])
+	}
+
+	days, err := store.Days(layers.LayerTypeTCP, 23)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(days) != 2 {
+		t.Fatalf("Got %d days, expected 2: %+v", len(days), days)
+	}
+	if days[0].Day != "2026-10-18" || days[0].Count != 1 || days[0].Sources != 1 {
+		t.Errorf("Got %+v for the first day", days[0])
+	}
+	if days[1].Day != "2026-10-19" || days[1].Count != 3 || days[1].Sources != 2 {
+		t.Errorf("Got %+v for the second day", days[1])
+	}
+	if days, err := store.Days(layers.LayerTypeTCP, 80); err != nil || len(days) != 0 {
+		t.Errorf("Got days %v and error %v for a port that was never hit", days, err)
+	}
+}
+
+func TestMissedStorePrune(t *testing.T) {
+	store, dir := openTestStore(t)
+	defer os.RemoveAll(dir)
+	defer store.Close()
+
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	old := now.Add(-sourceRetention - time.Hour)
+	store.Hit(layers.LayerTypeTCP, 23, "198.51.100.7", old)
+	store.Hit(layers.LayerTypeTCP, 23, "198.51.100.8", now.Add(-24*time.Hour))
+	store.Hit(layers.LayerTypeTCP, 23, "198.51.100.9", now)
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Prune(now); err != nil {
+		t.Fatal(err)
+	}
+
+	if count := sourceCount(t, store, "tcp", 23, ""); count != 2 {
+		t.Errorf("Kept %d source IPs for the port, expected 2", count)
+	}
+	oldDay := old.Format(dayFormat)
+	if count := sourceCount(t, store, "tcp", 23, oldDay); count != 0 {
+		t.Errorf("Kept %d source IPs for %s", count, oldDay)
+	}
+	// Yesterday is kept in case hits for it are flushed late
+	if count := sourceCount(t, store, "tcp", 23, "2026-10-18"); count != 1 {
+		t.Errorf("Kept %d source IPs for yesterday, expected 1", count)
+	}
+
+	ports, err := store.Ports()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ports[0].Count != 3 || ports[0].Sources != 3 {
+		t.Errorf("Counts changed when pruning: %+v", ports[0])
+	}
+
+	// A pruned source is new again when it comes back
+	store.Hit(layers.LayerTypeTCP, 23, "198.51.100.7", now)
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if ports, _ := store.Ports(); ports[0].Sources != 4 {
+		t.Errorf("Got %d sources after a pruned one came back, expected 4", ports[0].Sources)
+	}
+}
+
+func TestPruneSourcesMax(t *testing.T) {
+	store, dir := openTestStore(t)
+	defer os.RemoveAll(dir)
+	defer store.Close()
+
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		sourceIPs, err := tx.CreateBucket(bucketSourceIPs)
+		if err != nil {
+			return err
+		}
+		for i := 1; i <= 5; i++ {
+			sourceIPs.Put([]byte("198.51.100."+strconv.Itoa(i)), encodeUint(uint64(1000+i)))
+		}
+		pruned, err := pruneSources(sourceIPs, 1000, 3)
+		if pruned != 2 {
+			t.Errorf("Pruned %d source IPs, expected 2", pruned)
+		}
+		for i := 1; i <= 5; i++ {
+			kept := sourceIPs.Get([]byte("198.51.100."+strconv.Itoa(i))) != nil
+			if kept != (i > 2) {
+				t.Errorf("198.51.100.%d kept is %v, only the newest should be", i, kept)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMissedStoreLegacy(t *testing.T) {
+	store, dir := openTestStore(t)
+	defer os.RemoveAll(dir)
+	defer store.Close()
+
+	legacyPath := filepath.Join(dir, "missed.txt")
+	err := ioutil.WriteFile(legacyPath, []byte("   22|   10|    0\n   53|    0|    7\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.ImportLegacy(legacyPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.ImportLegacy(legacyPath); err == nil {
+		t.Error("The same database imported a missed.txt twice")
+	}
+
+	store.Hit(layers.LayerTypeTCP, 22, "198.51.100.7", time.Now())
+	for i := 0; i < legacyMaxCount+5; i++ {
+		store.Hit(layers.LayerTypeUDP, 161, "", time.Now())
+	}
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	exportPath := filepath.Join(dir, "export.txt")
+	if err := store.ExportLegacy(exportPath); err != nil {
+		t.Fatal(err)
+	}
+	exported, err := os.Open(exportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exported.Close()
+	lines := make([]string, 0, 65535)
+	scanner := bufio.NewScanner(exported)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 65535 {
+		t.Fatalf("Exported %d lines, expected 65535", len(lines))
+	}
+	expected := map[int]string{
+		22:  "   22|   11|    0",
+		53:  "   53|    0|    7",
+		161: "  161|    0|99999",
+		443: "  443|    0|    0",
+	}
+	for port, line := range expected {
+		if lines[port-1] != line {
+			t.Errorf("Got %q for port %d, expected %q", lines[port-1], port, line)
+		}
+	}
+
+	bad := filepath.Join(dir, "bad.txt")
+	ioutil.WriteFile(bad, []byte("22|10\n"), 0644)
+	other, otherDir := openTestStore(t)
+	defer os.RemoveAll(otherDir)
+	defer other.Close()
+	if err := other.ImportLegacy(bad); err == nil {
+		t.Error("No error for a corrupted missed.txt")
+	}
+}
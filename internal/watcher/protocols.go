@@ -0,0 +1,150 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package watcher
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Most bytes of ICMP echo data put on a record
+const maxEchoSnippet = 128
+
+// SCTP chunk types that start an association
+const (
+	sctpChunkInit       = 1
+	sctpChunkCookieEcho = 10
+)
+
+func echoSnippet(data []byte) []byte {
+	if len(data) > maxEchoSnippet {
+		return data[:maxEchoSnippet]
+	}
+	return data
+}
+
+// firstFragment decodes the transport header in the first fragment of an IPv4 packet. The
+// parser stops at the IPv4 layer when more fragments follow, but the first one has the whole
+// header. Returns the layer decoded, or false if there isn't one or it's cut short.
+func (h *packetHandler) firstFragment() (gopacket.LayerType, bool) {
+	if h.ip4.Flags&layers.IPv4MoreFragments == 0 || h.ip4.FragOffset != 0 {
+		return gopacket.LayerTypeZero, false
+	}
+	var layer gopacket.DecodingLayer
+	var layerType gopacket.LayerType
+	switch h.ip4.Protocol {
+	case layers.IPProtocolTCP:
+		layer, layerType = &h.tcp, layers.LayerTypeTCP
+	case layers.IPProtocolUDP:
+		layer, layerType = &h.udp, layers.LayerTypeUDP
+	case layers.IPProtocolICMPv4:
+		layer, layerType = &h.icmp4, layers.LayerTypeICMPv4
+	default:
+		return gopacket.LayerTypeZero, false
+	}
+	if layer.DecodeFromBytes(h.ip4.Payload, gopacket.NilDecodeFeedback) != nil {
+		return gopacket.LayerTypeZero, false
+	}
+	return layerType, true
+}
+
+// observeOther records a packet that isn't TCP or UDP. There are no ports, so port is
+// whatever identifies what was asked for, like the ICMP type. An empty technique
+// keeps the packet out of scan detection.
+func (h *packetHandler) observeOther(protocol gopacket.LayerType, source string, target string, port uint16, snippet []byte, technique string, now time.Time) {
+	h.missedStore.Hit(protocol, port, source, now)
+	h.events.observe(protocol, source, 0, port, nil, snippet, now)
+	if technique != "" {
+		h.scans.observe(protocol, source, target, port, technique, now)
+	}
+}
+
+func (h *packetHandler) handleICMPv4(source string, target string, now time.Time) {
+	icmpType := h.icmp4.TypeCode.Type()
+	switch icmpType {
+	case layers.ICMPv4TypeDestinationUnreachable:
+		h.handleICMP("icmp", source, BackscatterUnreachable, h.icmp4.Payload, now)
+	case layers.ICMPv4TypeTimeExceeded:
+		h.handleICMP("icmp", source, BackscatterTimeExceeded, h.icmp4.Payload, now)
+	case layers.ICMPv4TypeSourceQuench, layers.ICMPv4TypeParameterProblem:
+		h.handleICMP("icmp", source, BackscatterICMPOther, h.icmp4.Payload, now)
+	case layers.ICMPv4TypeEchoReply:
+		// We don't ping anyone, so these are replies to pings spoofed from us
+		h.backscatter.observe(BackscatterEchoReply, "icmp", source, source, 0, now)
+	case layers.ICMPv4TypeEchoRequest:
+		h.observeOther(layers.LayerTypeICMPv4, source, target, uint16(icmpType), echoSnippet(h.icmp4.Payload), "ICMP", now)
+	default:
+		h.observeOther(layers.LayerTypeICMPv4, source, target, uint16(icmpType), nil, "ICMP", now)
+	}
+}
+
+func (h *packetHandler) handleICMPv6(source string, target string, now time.Time) {
+	icmpType := h.icmp6.TypeCode.Type()
+	// Errors and echoes have 4 more bytes of header before their data
+	var body []byte
+	if len(h.icmp6.Payload) >= 4 {
+		body = h.icmp6.Payload[4:]
+	}
+
+	switch icmpType {
+	case layers.ICMPv6TypeDestinationUnreachable:
+		h.handleICMP("icmpv6", source, BackscatterUnreachable, body, now)
+	case layers.ICMPv6TypeTimeExceeded:
+		h.handleICMP("icmpv6", source, BackscatterTimeExceeded, body, now)
+	case layers.ICMPv6TypePacketTooBig, layers.ICMPv6TypeParameterProblem:
+		h.handleICMP("icmpv6", source, BackscatterICMPOther, body, now)
+	case layers.ICMPv6TypeEchoReply:
+		h.backscatter.observe(BackscatterEchoReply, "icmpv6", source, source, 0, now)
+	case layers.ICMPv6TypeEchoRequest:
+		h.observeOther(layers.LayerTypeICMPv6, source, target, uint16(icmpType), echoSnippet(body), "ICMPv6", now)
+	case layers.ICMPv6TypeRouterSolicitation, layers.ICMPv6TypeRouterAdvertisement, layers.ICMPv6TypeNeighborSolicitation,
+		layers.ICMPv6TypeNeighborAdvertisement, layers.ICMPv6TypeRedirect:
+		// Neighbor discovery goes to a different multicast address for every target, so normal
+		// traffic from a router would look like a sweep
+		h.observeOther(layers.LayerTypeICMPv6, source, target, uint16(icmpType), nil, "", now)
+	default:
+		h.observeOther(layers.LayerTypeICMPv6, source, target, uint16(icmpType), nil, "ICMPv6", now)
+	}
+}
+
+// handleOtherIP handles the IP protocols that aren't decoded by the parser
+func (h *packetHandler) handleOtherIP(protocol layers.IPProtocol, payload []byte, isIPv6 bool, source string, target string, now time.Time) {
+	switch protocol {
+	case layers.IPProtocolSCTP:
+		// Common header has the ports, followed by the first chunk
+		if len(payload) < 13 {
+			return
+		}
+		port := binary.BigEndian.Uint16(payload[2:4])
+		technique := "SCTP"
+		switch payload[12] {
+		case sctpChunkInit:
+			technique = "SCTP INIT"
+		case sctpChunkCookieEcho:
+			technique = "SCTP COOKIE-ECHO"
+		}
+		h.observeOther(layers.LayerTypeSCTP, source, target, port, nil, technique, now)
+	case layers.IPProtocolGRE:
+		// Keyed by the protocol carried inside
+		if len(payload) < 4 {
+			return
+		}
+		h.observeOther(layers.LayerTypeGRE, source, target, binary.BigEndian.Uint16(payload[2:4]), nil, "", now)
+	case layers.IPProtocolIPv6HopByHop, layers.IPProtocolIPv6Fragment, layers.IPProtocolNoNextHeader:
+		// IPv6 extension headers aren't followed
+	case layers.IPProtocolTCP, layers.IPProtocolUDP, layers.IPProtocolICMPv4, layers.IPProtocolICMPv6:
+		// Decoded by the parser, so these got here because their header was cut short
+	default:
+		// Protocol sweeps show up as vertical scans across protocol numbers
+		ipLayer := layers.LayerTypeIPv4
+		if isIPv6 {
+			ipLayer = layers.LayerTypeIPv6
+		}
+		h.observeOther(ipLayer, source, target, uint16(protocol), nil, "IP protocol", now)
+	}
+}
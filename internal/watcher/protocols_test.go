@@ -0,0 +1,100 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package watcher
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/bocajspear1/honeypoke-go/internal/recorder"
+)
+
+// ipv4Packet serializes an IPv4 packet from source to 192.0.2.10 carrying the layers
+func ipv4Packet(t *testing.T, source string, flags layers.IPv4Flag, fragOffset uint16, protocol layers.IPProtocol, payload ...gopacket.SerializableLayer) []byte {
+	ip := &layers.IPv4{
+		Version:    4,
+		TTL:        64,
+		Flags:      flags,
+		FragOffset: fragOffset,
+		Protocol:   protocol,
+		SrcIP:      net.ParseIP(source).To4(),
+		DstIP:      net.ParseIP("192.0.2.10").To4(),
+	}
+	for _, layer := range payload {
+		if tcp, ok := layer.(*layers.TCP); ok {
+			tcp.SetNetworkLayerForChecksum(ip)
+		} else if udp, ok := layer.(*layers.UDP); ok {
+			udp.SetNetworkLayerForChecksum(ip)
+		}
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, append([]gopacket.SerializableLayer{ip}, payload...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestHandleProtocols(t *testing.T) {
+	store, dir := openTestStore(t)
+	defer os.RemoveAll(dir)
+	defer store.Close()
+
+	recChan := make(chan *recorder.HoneypokeRecord, 20)
+	config := Config{Events: EventConfig{Enabled: true, Aggregate: AggregateNone, RecChan: recChan}}
+	handler := newPacketHandler(config, store, map[uint16]bool{}, map[string]bool{"192.0.2.10": true}, false)
+
+	syn := &layers.TCP{SrcPort: 40000, DstPort: 23, Seq: 1000, SYN: true, Window: 1024}
+	data := gopacket.Payload(make([]byte, 32))
+	sctpInit := gopacket.Payload([]byte{0x9c, 0x40, 0x0b, 0x59, 0, 0, 0, 0, 0, 0, 0, 0, sctpChunkInit, 0, 0, 20})
+	mf := layers.IPv4MoreFragments
+
+	tests := []struct {
+		name     string
+		packet   []byte
+		protocol string
+		port     int
+	}{
+		{"tcp", ipv4Packet(t, "198.51.100.7", 0, 0, layers.IPProtocolTCP, syn), "tcp", 23},
+		{"tcp first fragment", ipv4Packet(t, "198.51.100.7", mf, 0, layers.IPProtocolTCP, syn, data), "tcp", 23},
+		{"udp first fragment", ipv4Packet(t, "198.51.100.7", mf, 0, layers.IPProtocolUDP, &layers.UDP{SrcPort: 40000, DstPort: 161}, data), "udp", 161},
+		{
+			"icmp first fragment",
+			ipv4Packet(t, "198.51.100.7", mf, 0, layers.IPProtocolICMPv4, &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0)}, data),
+			"icmp",
+			8,
+		},
+		{"first fragment too short for the header", ipv4Packet(t, "198.51.100.7", mf, 0, layers.IPProtocolTCP, gopacket.Payload(make([]byte, 8))), "", 0},
+		{"later fragment", ipv4Packet(t, "198.51.100.7", 0, 4, layers.IPProtocolTCP, data), "", 0},
+		{"sctp", ipv4Packet(t, "198.51.100.7", 0, 0, layers.IPProtocolSCTP, sctpInit), "sctp", 2905},
+		{"gre", ipv4Packet(t, "198.51.100.7", 0, 0, layers.IPProtocolGRE, gopacket.Payload([]byte{0, 0, 0x08, 0x00})), "gre", 2048},
+		{"other protocol", ipv4Packet(t, "198.51.100.7", 0, 0, layers.IPProtocol(99), data), "ip", 99},
+		{"from us", ipv4Packet(t, "192.0.2.10", 0, 0, layers.IPProtocol(99), data), "", 0},
+	}
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler.handle(test.packet, gopacket.CaptureInfo{Timestamp: now}, layers.LinkTypeRaw, now)
+			if test.protocol == "" {
+				if len(recChan) != 0 {
+					t.Errorf("Got a record: %+v", <-recChan)
+				}
+				return
+			}
+			if len(recChan) != 1 {
+				t.Fatalf("Got %d records, expected 1", len(recChan))
+			}
+			record := <-recChan
+			if record.Protocol != test.protocol || record.Port != test.port {
+				t.Errorf("Got %s port %d, expected %s port %d", record.Protocol, record.Port, test.protocol, test.port)
+			}
+		})
+	}
+}
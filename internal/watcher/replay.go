@@ -0,0 +1,185 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package watcher
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+// StreamFunc hands a TCP stream reassembled from a capture to the listener on port
+type StreamFunc func(port uint16, source string, sourcePort uint16, data []byte, started time.Time)
+
+// Most bytes kept from a replayed stream, the listeners stop reading well before this
+const maxStreamSize = 64 * 1024
+
+// How long a replayed stream can go without packets before it's handed over anyway
+const streamTimeout = 2 * time.Minute
+
+// streamReplay reassembles the client side of TCP connections to our listeners
+type streamReplay struct {
+	ports     map[uint16]bool
+	handler   StreamFunc
+	assembler *tcpassembly.Assembler
+	lastFlush time.Time
+}
+
+type replayStream struct {
+	handler    StreamFunc
+	source     string
+	sourcePort uint16
+	port       uint16
+	started    time.Time
+	data       []byte
+}
+
+func (s *streamReplay) New(netFlow gopacket.Flow, tcpFlow gopacket.Flow) tcpassembly.Stream {
+	return &replayStream{
+		handler:    s.handler,
+		source:     netFlow.Src().String(),
+		sourcePort: binary.BigEndian.Uint16(tcpFlow.Src().Raw()),
+		port:       binary.BigEndian.Uint16(tcpFlow.Dst().Raw()),
+	}
+}
+
+func (r *replayStream) Reassembled(reassemblies []tcpassembly.Reassembly) {
+	for _, reassembly := range reassemblies {
+		if r.started.IsZero() {
+			r.started = reassembly.Seen
+		}
+		room := maxStreamSize - len(r.data)
+		if room <= 0 {
+			return
+		}
+		if len(reassembly.Bytes) > room {
+			reassembly.Bytes = reassembly.Bytes[:room]
+		}
+		r.data = append(r.data, reassembly.Bytes...)
+	}
+}
+
+func (r *replayStream) ReassemblyComplete() {
+	// Only the client side is captured, so a connection that never sent anything
+	// can't be told apart from a SYN scan, and is left out
+	if len(r.data) == 0 {
+		return
+	}
+	r.handler(r.port, r.source, r.sourcePort, r.data, r.started)
+}
+
+func newStreamReplay(ports []uint16, handler StreamFunc) *streamReplay {
+	replay := &streamReplay{
+		ports:   make(map[uint16]bool),
+		handler: handler,
+	}
+	for _, port := range ports {
+		replay.ports[port] = true
+	}
+	replay.assembler = tcpassembly.NewAssembler(tcpassembly.NewStreamPool(replay))
+	return replay
+}
+
+func (s *streamReplay) assemble(netFlow gopacket.Flow, tcp *layers.TCP, now time.Time) {
+	s.assembler.AssembleWithTimestamp(netFlow, tcp, now)
+	if now.Sub(s.lastFlush) >= streamTimeout {
+		s.assembler.FlushOlderThan(now.Add(-streamTimeout))
+		s.lastFlush = now
+	}
+}
+
+// streamFilter matches the client side of connections to the stream ports
+func streamFilter(ports []uint16) string {
+	filter := ""
+	for _, port := range ports {
+		if filter != "" {
+			filter += " or "
+		}
+		filter += "tcp dst port " + strconv.Itoa(int(port))
+	}
+	return filter
+}
+
+// Replay feeds a capture file through the watcher, producing the same records as if it had
+// been seen live. Packet times are used throughout, and if streams is set, TCP streams to
+// streamPorts are reassembled and handed to it. Adaptive listeners are never opened from a replay.
+func Replay(config Config, path string, streamPorts []uint16, streams StreamFunc) error {
+	missedStore, err := OpenMissedStore(config.MissedPath)
+	if err != nil {
+		return err
+	}
+	defer missedStore.Close()
+
+	pcapHandle, err := pcap.OpenOffline(path)
+	if err != nil {
+		return err
+	}
+	defer pcapHandle.Close()
+
+	// The rolling capture is only for live sessions
+	config.Capture = false
+	pcapFilter, excluded, local, err := watcherFilter(config)
+	if err != nil {
+		// Captures can come from somewhere else, so this isn't fatal like it is live
+		log.Printf("%s, replaying without leaving out our own traffic\n", err)
+	}
+	if streams != nil && len(streamPorts) > 0 && pcapFilter != "" {
+		pcapFilter = "(" + pcapFilter + ") or (" + streamFilter(streamPorts) + ")"
+	}
+	if pcapFilter != "" {
+		err = pcapHandle.SetBPFFilter(pcapFilter)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Replaying %s...\n", path)
+	packets, err := replayPackets(config, missedStore, pcapHandle, pcapHandle.LinkType(), excluded, local, streamPorts, streams)
+	if err != nil {
+		return err
+	}
+	log.Printf("Replayed %d packets from %s\n", packets, path)
+	return nil
+}
+
+// replayPackets runs every packet from source through a new handler, then sends what's
+// left once the packets run out
+func replayPackets(config Config, missedStore *MissedStore, source gopacket.PacketDataSource, linkType layers.LinkType, excluded map[uint16]bool, local map[string]bool, streamPorts []uint16, streams StreamFunc) (int, error) {
+	if _, ok := linkLayer(linkType, nil); !ok {
+		return 0, fmt.Errorf("Unsupported link type %s", linkType)
+	}
+
+	config.Adaptive.Enabled = false
+	handler := newPacketHandler(config, missedStore, excluded, local, false)
+	if streams != nil {
+		handler.streams = newStreamReplay(streamPorts, streams)
+	}
+
+	packets := 0
+	var last time.Time
+	pcapPacket := gopacket.NewPacketSource(source, linkType)
+	for packet := range pcapPacket.Packets() {
+		last = packet.Metadata().Timestamp
+		handler.handle(packet.Data(), packet.Metadata().CaptureInfo, linkType, last)
+		handler.events.advance(last)
+		handler.scans.advance(last)
+		handler.backscatter.advance(last)
+		packets++
+	}
+
+	// The capture is over, so everything still open is finished
+	if handler.streams != nil {
+		handler.streams.assembler.FlushAll()
+	}
+	handler.finish(config, last)
+	return packets, nil
+}
@@ -0,0 +1,104 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/pcapgo"
+
+	"github.com/bocajspear1/honeypoke-go/internal/recorder"
+)
+
+type replayedStream struct {
+	port       uint16
+	source     string
+	sourcePort uint16
+	data       string
+}
+
+// testdata/replay.pcap has a client sending a request to port 80, a SYN to 23 and a UDP packet
+// to 161 from another source, then a second IPv4 fragment that shouldn't be counted
+func TestReplayPackets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "honeypoke")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	missedStore, err := OpenMissedStore(filepath.Join(dir, "missed.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer missedStore.Close()
+
+	file, err := os.Open("testdata/replay.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := pcapgo.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recChan := make(chan *recorder.HoneypokeRecord, 10)
+	config := Config{
+		Events: EventConfig{Enabled: true, Aggregate: AggregateSource, Window: time.Minute, RecChan: recChan},
+	}
+	excluded := map[uint16]bool{80: true}
+	streams := make([]replayedStream, 0)
+	handler := func(port uint16, source string, sourcePort uint16, data []byte, started time.Time) {
+		streams = append(streams, replayedStream{port, source, sourcePort, string(data)})
+	}
+
+	packets, err := replayPackets(config, missedStore, reader, reader.LinkType(), excluded, map[string]bool{}, []uint16{80}, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packets != 6 {
+		t.Errorf("Replayed %d packets, expected 6", packets)
+	}
+
+	expectedStreams := []replayedStream{{80, "198.51.100.7", 40000, "GET / HTTP/1.0\r\n\r\n"}}
+	if !reflect.DeepEqual(streams, expectedStreams) {
+		t.Errorf("Got streams %+v, expected %+v", streams, expectedStreams)
+	}
+
+	err = missedStore.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := missedStore.Ports()
+	if err != nil {
+		t.Fatal(err)
+	}
+	missed := make(map[string]uint64)
+	for _, stat := range stats {
+		missed[stat.Protocol+"/"+strconv.Itoa(int(stat.Port))] = stat.Count
+	}
+	expectedMissed := map[string]uint64{"tcp/23": 1, "udp/161": 1}
+	if !reflect.DeepEqual(missed, expectedMissed) {
+		t.Errorf("Got missed ports %v, expected %v", missed, expectedMissed)
+	}
+
+	close(recChan)
+	records := make(map[string][]int)
+	for record := range recChan {
+		if record.RemoteIP != "203.0.113.5" {
+			t.Errorf("Got a missed port event from %s", record.RemoteIP)
+		}
+		records[record.Protocol] = record.Ports
+	}
+	expectedRecords := map[string][]int{"tcp": {23}, "udp": {161}}
+	if !reflect.DeepEqual(records, expectedRecords) {
+		t.Errorf("Got missed port events %v, expected %v", records, expectedRecords)
+	}
+}
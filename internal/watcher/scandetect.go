@@ -0,0 +1,288 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package watcher
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/bocajspear1/honeypoke-go/internal/fingerprint"
+	"github.com/bocajspear1/honeypoke-go/internal/recorder"
+)
+
+// Scan types, a source can be both at once
+const (
+	ScanVertical   = "vertical"
+	ScanHorizontal = "horizontal"
+	ScanBoth       = "vertical,horizontal"
+)
+
+// How often sources are checked to see if their scan is over
+const scanCheckInterval = 10 * time.Second
+
+// Most port/target pairs tracked for one source, so a huge scan can't use up all our memory
+const maxScanTuples = 100000
+
+// Most sources tracked at once. When there are more, the ones that have been quiet the
+// longest are finished early, a tenth at a time.
+const maxScanSources = 10000
+
+// ScanConfig controls detecting port scans and sweeps
+type ScanConfig struct {
+	Enabled bool
+	// Ports hit on a single target to be a vertical scan
+	MinPorts int
+	// Targets hit on a single port to be a horizontal sweep
+	MinHosts int
+	// How long a source has to be quiet for its scan to be over
+	Idle    time.Duration
+	RecChan chan *recorder.HoneypokeRecord
+}
+
+type scanTarget struct {
+	host string
+	port uint16
+}
+
+type scanSource struct {
+	first      time.Time
+	last       time.Time
+	packets    int
+	protocols  map[string]bool
+	tuples     map[scanTarget]bool
+	techniques map[string]int
+}
+
+// scanDetector classifies sources by how they probe our ports
+type scanDetector struct {
+	config    ScanConfig
+	lock      sync.Mutex
+	sources   map[string]*scanSource
+	lastCheck time.Time
+}
+
+// newScanDetector sets up scan detection. Without background, scans are only finished
+// by calling advance, which is used to follow the packet times when replaying.
+func newScanDetector(config ScanConfig, background bool) *scanDetector {
+	detector := &scanDetector{
+		config:  config,
+		sources: make(map[string]*scanSource),
+	}
+	if background && config.Enabled {
+		running.Add(1)
+		go detector.run()
+	}
+	return detector
+}
+
+// scanTechnique names the kind of scan a TCP packet is from, using its flags
+func scanTechnique(tcp *layers.TCP) string {
+	switch {
+	case tcp.SYN && !tcp.ACK && !tcp.FIN && !tcp.RST:
+		return "SYN"
+	case !tcp.SYN && !tcp.ACK && !tcp.FIN && !tcp.RST && !tcp.PSH && !tcp.URG:
+		return "NULL"
+	case tcp.FIN && tcp.PSH && tcp.URG && !tcp.SYN && !tcp.ACK:
+		return "Xmas"
+	case tcp.FIN && !tcp.SYN && !tcp.ACK && !tcp.RST && !tcp.PSH && !tcp.URG:
+		return "FIN"
+	case tcp.ACK && !tcp.SYN && !tcp.FIN && !tcp.RST && !tcp.PSH && !tcp.URG:
+		return "ACK"
+	}
+	return "other"
+}
+
+// observe tracks a packet from a source to one of our addresses
+func (d *scanDetector) observe(protocol gopacket.LayerType, source string, target string, port uint16, technique string, now time.Time) {
+	if !d.config.Enabled || source == "" {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	scanner, ok := d.sources[source]
+	if !ok {
+		if len(d.sources) >= maxScanSources {
+			// Sending the records can block, and the capture loop can't wait on it
+			go d.finish(d.evict(maxScanSources / 10))
+		}
+		scanner = &scanSource{
+			first:      now,
+			protocols:  make(map[string]bool),
+			tuples:     make(map[scanTarget]bool),
+			techniques: make(map[string]int),
+		}
+		d.sources[source] = scanner
+	}
+
+	scanner.last = now
+	scanner.packets++
+	scanner.protocols[protocolName(protocol)] = true
+	scanner.techniques[technique]++
+	if len(scanner.tuples) < maxScanTuples {
+		scanner.tuples[scanTarget{host: target, port: port}] = true
+	}
+}
+
+// summarize builds a scan record for a source, or nil if it doesn't look like a scan
+func (d *scanDetector) summarize(source string, scanner *scanSource) *recorder.HoneypokeRecord {
+	portsPerHost := make(map[string]int)
+	hostsPerPort := make(map[uint16]int)
+	ports := make(map[uint16]bool)
+	hosts := make(map[string]bool)
+	for tuple := range scanner.tuples {
+		portsPerHost[tuple.host]++
+		hostsPerPort[tuple.port]++
+		ports[tuple.port] = true
+		hosts[tuple.host] = true
+	}
+
+	vertical := false
+	for _, count := range portsPerHost {
+		if count >= d.config.MinPorts {
+			vertical = true
+		}
+	}
+	horizontal := false
+	for _, count := range hostsPerPort {
+		if count >= d.config.MinHosts {
+			horizontal = true
+		}
+	}
+
+	if !vertical && !horizontal {
+		return nil
+	}
+
+	record := recorder.NewRecord(source, 0)
+	record.Kind = recorder.KindScan
+	record.RemoteIP = source
+	if vertical && horizontal {
+		record.ScanType = ScanBoth
+	} else if vertical {
+		record.ScanType = ScanVertical
+	} else {
+		record.ScanType = ScanHorizontal
+	}
+
+	protocols := make([]string, 0, len(scanner.protocols))
+	for protocol := range scanner.protocols {
+		protocols = append(protocols, protocol)
+	}
+	sort.Strings(protocols)
+	if len(protocols) == 1 {
+		record.Protocol = protocols[0]
+	} else {
+		record.Protocol = "mixed"
+	}
+
+	// The technique used for most of the scan
+	mostUsed := 0
+	for technique, count := range scanner.techniques {
+		if count > mostUsed || (count == mostUsed && technique < record.ScanTechnique) {
+			record.ScanTechnique = technique
+			mostUsed = count
+		}
+	}
+
+	for port := range ports {
+		if len(record.Ports) >= maxEventPorts {
+			break
+		}
+		record.Ports = append(record.Ports, int(port))
+	}
+	sort.Ints(record.Ports)
+
+	record.Count = scanner.packets
+	record.DistinctTargets = len(hosts)
+	record.Duration = scanner.last.Sub(scanner.first).Seconds()
+	if record.Duration > 0 {
+		record.Rate = float64(scanner.packets) / record.Duration
+	}
+	record.Time = scanner.first.UTC().Format("2006-01-02T15:04:05-0700")
+	if result, ok := fingerprint.LookupSource(source); ok {
+		addFingerprint(record, result)
+	}
+
+	return record
+}
+
+// evict removes the count sources that have been quiet the longest and returns them.
+// Expects the lock to be held.
+func (d *scanDetector) evict(count int) map[string]*scanSource {
+	sources := make([]string, 0, len(d.sources))
+	for source := range d.sources {
+		sources = append(sources, source)
+	}
+	sort.Slice(sources, func(i, j int) bool { return d.sources[sources[i]].last.Before(d.sources[sources[j]].last) })
+	if count > len(sources) {
+		count = len(sources)
+	}
+
+	evicted := make(map[string]*scanSource, count)
+	for _, source := range sources[:count] {
+		evicted[source] = d.sources[source]
+		delete(d.sources, source)
+	}
+	return evicted
+}
+
+// finish sends a record for each of the sources that was scanning
+func (d *scanDetector) finish(finished map[string]*scanSource) {
+	for source, scanner := range finished {
+		record := d.summarize(source, scanner)
+		if record != nil {
+			d.config.RecChan <- record
+		}
+	}
+}
+
+// check finishes scans from sources that have gone quiet
+func (d *scanDetector) check(now time.Time) {
+	finished := make(map[string]*scanSource)
+
+	d.lock.Lock()
+	for source, scanner := range d.sources {
+		if now.Sub(scanner.last) >= d.config.Idle {
+			finished[source] = scanner
+			delete(d.sources, source)
+		}
+	}
+	d.lock.Unlock()
+
+	d.finish(finished)
+}
+
+// advance finishes quiet scans once now has moved a check interval along
+func (d *scanDetector) advance(now time.Time) {
+	if !d.config.Enabled {
+		return
+	}
+	if d.lastCheck.IsZero() {
+		d.lastCheck = now
+	} else if now.Sub(d.lastCheck) >= scanCheckInterval {
+		d.check(now)
+		d.lastCheck = now
+	}
+}
+
+func (d *scanDetector) run() {
+	defer running.Done()
+	ticker := time.NewTicker(scanCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			d.check(now)
+		case <-stopping:
+			return
+		}
+	}
+}
@@ -0,0 +1,143 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/. */
+
+package watcher
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/bocajspear1/honeypoke-go/internal/recorder"
+)
+
+func TestScanTechnique(t *testing.T) {
+	tests := []struct {
+		tcp      layers.TCP
+		expected string
+	}{
+		{layers.TCP{SYN: true}, "SYN"},
+		{layers.TCP{SYN: true, ECE: true, CWR: true}, "SYN"},
+		{layers.TCP{}, "NULL"},
+		{layers.TCP{FIN: true, PSH: true, URG: true}, "Xmas"},
+		{layers.TCP{FIN: true}, "FIN"},
+		{layers.TCP{ACK: true}, "ACK"},
+		{layers.TCP{SYN: true, ACK: true}, "other"},
+		{layers.TCP{RST: true}, "other"},
+	}
+	for _, test := range tests {
+		if technique := scanTechnique(&test.tcp); technique != test.expected {
+			t.Errorf("Got %s for %v, expected %s", technique, tcpFlagNames(&test.tcp), test.expected)
+		}
+	}
+}
+
+func testScanDetector() *scanDetector {
+	config := ScanConfig{Enabled: true, MinPorts: 5, MinHosts: 3, Idle: time.Minute, RecChan: make(chan *recorder.HoneypokeRecord, 10)}
+	return newScanDetector(config, false)
+}
+
+func TestScanDetector(t *testing.T) {
+	detector := testScanDetector()
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	detector.advance(start)
+
+	// A vertical SYN scan with a couple of FINs
+	for port := uint16(20); port < 30; port++ {
+		detector.observe(layers.LayerTypeTCP, "198.51.100.7", "192.0.2.10", port, "SYN", start.Add(time.Duration(port-20)*time.Second))
+	}
+	detector.observe(layers.LayerTypeTCP, "198.51.100.7", "192.0.2.10", 80, "FIN", start.Add(10*time.Second))
+	// A horizontal UDP sweep
+	for host := 10; host < 13; host++ {
+		detector.observe(layers.LayerTypeUDP, "198.51.100.8", "192.0.2."+strconv.Itoa(host), 161, "UDP", start)
+	}
+	// Both, across protocols
+	for port := uint16(1); port <= 5; port++ {
+		detector.observe(layers.LayerTypeTCP, "198.51.100.9", "192.0.2.10", port, "SYN", start)
+	}
+	for host := 11; host < 13; host++ {
+		detector.observe(layers.LayerTypeUDP, "198.51.100.9", "192.0.2."+strconv.Itoa(host), 1, "UDP", start)
+	}
+	// Not enough to be a scan
+	detector.observe(layers.LayerTypeTCP, "198.51.100.10", "192.0.2.10", 22, "SYN", start)
+	detector.observe(layers.LayerTypeTCP, "", "192.0.2.10", 22, "SYN", start)
+
+	// Nothing is finished until the sources have been quiet for long enough
+	detector.advance(start.Add(scanCheckInterval))
+	if len(detector.config.RecChan) != 0 {
+		t.Fatal("Scan finished before the source went quiet")
+	}
+	detector.advance(start.Add(time.Minute + 10*time.Second))
+	if len(detector.sources) != 0 {
+		t.Errorf("%d sources left after they all went quiet", len(detector.sources))
+	}
+
+	records := make(map[string]*recorder.HoneypokeRecord)
+	for len(detector.config.RecChan) > 0 {
+		record := <-detector.config.RecChan
+		records[record.RemoteIP] = record
+	}
+	if len(records) != 3 {
+		t.Fatalf("Got %d scan records, expected 3", len(records))
+	}
+
+	vertical := records["198.51.100.7"]
+	if vertical.Kind != recorder.KindScan || vertical.ScanType != ScanVertical || vertical.ScanTechnique != "SYN" || vertical.Protocol != "tcp" {
+		t.Errorf("Got %+v for the vertical scan", vertical)
+	}
+	if vertical.Count != 11 || vertical.DistinctTargets != 1 || vertical.Duration != 10 || vertical.Rate != 1.1 || len(vertical.Ports) != 11 {
+		t.Errorf("Got count %d, targets %d, duration %f, rate %f and ports %v", vertical.Count, vertical.DistinctTargets, vertical.Duration, vertical.Rate, vertical.Ports)
+	}
+	if vertical.Time != "2026-10-19T12:00:00+0000" {
+		t.Errorf("Got time %s, expected the start of the scan", vertical.Time)
+	}
+	horizontal := records["198.51.100.8"]
+	if horizontal.ScanType != ScanHorizontal || horizontal.ScanTechnique != "UDP" || !reflect.DeepEqual(horizontal.Ports, []int{161}) || horizontal.DistinctTargets != 3 {
+		t.Errorf("Got %+v for the horizontal sweep", horizontal)
+	}
+	both := records["198.51.100.9"]
+	if both.ScanType != ScanBoth || both.Protocol != "mixed" || both.ScanTechnique != "SYN" {
+		t.Errorf("Got %+v for the mixed scan", both)
+	}
+}
+
+func TestScanDetectorMaxSources(t *testing.T) {
+	detector := testScanDetector()
+	detector.config.RecChan = make(chan *recorder.HoneypokeRecord, 1)
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	// The quietest source is a scan, so it's sent when it's evicted
+	for port := uint16(1); port <= 5; port++ {
+		detector.observe(layers.LayerTypeTCP, "198.51.100.7", "192.0.2.10", port, "SYN", start)
+	}
+	for i := 1; i < maxScanSources; i++ {
+		detector.observe(layers.LayerTypeTCP, strconv.Itoa(i), "192.0.2.10", 22, "SYN", start.Add(time.Duration(i)*time.Millisecond))
+	}
+	if len(detector.sources) != maxScanSources {
+		t.Fatalf("Tracking %d sources, expected %d", len(detector.sources), maxScanSources)
+	}
+
+	detector.observe(layers.LayerTypeTCP, "198.51.100.8", "192.0.2.10", 22, "SYN", start.Add(time.Minute))
+	if count := len(detector.sources); count != maxScanSources-maxScanSources/10+1 {
+		t.Errorf("Tracking %d sources after evicting", count)
+	}
+	if _, ok := detector.sources["198.51.100.7"]; ok {
+		t.Error("The source that was quiet the longest wasn't evicted")
+	}
+	if _, ok := detector.sources[strconv.Itoa(maxScanSources-1)]; !ok {
+		t.Error("The newest source was evicted")
+	}
+
+	select {
+	case record := <-detector.config.RecChan:
+		if record.RemoteIP != "198.51.100.7" || record.ScanType != ScanVertical {
+			t.Errorf("Got %+v for the evicted scan", record)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("No record for the evicted scan")
+	}
+}
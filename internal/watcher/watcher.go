@@ -5,175 +5,621 @@
 package watcher
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
-	"os"
-	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+
+	"github.com/bocajspear1/honeypoke-go/internal/capture"
+	"github.com/bocajspear1/honeypoke-go/internal/fingerprint"
 )
 
 // https://godoc.org/github.com/google/gopacket
 // https://godoc.org/github.com/google/gopacket/pcap
 
-const portCountLength = 5
+// Config holds the settings for the missed port watcher
+type Config struct {
+	// Interfaces to capture on, "any" captures on all of them
+	Interfaces []string
+	Filter     string
+	MissedPath string
+	Adaptive   AdaptiveConfig
+	Events     EventConfig
+	Scans      ScanConfig
+	// TCP ports that are left out of Filter, since something else handles them
+	ExcludedTCPPorts []uint16
+	// Fingerprint SYNs, including those sent to ExcludedTCPPorts
+	Fingerprint bool
+	// Add TCP packets to the rolling capture, letting through both sides of sessions on SessionPorts
+	Capture      bool
+	SessionPorts []uint16
+	// UDP listener ports, errors about replies from these mean we were used for reflection
+	UDPPorts    []uint16
+	Backscatter BackscatterConfig
+	// Capture with AF_PACKET instead of libpcap
+	AFPacket AFPacketConfig
+	// Added to the whole filter, after everything else
+	ExtraFilter string
+}
 
-func logPacket(protocol gopacket.LayerType, port uint16, outFile *os.File) {
+// Closed to stop the live watcher
+var stopping = make(chan bool)
 
-	if port == 0 {
-		return
-	}
+// The live watcher and the goroutines sending records in the background
+var running sync.WaitGroup
 
-	lineLength := (int64)(6 + portCountLength + 1 + portCountLength + 1)
-	offset := (int64)(port-1)*lineLength + 6
-	outFile.Seek(offset, 0)
+// Lets SYNs through the filter for fingerprinting. IPv6 is only matched without extension headers.
+const synFilter = "(ip and tcp[tcpflags] & (tcp-syn|tcp-ack) == tcp-syn) or (ip6 and ip6[6] == 6 and ip6[53] & 0x12 == 0x02)"
 
-	intBuffer := make([]byte, portCountLength)
-	if protocol == layers.LayerTypeTCP {
-		outFile.Read(intBuffer)
-	} else if protocol == layers.LayerTypeUDP {
-		outFile.Seek((int64)(portCountLength+1), 1)
-		outFile.Read(intBuffer)
-	} else {
-		return
+// The running watcher, so it can be reloaded
+var live struct {
+	lock    sync.Mutex
+	config  Config
+	filter  string
+	handler *packetHandler
+	// Changes the filter on every socket being captured from
+	setFilter func(filter string) error
+}
+
+// watchedPorts is what the handler knows about our ports and addresses, which is swapped
+// out when the watcher is reloaded
+type watchedPorts struct {
+	excluded     map[uint16]bool
+	udpListeners map[uint16]bool
+	local        map[string]bool
+	// Only set when capturing sessions
+	sessionPorts map[uint16]bool
+}
+
+func newWatchedPorts(config Config, excluded map[uint16]bool, local map[string]bool) *watchedPorts {
+	ports := &watchedPorts{
+		excluded:     excluded,
+		udpListeners: make(map[uint16]bool),
+		local:        local,
+		sessionPorts: make(map[uint16]bool),
 	}
-	intCount, err := strconv.Atoi(strings.TrimSpace(string(intBuffer)))
-	if err != nil {
-		log.Printf("missed.txt is corrupted! Got '%s' for port %d\n", string(intBuffer), port)
-		return
+	for _, port := range config.UDPPorts {
+		ports.udpListeners[port] = true
+	}
+	if config.Capture {
+		for _, port := range config.SessionPorts {
+			ports.sessionPorts[port] = true
+		}
 	}
+	return ports
+}
+
+// packetHandler runs captured packets through the missed port pipeline
+type packetHandler struct {
+	missedStore    *MissedStore
+	adaptive       *adaptiveTracker
+	events         *missedEvents
+	scans          *scanDetector
+	backscatter    *backscatterEvents
+	fingerprinting bool
+	// Holds a *watchedPorts, shared with the handler's workers
+	ports *atomic.Value
+	// What we've sent from our own addresses
+	solicited *solicitedFlows
+	capturing bool
+	// Only set when replaying a capture with stream reassembly
+	streams *streamReplay
+
+	tcp      layers.TCP
+	udp      layers.UDP
+	eth      layers.Ethernet
+	sll      layers.LinuxSLL
+	loopback layers.Loopback
+	ip4      layers.IPv4
+	ip6      layers.IPv6
+	icmp4    layers.ICMPv4
+	icmp6    layers.ICMPv6
+	// A parser for each first layer, all decoding into the layers above
+	parsers map[gopacket.LayerType]*gopacket.DecodingLayerParser
+	decoded []gopacket.LayerType
+}
 
-	intCount++
+// capturedPacket is a packet read from one of the interfaces
+type capturedPacket struct {
+	data     []byte
+	info     gopacket.CaptureInfo
+	linkType layers.LinkType
+}
 
-	outFile.Seek(-portCountLength, 1)
-	newNum := fmt.Sprintf("%"+strconv.Itoa(portCountLength)+"d", intCount)
-	if len(newNum) > portCountLength {
-		intCount--
+// DLT_RAW, which is what libpcap gives for raw IP interfaces like tun and wireguard
+const linkTypeRawDLT layers.LinkType = 12
+
+// linkLayer picks the layer a packet starts with from its link type. Raw IP can be either
+// IPv4 or IPv6, so it's taken from the version in the packet.
+func linkLayer(linkType layers.LinkType, data []byte) (gopacket.LayerType, bool) {
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		return layers.LayerTypeEthernet, true
+	case layers.LinkTypeLinuxSLL:
+		return layers.LayerTypeLinuxSLL, true
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		return layers.LayerTypeLoopback, true
+	case layers.LinkTypeRaw, linkTypeRawDLT, layers.LinkTypeIPv4, layers.LinkTypeIPv6:
+		if len(data) > 0 && data[0]>>4 == 6 {
+			return layers.LayerTypeIPv6, true
+		}
+		return layers.LayerTypeIPv4, true
 	}
-	fmt.Fprintf(outFile, "%"+strconv.Itoa(portCountLength)+"d", intCount)
-	outFile.Sync()
+	return gopacket.LayerTypeZero, false
+}
 
+// parser gets the parser for packets starting with first, making it the first time
+func (h *packetHandler) parser(first gopacket.LayerType) *gopacket.DecodingLayerParser {
+	parser, ok := h.parsers[first]
+	if !ok {
+		parser = gopacket.NewDecodingLayerParser(first, &h.eth, &h.sll, &h.loopback, &h.ip4, &h.ip6, &h.tcp, &h.udp, &h.icmp4, &h.icmp6)
+		h.parsers[first] = parser
+	}
+	return parser
 }
 
-func watcherRun(iface string, pcapFilter string, contChan chan bool) {
+// newPacketHandler sets up the pipeline. Without background, windowed events are only sent
+// as the packet times move along, which is used when replaying.
+func newPacketHandler(config Config, missedStore *MissedStore, excluded map[uint16]bool, local map[string]bool, background bool) *packetHandler {
+	handler := &packetHandler{
+		missedStore:    missedStore,
+		adaptive:       newAdaptiveTracker(config.Adaptive),
+		events:         newMissedEvents(config.Events, background),
+		scans:          newScanDetector(config.Scans, background),
+		backscatter:    newBackscatterEvents(config.Backscatter, background),
+		fingerprinting: config.Fingerprint,
+		ports:          new(atomic.Value),
+		solicited:      newSolicitedFlows(),
+		capturing:      config.Capture,
+		parsers:        make(map[gopacket.LayerType]*gopacket.DecodingLayerParser),
+		decoded:        []gopacket.LayerType{},
+	}
+	handler.ports.Store(newWatchedPorts(config, excluded, local))
+	return handler
+}
 
-	missedPath := "missed.txt"
+func (h *packetHandler) watched() *watchedPorts {
+	return h.ports.Load().(*watchedPorts)
+}
 
-	missedFile, err := os.OpenFile(missedPath, os.O_RDWR|os.O_CREATE, 0755)
-	if err != nil {
-		log.Fatalf("Could not open missed file: %s\n", err)
+// worker makes a handler that decodes packets separately, but shares everything else with h,
+// so packets can be handled from several goroutines
+func (h *packetHandler) worker() *packetHandler {
+	worker := &packetHandler{}
+	*worker = *h
+	worker.parsers = make(map[gopacket.LayerType]*gopacket.DecodingLayerParser)
+	worker.decoded = []gopacket.LayerType{}
+	return worker
+}
+
+// finish sends records for everything still being aggregated, now is when packets stopped
+func (h *packetHandler) finish(config Config, now time.Time) {
+	h.events.flush()
+	h.backscatter.flush()
+	h.scans.check(now.Add(config.Scans.Idle))
+}
+
+// handleICMP checks ICMP errors for backscatter. The quoted packet has our address as the
+// source, so if we didn't send it, someone spoofed us. Errors quoting someone else's packet
+// aren't about us at all.
+func (h *packetHandler) handleICMP(protocol string, source string, typeName string, quoted []byte, now time.Time) {
+	quotedProtocol, quotedSource, quotedSourcePort, victim, victimPort, ok := quotedPacket(quoted)
+	if !ok || !h.watched().local[quotedSource] {
 		return
 	}
-	defer missedFile.Close()
-
-	stat, err := missedFile.Stat()
-	if err != nil {
-		log.Fatalf("Could not stat missed file: %s\n", err)
+	if h.solicited.check(flowKey{protocol: quotedProtocol, remote: victim, remotePort: victimPort, localPort: quotedSourcePort}, now) {
 		return
 	}
+	if quotedProtocol == layers.LayerTypeUDP && h.watched().udpListeners[quotedSourcePort] {
+		typeName = BackscatterReflection
+	}
+	h.backscatter.observe(typeName, protocol, source, victim, victimPort, now)
+}
+
+// handle processes a single packet, now is when the packet was captured
+func (h *packetHandler) handle(data []byte, info gopacket.CaptureInfo, linkType layers.LinkType, now time.Time) {
+	tcp := &h.tcp
+	udp := &h.udp
+	ports := h.watched()
 
-	lineLength := 6 + portCountLength + 1 + portCountLength + 1
-	maxSize := (int64)(lineLength) * 65535
+	first, ok := linkLayer(linkType, data)
+	if !ok {
+		return
+	}
+	h.parser(first).DecodeLayers(data, &h.decoded)
+	if last := len(h.decoded) - 1; last >= 0 && h.decoded[last] == layers.LayerTypeIPv4 {
+		if layerType, ok := h.firstFragment(); ok {
+			h.decoded = append(h.decoded, layerType)
+		}
+	}
 
-	if stat.Size() < maxSize {
-		log.Println("Setting up missed.txt")
-		var i int64
-		for i = 0; i < 65535; i++ {
-			fmt.Fprintf(missedFile, "%5d|", i+1)
-			fmt.Fprintf(missedFile, "%"+strconv.Itoa(portCountLength)+"d", 0)
-			missedFile.WriteString("|")
-			fmt.Fprintf(missedFile, "%"+strconv.Itoa(portCountLength)+"d", 0)
-			missedFile.WriteString("\n")
+	source := ""
+	target := ""
+	isIPv6 := false
+	// Used for protocols that aren't decoded
+	var ipProtocol layers.IPProtocol
+	var ipPayload []byte
+	transport := false
+	for _, layerType := range h.decoded {
+		if layerType == layers.LayerTypeIPv4 {
+			source = h.ip4.SrcIP.String()
+			target = h.ip4.DstIP.String()
+			// Only the first fragment has the headers we need, later ones would be counted again
+			if h.ip4.FragOffset == 0 {
+				ipProtocol = h.ip4.Protocol
+				ipPayload = h.ip4.Payload
+			}
+		} else if layerType == layers.LayerTypeIPv6 {
+			source = h.ip6.SrcIP.String()
+			target = h.ip6.DstIP.String()
+			isIPv6 = true
+			ipProtocol = h.ip6.NextHeader
+			ipPayload = h.ip6.Payload
+		} else if layerType == layers.LayerTypeTCP {
+			transport = true
+			if h.capturing {
+				capture.Add(linkType, info, data, source, (uint16)(tcp.SrcPort), target, (uint16)(tcp.DstPort), tcp.SYN, tcp.FIN || tcp.RST)
+				// Our side of a session is only here for the capture
+				if ports.local[source] && ports.sessionPorts[(uint16)(tcp.SrcPort)] {
+					continue
+				}
+			}
+			if ports.local[source] {
+				// Only connections we start get this far
+				if tcp.SYN && !tcp.ACK {
+					h.solicited.add(flowKey{protocol: layers.LayerTypeTCP, remote: target, remotePort: (uint16)(tcp.DstPort), localPort: (uint16)(tcp.SrcPort)}, now)
+				}
+				continue
+			}
+			if h.solicited.check(flowKey{protocol: layers.LayerTypeTCP, remote: source, remotePort: (uint16)(tcp.SrcPort), localPort: (uint16)(tcp.DstPort)}, now) {
+				continue
+			}
+			if h.fingerprinting && tcp.SYN && !tcp.ACK {
+				if isIPv6 {
+					fingerprint.Remember(source, (uint16)(tcp.SrcPort), fingerprint.FromSYN(nil, &h.ip6, tcp))
+				} else {
+					fingerprint.Remember(source, (uint16)(tcp.SrcPort), fingerprint.FromSYN(&h.ip4, nil, tcp))
+				}
+			}
+			if h.streams != nil && h.streams.ports[(uint16)(tcp.DstPort)] {
+				if isIPv6 {
+					h.streams.assemble(h.ip6.NetworkFlow(), tcp, now)
+				} else {
+					h.streams.assemble(h.ip4.NetworkFlow(), tcp, now)
+				}
+			}
+			if ports.excluded[(uint16)(tcp.DstPort)] || h.adaptive.isServed(layers.LayerTypeTCP, (uint16)(tcp.DstPort)) {
+				continue
+			}
+			// Replies to connections we never started, the sender is the victim of a spoofed attack
+			if tcp.SYN && tcp.ACK {
+				h.backscatter.observe(BackscatterSYNACK, "tcp", source, source, (uint16)(tcp.SrcPort), now)
+				continue
+			} else if tcp.RST {
+				h.backscatter.observe(BackscatterRST, "tcp", source, source, (uint16)(tcp.SrcPort), now)
+				continue
+			}
+			h.missedStore.Hit(layers.LayerTypeTCP, (uint16)(tcp.DstPort), source, now)
+			h.events.observe(layers.LayerTypeTCP, source, (uint16)(tcp.SrcPort), (uint16)(tcp.DstPort), tcpFlagNames(tcp), nil, now)
+			h.scans.observe(layers.LayerTypeTCP, source, target, (uint16)(tcp.DstPort), scanTechnique(tcp), now)
+			// Only count connection attempts towards opening a listener
+			if tcp.SYN && !tcp.ACK {
+				h.adaptive.observe(layers.LayerTypeTCP, (uint16)(tcp.DstPort), now)
+			}
+		} else if layerType == layers.LayerTypeUDP {
+			transport = true
+			if ports.local[source] {
+				if !ports.udpListeners[(uint16)(udp.SrcPort)] {
+					h.solicited.add(flowKey{protocol: layers.LayerTypeUDP, remote: target, remotePort: (uint16)(udp.DstPort), localPort: (uint16)(udp.SrcPort)}, now)
+				}
+				continue
+			}
+			if h.solicited.check(flowKey{protocol: layers.LayerTypeUDP, remote: source, remotePort: (uint16)(udp.SrcPort), localPort: (uint16)(udp.DstPort)}, now) {
+				continue
+			}
+			if h.adaptive.isServed(layers.LayerTypeUDP, (uint16)(udp.DstPort)) {
+				continue
+			}
+			h.missedStore.Hit(layers.LayerTypeUDP, (uint16)(udp.DstPort), source, now)
+			h.events.observe(layers.LayerTypeUDP, source, (uint16)(udp.SrcPort), (uint16)(udp.DstPort), nil, nil, now)
+			h.scans.observe(layers.LayerTypeUDP, source, target, (uint16)(udp.DstPort), "UDP", now)
+			h.adaptive.observe(layers.LayerTypeUDP, (uint16)(udp.DstPort), now)
+		} else if layerType == layers.LayerTypeICMPv4 {
+			transport = true
+			if ports.local[source] {
+				continue
+			}
+			h.handleICMPv4(source, target, now)
+		} else if layerType == layers.LayerTypeICMPv6 {
+			transport = true
+			if ports.local[source] {
+				continue
+			}
+			h.handleICMPv6(source, target, now)
 		}
 	}
 
+	if !transport && ipPayload != nil && !ports.local[source] {
+		h.handleOtherIP(ipProtocol, ipPayload, isIPv6, source, target, now)
+	}
+}
+
+// openInterface starts capturing on an interface
+func openInterface(iface string, pcapFilter string) *pcap.Handle {
 	pcapHandle, err := pcap.OpenLive(iface, 1600, true, pcap.BlockForever)
 
 	if err != nil {
 		log.Fatalf("Could not open interface %s for listening: %s\n", iface, err)
-		return
+		return nil
+	}
+
+	if _, ok := linkLayer(pcapHandle.LinkType(), nil); !ok {
+		log.Fatalf("Interface %s has unsupported link type %s\n", iface, pcapHandle.LinkType())
+		return nil
 	}
 
 	err = pcapHandle.SetBPFFilter(pcapFilter)
 
 	if err != nil {
 		log.Fatalf("Could not set filter %s for interface %s: %s\n", pcapFilter, iface, err)
+		return nil
+	}
+	return pcapHandle
+}
+
+// capturePackets sends the packets from an interface to the watcher
+func capturePackets(iface string, pcapHandle *pcap.Handle, packets chan capturedPacket) {
+	linkType := pcapHandle.LinkType()
+	// Session captures are written with the link type, and files use a different number
+	if linkType == linkTypeRawDLT {
+		linkType = layers.LinkTypeRaw
+	}
+	pcapPacket := gopacket.NewPacketSource(pcapHandle, linkType)
+	for packet := range pcapPacket.Packets() {
+		packets <- capturedPacket{data: packet.Data(), info: packet.Metadata().CaptureInfo, linkType: linkType}
+	}
+	log.Printf("Stopped capturing on interface %s\n", iface)
+}
+
+func watcherRun(config Config, pcapFilter string, excluded map[uint16]bool, local map[string]bool, contChan chan bool) {
+	defer running.Done()
+
+	missedPath := config.MissedPath
+	missedStore, err := OpenMissedStore(missedPath)
+	if err != nil {
+		log.Fatalf("Could not open missed port database %s: %s\n", missedPath, err)
+		return
+	}
+	defer missedStore.Close()
+	missedStore.StartFlushing()
+
+	handler := newPacketHandler(config, missedStore, excluded, local, true)
+	live.lock.Lock()
+	live.config = config
+	live.filter = pcapFilter
+	live.handler = handler
+	live.lock.Unlock()
+
+	if config.AFPacket.Enabled {
+		runAFPacket(config, pcapFilter, handler, contChan)
+		handler.finish(config, time.Now())
 		return
 	}
 
+	// Each interface gets its own capture, but packets are all handled here
+	packets := make(chan capturedPacket, 1024)
+	handles := make([]*pcap.Handle, 0, len(config.Interfaces))
+	var captures sync.WaitGroup
+	for _, iface := range config.Interfaces {
+		pcapHandle := openInterface(iface, pcapFilter)
+		handles = append(handles, pcapHandle)
+		captures.Add(1)
+		go func(iface string, pcapHandle *pcap.Handle) {
+			defer captures.Done()
+			capturePackets(iface, pcapHandle, packets)
+		}(iface, pcapHandle)
+	}
+
+	live.lock.Lock()
+	live.setFilter = func(filter string) error {
+		for _, pcapHandle := range handles {
+			err := pcapHandle.SetBPFFilter(filter)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	live.lock.Unlock()
+
 	log.Println("Missed port watcher listening...")
 	contChan <- true
 
-	var tcp layers.TCP
-	var udp layers.UDP
-	var eth layers.Ethernet
-	var ip4 layers.IPv4
-	var ip6 layers.IPv6
+	// Closing the handles ends the captures, packets already read are still handled
+	go func() {
+		<-stopping
+		for _, pcapHandle := range handles {
+			pcapHandle.Close()
+		}
+		captures.Wait()
+		close(packets)
+	}()
 
-	parser := gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &eth, &ip4, &ip6, &tcp, &udp)
-	decodedPacket := []gopacket.LayerType{}
+	for packet := range packets {
+		handler.handle(packet.data, packet.info, packet.linkType, time.Now())
+	}
+	handler.finish(config, time.Now())
+}
 
-	pcapPacket := gopacket.NewPacketSource(pcapHandle, pcapHandle.LinkType())
-	for packet := range pcapPacket.Packets() {
+// interfaceAddrs gets the addresses of an interface, or of every interface for "any"
+func interfaceAddrs(iface string) ([]net.Addr, error) {
+	if iface == "any" {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return nil, fmt.Errorf("Could not get interface addresses")
+		}
+		return addrs, nil
+	}
 
-		err = parser.DecodeLayers(packet.Data(), &decodedPacket)
-		// if err != nil {
-		// 	fmt.Printf("err: %s\n", err)
-		// 	continue
-		// }
+	ifaceInfo, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get interface %s", iface)
+	}
+
+	addrs, err := ifaceInfo.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("Could not get interface %s addresses", iface)
+	}
+	return addrs, nil
+}
+
+// watcherFilter adds what the watcher needs to the configured filter, and leaves out traffic
+// sent by the interfaces' own addresses, which are also returned
+func watcherFilter(config Config) (string, map[uint16]bool, map[string]bool, error) {
+	newFilter := config.Filter
+
+	excluded := make(map[uint16]bool)
+	local := make(map[string]bool)
+	for _, port := range config.ExcludedTCPPorts {
+		excluded[port] = true
+	}
+	if config.Fingerprint {
+		if newFilter != "" {
+			newFilter = "(" + synFilter + ") or (" + newFilter + ")"
+		}
+	}
 
-		for _, layerType := range decodedPacket {
-			if layerType == layers.LayerTypeTCP {
-				logPacket(layers.LayerTypeTCP, (uint16)(tcp.DstPort), missedFile)
-			} else if layerType == layers.LayerTypeUDP {
-				logPacket(layers.LayerTypeUDP, (uint16)(udp.DstPort), missedFile)
+	// Get interface address info so we don't intercept data sent by us. The same address
+	// can be on more than one interface.
+	localAddrs := make([]string, 0)
+	for _, iface := range config.Interfaces {
+		addrs, err := interfaceAddrs(iface)
+		if err != nil {
+			return newFilter, excluded, local, err
+		}
+
+		for _, addr := range addrs {
+			var ip net.IP
+			switch v := addr.(type) {
+			case *net.IPNet:
+				ip = v.IP
+			case *net.IPAddr:
+				ip = v.IP
+			}
+			if ip == nil || local[ip.String()] {
+				continue
+			}
+			host, err := filterHost(ip.String())
+			if err != nil {
+				return newFilter, excluded, local, err
 			}
+			local[ip.String()] = true
+			localAddrs = append(localAddrs, host)
 		}
+	}
+
+	if len(localAddrs) > 0 {
+		newFilter = andFilter(newFilter, "not ("+hostFilter("src", localAddrs)+")")
+
+		// Connections and UDP we start, so their replies can be told apart from backscatter
+		newFilter = "(" + newFilter + ") or ((" + synFilter + " or udp) and (" + hostFilter("src", localAddrs) + "))"
+	}
 
+	// Both sides of sessions to our listeners, after our own traffic is left out
+	if config.Capture && len(config.SessionPorts) > 0 && newFilter != "" {
+		newFilter = "(" + newFilter + ") or (" + PortFilter("tcp", config.SessionPorts) + ")"
 	}
 
+	// Anything the user wants left out applies to all of it
+	newFilter = andFilter(newFilter, config.ExtraFilter)
+
+	return newFilter, excluded, local, nil
 }
 
 // StartWatcher starts the missed port watcher
-func StartWatcher(iface string, pcapFilter string, contChan chan bool) {
-
-	newFilter := pcapFilter
+func StartWatcher(config Config, contChan chan bool) {
 
-	// Get interface address info so we don't intercept data sent by us
-	ifaceInfo, err := net.InterfaceByName(iface)
+	// Checked on its own first, so mistakes in it are easier to find
+	err := ValidateFilter(config.ExtraFilter)
 	if err != nil {
-		log.Fatalf("Could not get interface %s\n", iface)
+		log.Fatalf("Extra filter %s is not valid: %s\n", config.ExtraFilter, err)
 		return
 	}
 
-	addrs, err := ifaceInfo.Addrs()
+	newFilter, excluded, local, err := watcherFilter(config)
 	if err != nil {
-		log.Fatalf("Could not get interface %s addresses\n", iface)
+		log.Fatalln(err)
 		return
 	}
 
-	for _, addr := range addrs {
-		var ip net.IP
-		switch v := addr.(type) {
-		case *net.IPNet:
-			ip = v.IP
-		case *net.IPAddr:
-			ip = v.IP
-		}
-		if newFilter != "" {
-			newFilter += " and not src host " + ip.String()
-		} else {
-			newFilter += "not src host " + ip.String()
-		}
-
+	err = ValidateFilter(newFilter)
+	if err != nil {
+		log.Fatalf("Watcher filter %s is not valid: %s\n", newFilter, err)
+		return
 	}
 
 	log.Printf("Watcher filter: \n\n%s\n\n", newFilter)
 
 	log.Println("Starting missed port watcher...")
-	go watcherRun(iface, newFilter, contChan)
+	running.Add(1)
+	go watcherRun(config, newFilter, excluded, local, contChan)
+}
+
+// Reload changes the filter and ports of the running watcher to those in config, which are
+// Filter, ExcludedTCPPorts, SessionPorts, UDPPorts and ExtraFilter. Anything else needs a restart.
+func Reload(config Config) error {
+	live.lock.Lock()
+	defer live.lock.Unlock()
+	if live.handler == nil || live.setFilter == nil {
+		return errors.New("The watcher isn't running")
+	}
+
+	err := ValidateFilter(config.ExtraFilter)
+	if err != nil {
+		return fmt.Errorf("Extra filter %s is not valid: %s", config.ExtraFilter, err)
+	}
+
+	running := live.config
+	running.Filter = config.Filter
+	running.ExcludedTCPPorts = config.ExcludedTCPPorts
+	running.SessionPorts = config.SessionPorts
+	running.UDPPorts = config.UDPPorts
+	running.ExtraFilter = config.ExtraFilter
+
+	newFilter, excluded, local, err := watcherFilter(running)
+	if err != nil {
+		return err
+	}
+	err = ValidateFilter(newFilter)
+	if err != nil {
+		return fmt.Errorf("Watcher filter %s is not valid: %s", newFilter, err)
+	}
+
+	// Ports first, so packets to new listeners that get in before the filter changes are left out
+	live.handler.ports.Store(newWatchedPorts(running, excluded, local))
+	if newFilter != live.filter {
+		err = live.setFilter(newFilter)
+		if err != nil {
+			return err
+		}
+		log.Printf("Watcher filter: \n\n%s\n\n", newFilter)
+	}
+
+	live.config = running
+	live.filter = newFilter
+	return nil
+}
+
+// StopWatcher stops capturing, sends records for everything still being aggregated and
+// writes out the missed port database. Nothing is sent on the record channel after this.
+func StopWatcher() {
+	close(stopping)
+	running.Wait()
 }
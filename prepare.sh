@@ -6,16 +6,15 @@ if [ ! -f config.json ]; then
 fi 
 
 echo ""
-echo "Setting up 'large' directory..."
+echo "Setting up 'large' and 'sessions' directories..."
 if [ -f config.json ]; then
     USER=$(grep '"user":' config.json | cut -d":" -f 2 | sed 's_[", ]__g')
     GROUP=$(grep '"group":' config.json | cut -d":" -f 2 | sed 's_[", ]__g')
-    mkdir -p ./large
-    sudo chown ${USER}:${GROUP} ./large
+    mkdir -p ./large ./sessions
+    sudo chown ${USER}:${GROUP} ./large ./sessions
 else
-    echo "config.json does not exist, cannot create 'large' directory"
+    echo "config.json does not exist, cannot create 'large' and 'sessions' directories"
 fi
 
 echo ""
-echo "Creating SSL certificate..."
-openssl req -new -x509 -days 365 -nodes -out honeypoke_cert.pem -keyout honeypoke_key.pem
\ No newline at end of file
+echo "SSL certificates that don't exist will be generated by HoneyPoke when it starts"